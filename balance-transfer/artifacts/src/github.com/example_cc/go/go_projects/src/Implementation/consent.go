@@ -0,0 +1,400 @@
+package implementation
+
+import (
+	entity "Model"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+)
+
+// consentReceiptVersion is the Kantara consent receipt specification receipts follow
+const consentReceiptVersion = "KI-CR-v1.1.0"
+
+// consentReceiptCollection holds the receipt chains, next to the consents they record
+const consentReceiptCollection = "patientDetailsIn2Orgs"
+
+// ============================================================
+// RegisterPatientKey - register the public key of the calling patient's device,
+// used to verify signed consent changes. Replacing a registered key takes a
+// signature over the new key made with the current one; a patient who lost
+// their device has an admin reset the key with ResetPatientKey instead. Keys are
+// stored under the keyed hash of the patient id, so SetPurgeKey must be called first.
+// ============================================================
+func (u *User) RegisterPatientKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0                                      1
+	// "-----BEGIN PUBLIC KEY-----\n...", "MEUCIQ..."
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	patientId, err := getAttribute(stub, "id")
+	if err != nil {
+		return shim.Error("Fails to get id " + err.Error())
+	}
+
+	_, err = parseECDSAPublicKey(args[0])
+	if err != nil {
+		return shim.Error("1st argument must be a PEM encoded ECDSA public key: " + err.Error())
+	}
+
+	patientKeyKey, err := getPatientKeyKey(stub, patientId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	currentKey, err := stub.GetState(patientKeyKey)
+	if err != nil {
+		return shim.Error("Fails to get patient key " + err.Error())
+	}
+	if currentKey != nil {
+		if len(args) != 2 {
+			return shim.Error("A key is already registered, 2nd argument must be a signature over the new key made with it")
+		}
+		err = verifyPatientSignature(stub, patientId, []byte(args[0]), args[1])
+		if err != nil {
+			return shim.Error("Fails to verify the key change " + err.Error())
+		}
+	}
+
+	err = stub.PutState(patientKeyKey, []byte(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================
+// ResetPatientKey - admin only, remove a patient's registered key so that a
+// patient who lost their device can register a new one
+// ============================================================
+func (u *User) ResetPatientKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "pat001"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	mspRole, err := getAttribute(stub, "mspRole")
+	if err != nil {
+		return shim.Error("Fails to get mspRole " + err.Error())
+	}
+	if mspRole != "admin" {
+		return shim.Error("Unauthorized!")
+	}
+
+	patientKeyKey, err := getPatientKeyKey(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(patientKeyKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================
+// GetConsentReceiptHead - return the sequence number and hash of the calling
+// patient's latest receipt, which the next signed consent change must cover
+// ============================================================
+func (u *User) GetConsentReceiptHead(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	patientId, err := getAttribute(stub, "id")
+	if err != nil {
+		return shim.Error("Fails to get id " + err.Error())
+	}
+
+	head, err := getConsentReceiptHead(stub, patientId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	headAsBytes, err := json.Marshal(head)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(headAsBytes)
+}
+
+// ============================================================
+// GetConsentReceipts - return the calling patient's consent receipt chain, oldest first
+// ============================================================
+func (u *User) GetConsentReceipts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	patientId, err := getAttribute(stub, "id")
+	if err != nil {
+		return shim.Error("Fails to get id " + err.Error())
+	}
+
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(consentReceiptCollection, "consentReceipt", []string{patientId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	receipts := []entity.ConsentReceipt{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var receipt entity.ConsentReceipt
+		err = json.Unmarshal(queryResponse.Value, &receipt)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	receiptsAsBytes, err := json.Marshal(receipts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(receiptsAsBytes)
+}
+
+// issueConsentReceipt appends a receipt for a consent change to the patient's chain
+// and returns the stored receipt. payload is the consent JSON exactly as submitted;
+// when signature is set it must be a base64 ASN.1 ECDSA signature made with the
+// patient's registered key over consentSigningBytes, so that a signed change cannot
+// be replayed at another position of the chain.
+func issueConsentReceipt(stub shim.ChaincodeStubInterface, patientId string, consent entity.PatientDetailsUnmarshal, payload string, signature string) ([]byte, error) {
+	head, err := getConsentReceiptHead(stub, patientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if signature != "" {
+		err = verifyPatientSignature(stub, patientId, consentSigningBytes(head.Sequence+1, head.Hash, payload), signature)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	payloadHash := sha256.Sum256([]byte(payload))
+	receipt := &entity.ConsentReceipt{
+		Version:             consentReceiptVersion,
+		ConsentReceiptID:    stub.GetTxID(),
+		ConsentTimestamp:    txTimestamp.Seconds,
+		CollectionMethod:    "UpdateProviderAccess",
+		PiiPrincipalId:      patientId,
+		Sequence:            head.Sequence + 1,
+		Services:            consentServices(consent),
+		ConsentHash:         hex.EncodeToString(payloadHash[:]),
+		PreviousReceiptHash: head.Hash,
+		Signature:           signature,
+	}
+	receiptAsBytes, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Zero padded so the partial composite key scan returns the chain in order
+	receiptKey, err := stub.CreateCompositeKey("consentReceipt", []string{patientId, fmt.Sprintf("%020d", receipt.Sequence)})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutPrivateData(consentReceiptCollection, receiptKey, receiptAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	receiptHash := sha256.Sum256(receiptAsBytes)
+	head = &entity.ConsentReceiptHead{Sequence: receipt.Sequence, Hash: hex.EncodeToString(receiptHash[:])}
+	headAsBytes, err := json.Marshal(head)
+	if err != nil {
+		return nil, err
+	}
+	headKey, err := stub.CreateCompositeKey("consentReceiptHead", []string{patientId})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutPrivateData(consentReceiptCollection, headKey, headAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return receiptAsBytes, nil
+}
+
+// getConsentReceiptHead returns the head of a patient's receipt chain, the zero
+// head when no receipt has been issued yet
+func getConsentReceiptHead(stub shim.ChaincodeStubInterface, patientId string) (*entity.ConsentReceiptHead, error) {
+	headKey, err := stub.CreateCompositeKey("consentReceiptHead", []string{patientId})
+	if err != nil {
+		return nil, err
+	}
+	headAsBytes, err := stub.GetPrivateData(consentReceiptCollection, headKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get consent receipt head")
+	}
+	head := &entity.ConsentReceiptHead{}
+	if headAsBytes != nil {
+		err = json.Unmarshal(headAsBytes, head)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return head, nil
+}
+
+// consentSigningBytes are the bytes a patient signs for a consent change: the
+// sequence number the receipt will get, the hash of the receipt before it and the
+// consent JSON, one per line
+func consentSigningBytes(sequence uint64, previousReceiptHash string, payload string) []byte {
+	return []byte(fmt.Sprintf("%d\n%s\n%s", sequence, previousReceiptHash, payload))
+}
+
+// consentServices lists the provider consents carried by a consent change
+func consentServices(consent entity.PatientDetailsUnmarshal) []entity.ConsentService {
+	categories := []struct {
+		service  string
+		consents []entity.Consent
+	}{
+		{"allergies", consent.Allergies.ProviderConsent},
+		{"immunization", consent.Immunization.ProviderConsent},
+		{"medications", consent.Medications.ProviderConsent},
+		{"pastMedicalHx", consent.PastMedicalHx.ProviderConsent},
+		{"familyHx", consent.FamilyHx.ProviderConsent},
+	}
+
+	services := []entity.ConsentService{}
+	for _, category := range categories {
+		for _, c := range category.consents {
+			services = append(services, entity.ConsentService{
+				Service:    category.service,
+				ProviderId: c.Provider.ProviderId,
+				StartTime:  c.StartTime,
+				EndTime:    c.EndTime,
+			})
+		}
+	}
+	return services
+}
+
+// verifyPatientSignature checks a signature over the SHA-256 of message against the
+// patient's registered key
+func verifyPatientSignature(stub shim.ChaincodeStubInterface, patientId string, message []byte, signature string) error {
+	patientKeyKey, err := getPatientKeyKey(stub, patientId)
+	if err != nil {
+		return err
+	}
+	pemAsBytes, err := stub.GetState(patientKeyKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to get patient key")
+	} else if pemAsBytes == nil {
+		return errors.New("no public key registered for " + patientId)
+	}
+
+	publicKey, err := parseECDSAPublicKey(string(pemAsBytes))
+	if err != nil {
+		return err
+	}
+
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(err, "signature must be base64 encoded")
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return errors.Wrap(err, "signature must be an ASN.1 ECDSA signature")
+	}
+
+	digest := sha256.Sum256(message)
+	if !ecdsa.Verify(publicKey, digest[:], sig.R, sig.S) {
+		return errors.New("signature does not verify against the key registered for " + patientId)
+	}
+	return nil
+}
+
+// getPatientKeyKey returns the key of a patient's registered public key. The public
+// state keeps the history of its keys, so they carry the keyed hash of the patient id
+// used by purge tombstones rather than the id itself.
+func getPatientKeyKey(stub shim.ChaincodeStubInterface, patientId string) (string, error) {
+	patientIdHash, err := hashPatientId(stub, patientId)
+	if err != nil {
+		return "", err
+	}
+	return stub.CreateCompositeKey("patientKey", []string{patientIdHash})
+}
+
+// parseECDSAPublicKey parses a PEM encoded PKIX ECDSA public key
+func parseECDSAPublicKey(pemString string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemString))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key is not an ECDSA public key")
+	}
+	return publicKey, nil
+}
+
+// purgeConsentRecords purges a patient's receipt chain and registered key
+func purgeConsentRecords(stub shim.ChaincodeStubInterface, patientId string) error {
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(consentReceiptCollection, "consentReceipt", []string{patientId})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		err = purgePrivateData(stub, consentReceiptCollection, queryResponse.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	headKey, err := stub.CreateCompositeKey("consentReceiptHead", []string{patientId})
+	if err != nil {
+		return err
+	}
+	err = purgePrivateData(stub, consentReceiptCollection, headKey)
+	if err != nil {
+		return err
+	}
+
+	patientKeyKey, err := getPatientKeyKey(stub, patientId)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(patientKeyKey)
+}
@@ -0,0 +1,198 @@
+package implementation
+
+import (
+	entity "Model"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+func newPatientKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, message []byte) string {
+	digest := sha256.Sum256(message)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// issue runs issueConsentReceipt as a transaction of the patient
+func issue(stub *testStub, patient []byte, payload string, signature string) pb.Response {
+	return stub.call(patient, func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+		receiptAsBytes, err := issueConsentReceipt(stub, "pat1", entity.PatientDetailsUnmarshal{}, args[0], args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(receiptAsBytes)
+	}, payload, signature)
+}
+
+func TestRegisterPatientKey(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	patient := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "pat1"})
+	admin := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "adm1"})
+	firstKey, firstPEM := newPatientKey(t)
+	_, secondPEM := newPatientKey(t)
+	thirdKey, thirdPEM := newPatientKey(t)
+
+	expectError(t, stub.call(patient, u.RegisterPatientKey, firstPEM), "SetPurgeKey")
+	setPurgeKey(t, stub)
+	expectError(t, stub.call(patient, u.RegisterPatientKey, "not a key"), "PEM encoded ECDSA public key")
+	expectSuccess(t, stub.call(patient, u.RegisterPatientKey, firstPEM))
+
+	// ==== Replacing the key takes a signature from the current one ====
+	expectError(t, stub.call(patient, u.RegisterPatientKey, secondPEM), "already registered")
+	expectError(t, stub.call(patient, u.RegisterPatientKey, secondPEM, sign(t, thirdKey, []byte(secondPEM))), "does not verify")
+	expectError(t, stub.call(patient, u.RegisterPatientKey, secondPEM, sign(t, firstKey, []byte(thirdPEM))), "does not verify")
+	expectSuccess(t, stub.call(patient, u.RegisterPatientKey, secondPEM, sign(t, firstKey, []byte(secondPEM))))
+
+	// ==== A lost key is reset by an admin ====
+	expectError(t, stub.call(patient, u.ResetPatientKey, "pat1"), "Unauthorized")
+	expectSuccess(t, stub.call(admin, u.ResetPatientKey, "pat1"))
+	expectSuccess(t, stub.call(patient, u.RegisterPatientKey, thirdPEM))
+
+	patientKeyKey, err := getPatientKeyKey(stub, "pat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stub.State[patientKeyKey]) != thirdPEM {
+		t.Fatal("expected the key registered after the reset")
+	}
+	plainKey, _ := stub.CreateCompositeKey("patientKey", []string{"pat1"})
+	if stub.State[plainKey] != nil {
+		t.Fatal("patient keys must not be stored under the plain patient id")
+	}
+}
+
+func TestConsentReceiptChain(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	patient := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "pat1"})
+	key, keyPEM := newPatientKey(t)
+	setPurgeKey(t, stub)
+	expectSuccess(t, stub.call(patient, u.RegisterPatientKey, keyPEM))
+
+	head := func() entity.ConsentReceiptHead {
+		var head entity.ConsentReceiptHead
+		err := json.Unmarshal(expectSuccess(t, stub.call(patient, u.GetConsentReceiptHead)), &head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return head
+	}
+
+	first := head()
+	if first.Sequence != 0 || first.Hash != "" {
+		t.Fatalf("expected an empty chain, got %+v", first)
+	}
+	firstPayload := `{"allergies":{}}`
+	firstSignature := sign(t, key, consentSigningBytes(1, "", firstPayload))
+	expectError(t, issue(stub, patient, firstPayload, sign(t, key, []byte(firstPayload))), "does not verify")
+	receiptAsBytes := expectSuccess(t, issue(stub, patient, firstPayload, firstSignature))
+
+	// ==== The first signature does not cover the second position of the chain ====
+	second := head()
+	receiptHash := sha256.Sum256(receiptAsBytes)
+	if second.Sequence != 1 || second.Hash != hex.EncodeToString(receiptHash[:]) {
+		t.Fatalf("head does not point at the first receipt: %+v", second)
+	}
+	expectError(t, issue(stub, patient, firstPayload, firstSignature), "does not verify")
+	secondPayload := `{"medications":{}}`
+	expectSuccess(t, issue(stub, patient, secondPayload, sign(t, key, consentSigningBytes(2, second.Hash, secondPayload))))
+	expectSuccess(t, issue(stub, patient, `{}`, ""))
+
+	var receipts []entity.ConsentReceipt
+	err := json.Unmarshal(expectSuccess(t, stub.call(patient, u.GetConsentReceipts)), &receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 3 || receipts[0].Sequence != 1 || receipts[1].PreviousReceiptHash != second.Hash || receipts[2].Signature != "" {
+		t.Fatalf("unexpected receipt chain %+v", receipts)
+	}
+	// three receipts, their head and the purge key
+	if len(stub.PvtState["patientDetailsIn2Orgs"]) != 5 || len(stub.PvtState["patientDetails"]) != 0 {
+		t.Fatal("expected the receipts and their head next to the consents in patientDetailsIn2Orgs")
+	}
+}
+
+func TestUpdateProviderAccessChainsTheCallersRecord(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	registerProviderAndPatients(t, stub,
+		[5]string{"pat1", "111", "ann", "smith", "01/15/1960"},
+		[5]string{"123", "222", "bob", "jones", "06/30/1985"},
+	)
+	patient := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "pat1"})
+	stranger := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "pat9"})
+	stub.PvtState["patientDetails"]["123"] = []byte(`{"allergies":{"providerconsent":[{"starttime":"decoy"}]}}`)
+
+	consent := func(startTime string) string {
+		c := `{"providerconsent":[{"starttime":"` + startTime + `","endtime":"12-31-2099"}]}`
+		return `{"allergies":` + c + `,"immunization":` + c + `,"medications":` + c + `,"pastMedicalHx":` + c + `}`
+	}
+	allergyConsents := func() []string {
+		var details entity.PatientDetails
+		err := json.Unmarshal(stub.PvtState["patientDetailsIn2Orgs"]["pat1"], &details)
+		if err != nil {
+			t.Fatal(err)
+		}
+		startTimes := []string{}
+		for _, c := range details.Allergies.ProviderConsent {
+			startTimes = append(startTimes, c.StartTime)
+		}
+		return startTimes
+	}
+
+	expectError(t, stub.call(stranger, u.UpdateProviderAccess, consent("01-01-2020")), "Patient details not found pat9")
+	if head, _ := getConsentReceiptHead(stub, "pat9"); head.Sequence != 0 {
+		t.Fatal("no receipt may be issued without the patient's record")
+	}
+
+	// ==== The first change merges into the registered details, later ones into the shared record ====
+	expectSuccess(t, stub.call(patient, u.UpdateProviderAccess, consent("01-01-2020")))
+	first := allergyConsents()
+	if len(first) != 2 || first[1] != "01-01-2020" {
+		t.Fatalf("expected the registration consent and the new one, got %v", first)
+	}
+	var registered entity.PatientDetails
+	err := json.Unmarshal(stub.PvtState["patientDetails"]["pat1"], &registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0] == "decoy" || first[0] != registered.Allergies.ProviderConsent[0].StartTime {
+		t.Fatal("expected the consents of pat1's own registration")
+	}
+	expectSuccess(t, stub.call(patient, u.UpdateProviderAccess, consent("02-02-2020")))
+	if second := allergyConsents(); len(second) != 3 || second[2] != "02-02-2020" {
+		t.Fatalf("expected the consents to accumulate, got %v", second)
+	}
+	if stub.PvtState["patientDetailsIn2Orgs"]["123"] != nil {
+		t.Fatal("another patient's record was written")
+	}
+	if head, _ := getConsentReceiptHead(stub, "pat1"); head.Sequence != 2 {
+		t.Fatalf("expected two receipts, got %d", head.Sequence)
+	}
+}
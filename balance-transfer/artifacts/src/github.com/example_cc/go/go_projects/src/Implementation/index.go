@@ -0,0 +1,54 @@
+package implementation
+
+import (
+	index "Index"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// recordIndexes are the indexes kept for the public patient and provider records. The
+// record id is the last field so that people sharing a name each keep their own entry.
+// Patient and Provider carry a malformed docType struct tag, so their type is marshalled
+// under ObjectType.
+var recordIndexes = &index.Manager{
+	DocTypeField: "ObjectType",
+	Indexes: map[string][]index.Definition{
+		"Patient": {
+			{Name: "fname~lname", Fields: []string{"firstname", "lastname", "patientId"}},
+		},
+		"Provider": {
+			{Name: "fname~lname", Fields: []string{"firstname", "lastname", "providerId"}},
+		},
+	},
+}
+
+// ============================================================
+// RebuildIndexes - admin only, drop and regenerate the composite key indexes from the records,
+// including entries written before the record id was part of the key
+// ============================================================
+func (u *User) RebuildIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	mspRole, err := getAttribute(stub, "mspRole")
+	if err != nil {
+		return shim.Error("Fails to get mspRole " + err.Error())
+	}
+	if mspRole != "admin" {
+		return shim.Error("Unauthorized!")
+	}
+
+	counts, err := recordIndexes.Rebuild(stub)
+	if err != nil {
+		return shim.Error("Fails to rebuild indexes: " + err.Error())
+	}
+
+	countsAsBytes, err := json.Marshal(counts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(countsAsBytes)
+}
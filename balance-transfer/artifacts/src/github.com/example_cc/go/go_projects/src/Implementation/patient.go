@@ -3,9 +3,11 @@ import (
 	entity "Model"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	inf "interfaces"
 	"time"
+	cid "github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -138,27 +140,13 @@ func (u *User) RegisterPatient(stub shim.ChaincodeStubInterface, args []string)
 			return shim.Error(err.Error())
 		}
 
-		//=== Save Patient to state ===
-		err = stub.PutState(patientId, patientJSONasBytes)
+		//=== Save Patient to state and index it ===
+		//  recordIndexes maintains the fname~lname~patientId index for name-based range queries
+		err = recordIndexes.Put(stub, patientId, patientJSONasBytes)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 
-		//  ==== Index the Patient to enable name-based range queries, e.g. return all Patients ====
-		//  An 'index' is a normal key/value entry in state.
-		//  The key is a composite key, with the elements that you want to range query on listed first.
-		//  In our case, the composite key is based on indexName~color~name.
-		//  This will enable very efficient state range queries based on composite keys matching indexName~color~*
-		indexName := "fname~lname"
-		fnameLnameIndexKey, err := stub.CreateCompositeKey(indexName, []string{patient.PatientFirstname, patient.PatientLastname})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
-		//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-		value := []byte{0x00}
-		stub.PutState(fnameLnameIndexKey, value)
-
 		// ==== Marble saved and indexed. Return success ====
 		//fmt.Println("- end register patient")
 		return shim.Success(nil)
@@ -435,3 +423,355 @@ func (u *User) GetPatientByInformation(stub shim.ChaincodeStubInterface, args []
 	return shim.Success(queryResults)
 }
 
+// ============================================================
+// GetPatientByInformationWithPagination - page through registered patients,
+// optionally narrowed by a lastname prefix and a DOB range
+// ============================================================
+func (u *User) GetPatientByInformationWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0     1       2         3             4
+	// "10", "",   "smi", "01/01/1950", "12/31/1990"
+	if len(args) < 2 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 2")
+	}
+
+	pageSize, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return shim.Error("1st argument must be a positive numeric string")
+	}
+	bookmark := args[1]
+
+	lastnamePrefix := ""
+	if len(args) > 2 {
+		lastnamePrefix = strings.ToLower(args[2])
+	}
+
+	var dobFrom, dobTo time.Time
+	if len(args) > 3 && len(args[3]) > 0 {
+		dobFrom, err = parseDOB(args[3])
+		if err != nil {
+			return shim.Error("4th argument must be a date of birth: " + err.Error())
+		}
+	}
+	if len(args) > 4 && len(args[4]) > 0 {
+		dobTo, err = parseDOB(args[4])
+		if err != nil {
+			return shim.Error("5th argument must be a date of birth: " + err.Error())
+		}
+	}
+
+	// The lastname prefix is pushed down to CouchDB as a range on the lastname field.
+	// DOBs are stored as MM/DD/YYYY strings, which do not sort chronologically, so the
+	// DOB range is applied to each fetched page instead. A page may therefore hold fewer
+	// than pageSize records, or none: fetchedCount is the number of records returned, and
+	// scannedCount the number CouchDB fetched for the page. Callers keep paging with the
+	// bookmark until scannedCount is 0.
+	selector := map[string]interface{}{"ObjectType": "Patient"}
+	if lastnamePrefix != "" {
+		selector["lastname"] = map[string]string{"$gte": lastnamePrefix, "$lt": lastnamePrefix + "\ufff0"}
+	}
+	queryString, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- GetPatientByInformationWithPagination queryString:\n%s\n", queryString)
+
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(string(queryString), int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	page := entity.PatientPage{Records: []entity.PatientRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var patient entity.Patient
+		err = json.Unmarshal(queryResponse.Value, &patient)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if !dobInRange(patient.DOB, dobFrom, dobTo) {
+			continue
+		}
+		page.Records = append(page.Records, entity.PatientRecord{Key: queryResponse.Key, Record: patient})
+	}
+	page.FetchedCount = int32(len(page.Records))
+	page.ScannedCount = responseMetadata.FetchedRecordsCount
+	page.Bookmark = responseMetadata.Bookmark
+
+	pageAsBytes, err := json.Marshal(&page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pageAsBytes)
+}
+
+// dobInRange reports whether dob falls within [from, to]. A zero bound is open.
+func dobInRange(dob string, from, to time.Time) bool {
+	if from.IsZero() && to.IsZero() {
+		return true
+	}
+	parsed, err := parseDOB(dob)
+	if err != nil {
+		return false
+	}
+	if !from.IsZero() && parsed.Before(from) {
+		return false
+	}
+	if !to.IsZero() && parsed.After(to) {
+		return false
+	}
+	return true
+}
+
+// patientCollections are the private data collections holding a patient's details
+var patientCollections = []string{"patientDetails", "patientDetailsIn2Orgs"}
+
+// ============================================================
+// PurgePatient - erase a patient's data for a right-to-erasure request.
+// The first admin to call it files a purge request; a second, different admin
+// calling it with the same reason executes the purge and leaves a tombstone.
+// ============================================================
+func (u *User) PurgePatient(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0              1
+	// "pat001", "erasure request 2019-042"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	mspRole, err := getAttribute(stub, "mspRole")
+	if err != nil {
+		return shim.Error("Fails to get mspRole " + err.Error())
+	}
+	if mspRole != "admin" {
+		return shim.Error("Unauthorized!")
+	}
+	adminId, err := getAttribute(stub, "id")
+	if err != nil {
+		return shim.Error("Fails to get id " + err.Error())
+	}
+
+	adminMSP, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error("Fails to get MSP id " + err.Error())
+	}
+
+	// The patient id is taken exactly as the patient's certificate carries it, which is
+	// how consents, receipts and keys are stored; RegisterPatient lowercases the id of
+	// the Patient record and its details, so those are looked up by recordId
+	patientId := args[0]
+	recordId := strings.ToLower(patientId)
+	reason := args[1]
+	patientIdHash, err := hashPatientId(stub, patientId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	patientAsBytes, err := stub.GetState(recordId)
+	if err != nil {
+		return shim.Error("Fails to get patient: " + err.Error())
+	} else if patientAsBytes == nil {
+		return shim.Error("Patient not found " + patientId)
+	}
+
+	requestKey, err := stub.CreateCompositeKey("purgeRequest", []string{patientIdHash})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requestAsBytes, err := stub.GetState(requestKey)
+	if err != nil {
+		return shim.Error("Fails to get purge request: " + err.Error())
+	}
+
+	// ==== First approval, record the request and wait for a second admin ====
+	if requestAsBytes == nil {
+		request := &entity.PurgeRequest{ObjectType: "PurgeRequest", PatientIdHash: patientIdHash, Reason: reason, RequestedBy: adminId, RequestedByMSP: adminMSP}
+		requestAsBytes, err = json.Marshal(request)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(requestKey, requestAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte("Purge pending second approval"))
+	}
+
+	// ==== Second approval, purge the patient ====
+	var request entity.PurgeRequest
+	err = json.Unmarshal(requestAsBytes, &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if request.RequestedBy == adminId {
+		return shim.Error("Purge must be approved by a second admin")
+	}
+	if request.Reason != reason {
+		return shim.Error("Purge reason does not match the pending request, cancel it with CancelPurgeRequest to file a new one: " + request.Reason)
+	}
+
+	for _, collection := range patientCollections {
+		for _, key := range distinct(recordId, patientId) {
+			err = purgePrivateData(stub, collection, key)
+			if err != nil {
+				return shim.Error("Fails to purge " + collection + ": " + err.Error())
+			}
+		}
+	}
+
+	err = purgeConsentRecords(stub, patientId)
+	if err != nil {
+		return shim.Error("Fails to purge consent receipts: " + err.Error())
+	}
+
+	err = recordIndexes.Del(stub, recordId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Leave a tombstone so the erasure itself stays auditable ====
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tombstone := &entity.PatientTombstone{
+		ObjectType:    "PatientTombstone",
+		PatientIdHash: patientIdHash,
+		Reason:        reason,
+		Approvers:     []string{request.RequestedBy, adminId},
+		Timestamp:     time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format(time.RFC3339),
+	}
+	tombstoneAsBytes, err := json.Marshal(tombstone)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tombstoneKey, err := stub.CreateCompositeKey("tombstone", []string{patientIdHash})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(tombstoneKey, tombstoneAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = stub.DelState(requestKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(tombstoneAsBytes)
+}
+
+// ============================================================
+// CancelPurgeRequest - withdraw a pending purge request. Any admin of the
+// organisation that filed it may cancel, e.g. to correct the reason.
+// ============================================================
+func (u *User) CancelPurgeRequest(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "pat001"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	mspRole, err := getAttribute(stub, "mspRole")
+	if err != nil {
+		return shim.Error("Fails to get mspRole " + err.Error())
+	}
+	if mspRole != "admin" {
+		return shim.Error("Unauthorized!")
+	}
+	adminMSP, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error("Fails to get MSP id " + err.Error())
+	}
+
+	patientIdHash, err := hashPatientId(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requestKey, err := stub.CreateCompositeKey("purgeRequest", []string{patientIdHash})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requestAsBytes, err := stub.GetState(requestKey)
+	if err != nil {
+		return shim.Error("Fails to get purge request: " + err.Error())
+	} else if requestAsBytes == nil {
+		return shim.Error("No purge request is pending for " + args[0])
+	}
+
+	var request entity.PurgeRequest
+	err = json.Unmarshal(requestAsBytes, &request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if request.RequestedByMSP != adminMSP {
+		return shim.Error("Purge request can only be cancelled by an admin of " + request.RequestedByMSP)
+	}
+
+	err = stub.DelState(requestKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Purge request cancelled"))
+}
+
+// ============================================================
+// SetPurgeKey - admin only, set the secret key patient ids are hashed with in
+// purge requests and tombstones. The key is passed in the transient field
+// "purgeKey" so that it stays off the ledger, and can only be set once since
+// changing it would orphan the existing tombstones.
+// ============================================================
+func (u *User) SetPurgeKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0, pass the key in the transient field purgeKey")
+	}
+
+	mspRole, err := getAttribute(stub, "mspRole")
+	if err != nil {
+		return shim.Error("Fails to get mspRole " + err.Error())
+	}
+	if mspRole != "admin" {
+		return shim.Error("Unauthorized!")
+	}
+
+	transientMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Fails to get transient data " + err.Error())
+	}
+	key := transientMap["purgeKey"]
+	if len(key) < minPurgeKeyLength {
+		return shim.Error(fmt.Sprintf("Transient field purgeKey must hold at least %d bytes", minPurgeKeyLength))
+	}
+
+	existing, err := stub.GetPrivateData(purgeKeyCollection, purgeKeyName)
+	if err != nil {
+		return shim.Error("Fails to get purge key " + err.Error())
+	} else if existing != nil {
+		return shim.Error("Purge key is already set")
+	}
+
+	err = stub.PutPrivateData(purgeKeyCollection, purgeKeyName, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
@@ -0,0 +1,217 @@
+package implementation
+
+import (
+	entity "Model"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+func TestGetPatientByInformationWithPagination(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	provider := registerProviderAndPatients(t, stub,
+		[5]string{"pat1", "111", "ann", "smith", "01/15/1960"},
+		[5]string{"pat2", "222", "bob", "smithers", "06/30/1985"},
+		[5]string{"pat3", "333", "cat", "jones", "02/02/1970"},
+		[5]string{"pat4", "444", "dan", "smythe", "12/31/1999"},
+	)
+
+	page := func(args ...string) entity.PatientPage {
+		var page entity.PatientPage
+		err := json.Unmarshal(expectSuccess(t, stub.call(provider, u.GetPatientByInformationWithPagination, args...)), &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	keys := func(page entity.PatientPage) []string {
+		keys := []string{}
+		for _, record := range page.Records {
+			keys = append(keys, record.Key)
+		}
+		return keys
+	}
+
+	first := page("2", "")
+	if first.FetchedCount != 2 || len(first.Records) != 2 || first.Bookmark == "" {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+	second := page("2", first.Bookmark)
+	if got := append(keys(first), keys(second)...); len(got) != 4 || got[0] != "pat1" || got[3] != "pat4" {
+		t.Fatalf("expected every patient once across both pages, got %v", got)
+	}
+	if last := page("2", second.Bookmark); last.FetchedCount != 0 || len(last.Records) != 0 {
+		t.Fatalf("expected an empty page after the last one, got %+v", last)
+	}
+
+	if got := keys(page("10", "", "smi")); len(got) != 2 || got[0] != "pat1" || got[1] != "pat2" {
+		t.Fatalf("expected the smi lastname prefix to match pat1 and pat2, got %v", got)
+	}
+	if got := keys(page("10", "", "", "01/01/1965", "1990-01-01")); len(got) != 2 || got[0] != "pat2" || got[1] != "pat3" {
+		t.Fatalf("expected the DOB range to match pat2 and pat3, got %v", got)
+	}
+	if got := keys(page("10", "", "sm", "01/01/1990")); len(got) != 1 || got[0] != "pat4" {
+		t.Fatalf("expected the prefix and DOB filters to combine, got %v", got)
+	}
+
+	// ==== Pages filtered by DOB count the records they return, not those CouchDB scanned ====
+	filtered := page("2", "", "", "01/01/1980")
+	if filtered.FetchedCount != 1 || len(filtered.Records) != 1 || filtered.ScannedCount != 2 {
+		t.Fatalf("expected one record out of two scanned, got %+v", filtered)
+	}
+	filtered = page("2", filtered.Bookmark, "", "01/01/1980")
+	if filtered.FetchedCount != 1 || keys(filtered)[0] != "pat4" || filtered.ScannedCount != 2 {
+		t.Fatalf("expected pat4 out of two scanned, got %+v", filtered)
+	}
+	if last := page("2", filtered.Bookmark, "", "01/01/1980"); last.FetchedCount != 0 || last.ScannedCount != 0 {
+		t.Fatalf("expected the scan to be over, got %+v", last)
+	}
+	empty := page("2", "", "", "01/01/2000")
+	if empty.FetchedCount != 0 || len(empty.Records) != 0 || empty.ScannedCount != 2 {
+		t.Fatalf("expected an empty page that scanned two patients, got %+v", empty)
+	}
+}
+
+func TestGetPatientByInformationWithPaginationRejectsBadArguments(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	provider := registerProviderAndPatients(t, stub)
+
+	expectError(t, stub.call(provider, u.GetPatientByInformationWithPagination, "10"), "Incorrect number of arguments")
+	expectError(t, stub.call(provider, u.GetPatientByInformationWithPagination, "0", ""), "positive numeric")
+	expectError(t, stub.call(provider, u.GetPatientByInformationWithPagination, "ten", ""), "positive numeric")
+	expectError(t, stub.call(provider, u.GetPatientByInformationWithPagination, "10", "", "", "yesterday"), "4th argument")
+	expectError(t, stub.call(provider, u.GetPatientByInformationWithPagination, "10", "", "", "", "31/12/1990"), "5th argument")
+}
+
+func TestSetPurgeKey(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	admin := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "adm1"})
+	client := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "cli1"})
+
+	stub.transient = map[string][]byte{"purgeKey": []byte("0123456789abcdef0123456789abcdef")}
+	expectError(t, stub.call(client, u.SetPurgeKey), "Unauthorized")
+	stub.transient = map[string][]byte{"purgeKey": []byte("short")}
+	expectError(t, stub.call(admin, u.SetPurgeKey), "at least 32 bytes")
+
+	stub.transient = map[string][]byte{"purgeKey": []byte("0123456789abcdef0123456789abcdef")}
+	expectSuccess(t, stub.call(admin, u.SetPurgeKey))
+	expectError(t, stub.call(admin, u.SetPurgeKey), "already set")
+	if _, onLedger := stub.State[purgeKeyName]; onLedger {
+		t.Fatal("purge key must not be written to the public state")
+	}
+}
+
+func TestPurgePatient(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	registerProviderAndPatients(t, stub, [5]string{"pat1", "111", "ann", "smith", "01/15/1960"})
+	stub.PvtState["patientDetailsIn2Orgs"] = map[string][]byte{"pat1": []byte("{}")}
+
+	admin1 := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "adm1"})
+	admin2 := newCreator(t, "Org2MSP", map[string]string{"mspRole": "admin", "id": "adm2"})
+	admin3 := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "adm3"})
+	client := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "cli1"})
+
+	expectError(t, stub.call(admin1, u.PurgePatient, "pat1", "erasure 42"), "SetPurgeKey")
+	stub.transient = map[string][]byte{"purgeKey": []byte("0123456789abcdef0123456789abcdef")}
+	expectSuccess(t, stub.call(admin1, u.SetPurgeKey))
+
+	expectError(t, stub.call(client, u.PurgePatient, "pat1", "erasure 42"), "Unauthorized")
+	expectError(t, stub.call(admin1, u.PurgePatient, "nobody", "erasure 42"), "Patient not found")
+
+	// ==== A request can be cancelled by its own organisation only ====
+	expectSuccess(t, stub.call(admin1, u.PurgePatient, "pat1", "erasure 41"))
+	expectError(t, stub.call(admin2, u.PurgePatient, "pat1", "erasure 42"), "reason does not match")
+	expectError(t, stub.call(admin2, u.CancelPurgeRequest, "pat1"), "admin of Org1MSP")
+	expectError(t, stub.call(client, u.CancelPurgeRequest, "pat1"), "Unauthorized")
+	expectSuccess(t, stub.call(admin3, u.CancelPurgeRequest, "pat1"))
+	expectError(t, stub.call(admin3, u.CancelPurgeRequest, "pat1"), "No purge request")
+
+	// ==== Refile and approve with a second admin ====
+	expectSuccess(t, stub.call(admin1, u.PurgePatient, "pat1", "erasure 42"))
+	expectError(t, stub.call(admin1, u.PurgePatient, "pat1", "erasure 42"), "second admin")
+	payload := expectSuccess(t, stub.call(admin2, u.PurgePatient, "pat1", "erasure 42"))
+
+	var tombstone entity.PatientTombstone
+	err := json.Unmarshal(payload, &tombstone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstone.Approvers) != 2 || tombstone.Approvers[0] != "adm1" || tombstone.Approvers[1] != "adm2" {
+		t.Fatalf("unexpected approvers %v", tombstone.Approvers)
+	}
+	plainHash := sha256.Sum256([]byte("pat1"))
+	if tombstone.PatientIdHash == hex.EncodeToString(plainHash[:]) {
+		t.Fatal("tombstone must not carry the unkeyed hash of the patient id")
+	}
+	tombstoneKey, _ := stub.CreateCompositeKey("tombstone", []string{tombstone.PatientIdHash})
+	if stub.State[tombstoneKey] == nil {
+		t.Fatal("tombstone was not stored under the patient id hash")
+	}
+
+	if stub.State["pat1"] != nil || stub.PvtState["patientDetails"]["pat1"] != nil || stub.PvtState["patientDetailsIn2Orgs"]["pat1"] != nil {
+		t.Fatal("patient data survived the purge")
+	}
+	requestKey, _ := stub.CreateCompositeKey("purgeRequest", []string{tombstone.PatientIdHash})
+	if stub.State[requestKey] != nil {
+		t.Fatal("purge request survived the purge")
+	}
+}
+
+func TestPurgePatientUsesTheIdAsStored(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	setPurgeKey(t, stub)
+	registerProviderAndPatients(t, stub, [5]string{"Pat1", "111", "ann", "smith", "01/15/1960"})
+
+	// ==== Consents, receipts and keys carry the id of the patient's certificate ====
+	patient := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "Pat1"})
+	_, keyPEM := newPatientKey(t)
+	expectSuccess(t, stub.call(patient, u.RegisterPatientKey, keyPEM))
+	expectSuccess(t, stub.call(patient, func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+		_, err := issueConsentReceipt(stub, "Pat1", entity.PatientDetailsUnmarshal{}, "{}", "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	}))
+	stub.PvtState["patientDetailsIn2Orgs"]["Pat1"] = []byte("{}")
+
+	admin1 := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "adm1"})
+	admin2 := newCreator(t, "Org2MSP", map[string]string{"mspRole": "admin", "id": "adm2"})
+	expectSuccess(t, stub.call(admin1, u.PurgePatient, "Pat1", "erasure 42"))
+	var tombstone entity.PatientTombstone
+	err := json.Unmarshal(expectSuccess(t, stub.call(admin2, u.PurgePatient, "Pat1", "erasure 42")), &tombstone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patientIdHash, err := hashPatientId(stub, "Pat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstone.PatientIdHash != patientIdHash {
+		t.Fatal("tombstone must carry the hash of the id as stored")
+	}
+	for key := range stub.PvtState["patientDetailsIn2Orgs"] {
+		if key != purgeKeyName {
+			t.Fatalf("private data %q survived the purge", key)
+		}
+	}
+	if len(stub.PvtState["patientDetails"]) != 0 {
+		t.Fatal("patient details survived the purge")
+	}
+	for key := range stub.State {
+		if strings.Contains(key, "patientKey") || strings.Contains(strings.ToLower(key), "pat1") {
+			t.Fatalf("public state %q survived the purge", key)
+		}
+	}
+}
@@ -77,27 +77,13 @@ func (u *User) RegisterProvider(stub shim.ChaincodeStubInterface, args []string)
 	//patientJSONasString := `{"docType":"Patient",  "patientId": "` + patientId + `", "patientSSN": "` + patientSSN + `", "patientUrl": ` + patientUrl + `, "firstname": "` + firstname + `, "DOB": "` + DOB + `, "email": "` + email + `, "mobile": "` + mobile + `"}`
 	//patientJSONasBytes := []byte(patientJSONasString)
 
-	// === Save Provider to state ===
-
+	// === Save Provider to state and index it ===
+	//  recordIndexes maintains the fname~lname~providerId index for name-based range queries
 	//err = stub.PutPrivateData("patientDetails", providerId, providerJSONasBytes)
-	err = stub.PutState(providerId, providerJSONasBytes)
+	err = recordIndexes.Put(stub, providerId, providerJSONasBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	//  ==== Index the Provider to enable name-based range queries, e.g. return all Patients ====
-	//  An 'index' is a normal key/value entry in state.
-	//  The key is a composite key, with the elements that you want to range query on listed first.
-	//  In our case, the composite key is based on indexName~color~name.
-	//  This will enable very efficient state range queries based on composite keys matching indexName~color~*
-	indexName := "fname~lname"
-	fnameLnameIndexKey, err := stub.CreateCompositeKey(indexName, []string{provider.ProviderFirstname, provider.ProviderLastname})
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
-	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(fnameLnameIndexKey, value)
 
 	// ==== Marble saved and indexed. Return success ====
 	//fmt.Println("- end register patient")
@@ -158,7 +144,15 @@ func (u *User) UpdateProviderAccess(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Fail to get Attribute from private DB " + err.Error())
 	} 
 
-	patientDetailsAsBytes, err := stub.GetPrivateData("patientDetails", "123")
+	// The consents are merged into the calling patient's own record: the one shared with
+	// both orgs, or the details RegisterPatient stored before the first consent change
+	patientDetailsAsBytes, err := stub.GetPrivateData("patientDetailsIn2Orgs", patientId)
+	if err == nil && patientDetailsAsBytes == nil {
+		patientDetailsAsBytes, err = stub.GetPrivateData("patientDetails", strings.ToLower(patientId))
+	}
+	if err == nil && patientDetailsAsBytes == nil {
+		return shim.Error("Patient details not found " + patientId)
+	}
 
 
 	if err != nil {
@@ -196,6 +190,16 @@ func (u *User) UpdateProviderAccess(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Error in put private data in two org "+err.Error())
 	}
 
-	return shim.Success([]byte("Success"))
+	// === Chain a consent receipt, optionally signed with the patient's device key ===
+	signature := ""
+	if len(args) > 1 {
+		signature = args[1]
+	}
+	receiptAsBytes, err := issueConsentReceipt(stub, patientId, patientDetails, args[0], signature)
+	if err != nil {
+		return shim.Error("Error in issuing consent receipt " + err.Error())
+	}
+
+	return shim.Success(receiptAsBytes)
 }
 
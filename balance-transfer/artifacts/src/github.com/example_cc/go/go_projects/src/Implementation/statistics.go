@@ -0,0 +1,318 @@
+package implementation
+
+import (
+	entity "Model"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// defaultMinK is the smallest cell size released when no threshold was configured
+const defaultMinK = 5
+
+// cohortBandWidth is the width in years of the age bands. It is fixed, as bands of
+// different widths or offsets overlap and subtracting one query's cells from
+// another's would single out patients in cells that were each above k.
+const cohortBandWidth = 10
+
+// cohortConfigKey holds the channel wide k-anonymity threshold
+const cohortConfigKey = "cohortConfig"
+
+// cohortDimensions are the only fields a cohort can be grouped by, for each unit, in
+// the order of the finest partition of that unit. Names, SSNs and ids are deliberately
+// absent, and DOB is only available generalised to an age band. Patients are only
+// grouped by age band, the one dimension a patient has a single value of, so that the
+// cells of the patient unit partition the patients.
+var cohortDimensions = map[string][]string{
+	"patient": {"ageBand"},
+	"consent": {"ageBand", "category", "speciality", "providerEHR"},
+}
+
+// ============================================================
+// SetCohortThreshold - set the minimum k below which cohort cells are suppressed
+// ============================================================
+func (u *User) SetCohortThreshold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "5"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	mspRole, err := getAttribute(stub, "mspRole")
+	if err != nil {
+		return shim.Error("Fails to get mspRole " + err.Error())
+	}
+	if mspRole != "admin" {
+		return shim.Error("Unauthorized!")
+	}
+
+	minK, err := strconv.Atoi(args[0])
+	if err != nil || minK < 2 {
+		return shim.Error("1st argument must be a numeric string of at least 2")
+	}
+
+	configAsBytes, err := json.Marshal(&entity.CohortConfig{MinK: minK})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(cohortConfigKey, configAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// ============================================================
+// GetCohortStatistics - count patients or consents grouped by de-identified
+// dimensions. Counts are first taken over the finest partition of the unit,
+// grouped by every one of its dimensions, and each of those cells holding fewer
+// than k distinct patients is suppressed. The requested cells are then sums of
+// the finest cells that were released, so no two queries differ by a suppressed
+// cell: subtracting one query's cells from another's only yields sums that the
+// finest grouping releases anyway. A categories filter likewise picks whole
+// cells of the finest partition.
+// ============================================================
+func (u *User) GetCohortStatistics(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// {"unit":"patient","groupBy":["ageBand"],"k":10}
+	// {"unit":"consent","groupBy":["category","speciality"],"categories":["allergies"]}
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	var spec entity.CohortSpec
+	err := json.Unmarshal([]byte(args[0]), &spec)
+	if err != nil {
+		return shim.Error("1st argument must be a cohort spec: " + err.Error())
+	}
+	if spec.Unit == "" {
+		spec.Unit = "patient"
+	}
+	if spec.Unit != "patient" && spec.Unit != "consent" {
+		return shim.Error("unit must be patient or consent")
+	}
+	if len(spec.GroupBy) == 0 {
+		return shim.Error("groupBy must name at least one dimension")
+	}
+	for _, dimension := range spec.GroupBy {
+		if !groupsBy(cohortDimensions[spec.Unit], dimension) {
+			return shim.Error("Cannot group " + spec.Unit + " counts by " + dimension)
+		}
+	}
+	if spec.BandWidth != 0 && spec.BandWidth != cohortBandWidth {
+		return shim.Error(fmt.Sprintf("bandWidth is fixed at %d years", cohortBandWidth))
+	}
+	spec.BandWidth = cohortBandWidth
+
+	minK, err := getCohortMinK(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if spec.K < minK {
+		spec.K = minK
+	}
+
+	categories := map[string]bool{}
+	for _, category := range spec.Categories {
+		categories[category] = true
+	}
+	if len(categories) > 0 && !groupsBy(spec.GroupBy, "category") {
+		return shim.Error("categories can only select cells of a grouping by category")
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	resultsIterator, err := stub.GetQueryResult(`{"selector":{"ObjectType":"Patient"}}`)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// ==== Count the finest cells ====
+	finest := cohortDimensions[spec.Unit]
+	counts := map[string]int{}
+	patients := map[string]map[string]bool{}
+	groups := map[string]map[string]string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var patient entity.Patient
+		err = json.Unmarshal(queryResponse.Value, &patient)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		facts, err := cohortFacts(stub, queryResponse.Key, patient, spec, categories, now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		for _, fact := range facts {
+			cellKey := cohortCellKey(finest, fact)
+			counts[cellKey]++
+			if patients[cellKey] == nil {
+				patients[cellKey] = map[string]bool{}
+			}
+			patients[cellKey][queryResponse.Key] = true
+			groups[cellKey] = fact
+		}
+	}
+
+	// ==== Sum the released finest cells into the requested ones ====
+	statistics := entity.CohortStatistics{Unit: spec.Unit, GroupBy: spec.GroupBy, K: spec.K, Cells: []entity.CohortCell{}}
+	requestedCounts := map[string]int{}
+	requestedGroups := map[string]map[string]string{}
+	for cellKey, count := range counts {
+		// Many consents of a few patients must not lift a cell over k
+		if len(patients[cellKey]) < spec.K {
+			statistics.Suppressed = true
+			continue
+		}
+		requestedKey := cohortCellKey(spec.GroupBy, groups[cellKey])
+		requestedCounts[requestedKey] += count
+		requestedGroups[requestedKey] = groups[cellKey]
+	}
+
+	requestedKeys := make([]string, 0, len(requestedCounts))
+	for requestedKey := range requestedCounts {
+		requestedKeys = append(requestedKeys, requestedKey)
+	}
+	sort.Strings(requestedKeys)
+	for _, requestedKey := range requestedKeys {
+		group := map[string]string{}
+		for _, dimension := range spec.GroupBy {
+			group[dimension] = requestedGroups[requestedKey][dimension]
+		}
+		statistics.Cells = append(statistics.Cells, entity.CohortCell{Group: group, Count: requestedCounts[requestedKey]})
+	}
+
+	statisticsAsBytes, err := json.Marshal(&statistics)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statisticsAsBytes)
+}
+
+// getCohortMinK returns the configured k-anonymity threshold
+func getCohortMinK(stub shim.ChaincodeStubInterface) (int, error) {
+	configAsBytes, err := stub.GetState(cohortConfigKey)
+	if err != nil {
+		return 0, err
+	} else if configAsBytes == nil {
+		return defaultMinK, nil
+	}
+
+	var config entity.CohortConfig
+	err = json.Unmarshal(configAsBytes, &config)
+	if err != nil {
+		return 0, err
+	}
+	return config.MinK, nil
+}
+
+// cohortFacts returns the dimension values a patient contributes, one map per
+// consent for the consent unit
+func cohortFacts(stub shim.ChaincodeStubInterface, patientId string, patient entity.Patient, spec entity.CohortSpec, categories map[string]bool, now time.Time) ([]map[string]string, error) {
+	base := map[string]string{"ageBand": ageBand(patient.DOB, now, spec.BandWidth)}
+	if spec.Unit == "patient" {
+		return []map[string]string{base}, nil
+	}
+
+	patientDetailsAsBytes, err := stub.GetPrivateData("patientDetailsIn2Orgs", patientId)
+	if err != nil {
+		return nil, err
+	}
+	if patientDetailsAsBytes == nil {
+		patientDetailsAsBytes, err = stub.GetPrivateData("patientDetails", patientId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if patientDetailsAsBytes == nil {
+		return nil, nil
+	}
+
+	var patientDetails entity.PatientDetailsUnmarshal
+	err = json.Unmarshal(patientDetailsAsBytes, &patientDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	facts := []map[string]string{}
+	for _, service := range consentServices(patientDetails) {
+		if len(categories) > 0 && !categories[service.Service] {
+			continue
+		}
+		fact := map[string]string{"ageBand": base["ageBand"], "category": service.Service}
+		provider, err := getConsentProvider(stub, service.ProviderId)
+		if err != nil {
+			return nil, err
+		}
+		fact["speciality"] = provider.Speciality
+		fact["providerEHR"] = provider.ProviderEHR
+		facts = append(facts, fact)
+	}
+	return facts, nil
+}
+
+// getConsentProvider reads the provider a consent was granted to
+func getConsentProvider(stub shim.ChaincodeStubInterface, providerId string) (entity.Provider, error) {
+	var provider entity.Provider
+	providerAsBytes, err := stub.GetState(providerId)
+	if err != nil || providerAsBytes == nil {
+		return provider, err
+	}
+	err = json.Unmarshal(providerAsBytes, &provider)
+	return provider, err
+}
+
+// groupsBy reports whether dimension is one of the grouped dimensions
+func groupsBy(groupBy []string, dimension string) bool {
+	for _, grouped := range groupBy {
+		if grouped == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+// cohortCellKey joins a fact's values for the grouped dimensions
+func cohortCellKey(groupBy []string, fact map[string]string) string {
+	values := make([]string, len(groupBy))
+	for i, dimension := range groupBy {
+		values[i] = fact[dimension]
+	}
+	return strings.Join(values, "\x00")
+}
+
+// ageBand generalises a date of birth into a band such as "30-39"
+func ageBand(dob string, now time.Time, bandWidth int) string {
+	born, err := parseDOB(dob)
+	if err != nil {
+		return "unknown"
+	}
+	age := now.Year() - born.Year()
+	if now.YearDay() < born.YearDay() {
+		age--
+	}
+	if age < 0 {
+		return "unknown"
+	}
+	low := age / bandWidth * bandWidth
+	return fmt.Sprintf("%d-%d", low, low+bandWidth-1)
+}
@@ -0,0 +1,135 @@
+package implementation
+
+import (
+	entity "Model"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// seedConsents stores patient details granting count consents per category to providerId
+func seedConsents(t *testing.T, stub *testStub, patientId string, providerId string, count map[string]int) {
+	consents := func(category string) []entity.Consent {
+		consents := []entity.Consent{}
+		for i := 0; i < count[category]; i++ {
+			consents = append(consents, entity.Consent{Provider: entity.Provider{ProviderId: providerId}})
+		}
+		return consents
+	}
+	var details entity.PatientDetails
+	details.Allergies.ProviderConsent = consents("allergies")
+	details.Medications.ProviderConsent = consents("medications")
+	detailsAsBytes, err := json.Marshal(&details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.PvtState["patientDetailsIn2Orgs"] == nil {
+		stub.PvtState["patientDetailsIn2Orgs"] = map[string][]byte{}
+	}
+	stub.PvtState["patientDetailsIn2Orgs"][patientId] = detailsAsBytes
+}
+
+func TestGetCohortStatistics(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	aged := func(years int) string {
+		return time.Now().AddDate(-years, 0, -1).Format("01/02/2006")
+	}
+	provider := registerProviderAndPatients(t, stub,
+		[5]string{"pat1", "111", "ann", "smith", aged(31)},
+		[5]string{"pat2", "222", "bob", "smith", aged(35)},
+		[5]string{"pat3", "333", "cat", "smith", aged(38)},
+		[5]string{"pat4", "444", "dan", "smith", aged(52)},
+	)
+	admin := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "adm1"})
+	expectError(t, stub.call(provider, u.SetCohortThreshold, "2"), "Unauthorized")
+	expectError(t, stub.call(admin, u.SetCohortThreshold, "1"), "at least 2")
+	expectSuccess(t, stub.call(admin, u.SetCohortThreshold, "2"))
+
+	statistics := func(spec string) entity.CohortStatistics {
+		var statistics entity.CohortStatistics
+		err := json.Unmarshal(expectSuccess(t, stub.call(provider, u.GetCohortStatistics, spec)), &statistics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return statistics
+	}
+
+	byAge := statistics(`{"groupBy":["ageBand"]}`)
+	if len(byAge.Cells) != 1 || byAge.Cells[0].Group["ageBand"] != "30-39" || byAge.Cells[0].Count != 3 || !byAge.Suppressed {
+		t.Fatalf("unexpected age band cells %+v", byAge)
+	}
+
+	// ==== Many consents of one patient do not lift a cell over k ====
+	seedConsents(t, stub, "pat1", "prov1", map[string]int{"allergies": 5, "medications": 1})
+	seedConsents(t, stub, "pat2", "prov1", map[string]int{"medications": 1})
+	seedConsents(t, stub, "pat3", "prov1", nil)
+	seedConsents(t, stub, "pat4", "prov1", nil)
+	byCategory := statistics(`{"unit":"consent","groupBy":["category"]}`)
+	if len(byCategory.Cells) != 1 || byCategory.Cells[0].Group["category"] != "medications" || byCategory.Cells[0].Count != 2 || !byCategory.Suppressed {
+		t.Fatalf("expected the allergies cell of a single patient to be suppressed, got %+v", byCategory)
+	}
+	if selected := statistics(`{"unit":"consent","groupBy":["category"],"categories":["allergies"]}`); len(selected.Cells) != 0 || !selected.Suppressed {
+		t.Fatalf("expected categories to select the suppressed allergies cell only, got %+v", selected)
+	}
+	if bySpeciality := statistics(`{"unit":"consent","groupBy":["speciality"]}`); len(bySpeciality.Cells) != 1 || bySpeciality.Cells[0].Group["speciality"] != "cardiology" || bySpeciality.Cells[0].Count != 2 {
+		t.Fatalf("expected the released medication consents in the speciality cell, got %+v", bySpeciality)
+	}
+}
+
+func TestGetCohortStatisticsResistsDifferencing(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	aged := func(years int) string {
+		return time.Now().AddDate(-years, 0, -1).Format("01/02/2006")
+	}
+	provider := registerProviderAndPatients(t, stub,
+		[5]string{"pat1", "111", "ann", "smith", aged(31)},
+		[5]string{"pat2", "222", "bob", "smith", aged(35)},
+		[5]string{"pat3", "333", "cat", "smith", aged(38)},
+		[5]string{"pat4", "444", "dan", "smith", aged(52)},
+	)
+	admin := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "adm1"})
+	expectSuccess(t, stub.call(admin, u.SetCohortThreshold, "2"))
+	seedConsents(t, stub, "pat1", "prov1", map[string]int{"allergies": 5, "medications": 1})
+	seedConsents(t, stub, "pat2", "prov1", map[string]int{"medications": 1})
+	seedConsents(t, stub, "pat3", "prov1", nil)
+	seedConsents(t, stub, "pat4", "prov1", nil)
+
+	count := func(spec string, dimension string, value string) int {
+		var statistics entity.CohortStatistics
+		err := json.Unmarshal(expectSuccess(t, stub.call(provider, u.GetCohortStatistics, spec)), &statistics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cell := range statistics.Cells {
+			if cell.Group[dimension] == value {
+				return cell.Count
+			}
+		}
+		return 0
+	}
+
+	// ==== The age band total less the released categories must not reveal pat1's allergies ====
+	inBand := count(`{"unit":"consent","groupBy":["ageBand"]}`, "ageBand", "30-39")
+	medications := count(`{"unit":"consent","groupBy":["category"]}`, "category", "medications")
+	if inBand != 2 || medications != 2 || inBand-medications != 0 {
+		t.Fatalf("expected the age band to hold the released medication consents only, got %d and %d", inBand, medications)
+	}
+	if allergies := count(`{"unit":"consent","groupBy":["ageBand","category"]}`, "category", "allergies"); allergies != 0 {
+		t.Fatalf("expected no allergies cell, got %d", allergies)
+	}
+}
+
+func TestGetCohortStatisticsRejectsDifferencingSpecs(t *testing.T) {
+	stub := newTestStub()
+	u := &User{}
+	provider := registerProviderAndPatients(t, stub)
+
+	expectError(t, stub.call(provider, u.GetCohortStatistics, `{"groupBy":["ageBand"],"bandWidth":5}`), "fixed at 10 years")
+	expectError(t, stub.call(provider, u.GetCohortStatistics, `{"groupBy":["ageBand"],"categories":["allergies"]}`), "grouping by category")
+	expectError(t, stub.call(provider, u.GetCohortStatistics, `{"groupBy":["lastname"]}`), "Cannot group patient counts by lastname")
+	expectError(t, stub.call(provider, u.GetCohortStatistics, `{"groupBy":["speciality"]}`), "Cannot group patient counts by speciality")
+	expectError(t, stub.call(provider, u.GetCohortStatistics, `{"unit":"visit","groupBy":["ageBand"]}`), "unit must be")
+	expectSuccess(t, stub.call(provider, u.GetCohortStatistics, `{"groupBy":["ageBand"],"bandWidth":10}`))
+}
@@ -0,0 +1,250 @@
+package implementation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub fills in the parts of shim.MockStub the implementation relies on: the creator
+// identity, transient data, private data deletes and partial composite key scans, and a
+// small CouchDB selector engine for the rich queries
+type testStub struct {
+	*shim.MockStub
+	creator   []byte
+	transient map[string][]byte
+	txCount   int
+}
+
+func newTestStub() *testStub {
+	return &testStub{MockStub: shim.NewMockStub("healthcare", nil)}
+}
+
+// call runs fn as one transaction submitted by creator
+func (s *testStub) call(creator []byte, fn func(shim.ChaincodeStubInterface, []string) pb.Response, args ...string) pb.Response {
+	s.txCount++
+	txID := fmt.Sprintf("tx%d", s.txCount)
+	s.creator = creator
+	s.MockTransactionStart(txID)
+	defer s.MockTransactionEnd(txID)
+	return fn(s, args)
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *testStub) DelPrivateData(collection string, key string) error {
+	delete(s.PvtState[collection], key)
+	return nil
+}
+
+func (s *testStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	results := []*queryresult.KV{}
+	for _, key := range sortedKeys(s.PvtState[collection]) {
+		if strings.HasPrefix(key, prefix) {
+			results = append(results, &queryresult.KV{Key: key, Value: s.PvtState[collection][key]})
+		}
+	}
+	return &sliceIterator{results: results}, nil
+}
+
+func (s *testStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	results, err := s.selectRecords(query)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{results: results}, nil
+}
+
+func (s *testStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	results, err := s.selectRecords(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(results) > 0 && bookmark != "" && results[0].Key <= bookmark {
+		results = results[1:]
+	}
+	if len(results) > int(pageSize) {
+		results = results[:pageSize]
+	}
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(results)), Bookmark: bookmark}
+	if len(results) > 0 {
+		metadata.Bookmark = results[len(results)-1].Key
+	}
+	return &sliceIterator{results: results}, metadata, nil
+}
+
+// selectRecords evaluates the selector of a query against the simple keys of the world state,
+// supporting equality and the $gt, $gte, $lt and $lte operators on strings
+func (s *testStub) selectRecords(query string) ([]*queryresult.KV, error) {
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	err := json.Unmarshal([]byte(query), &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*queryresult.KV{}
+	for _, key := range sortedKeys(s.State) {
+		if strings.HasPrefix(key, "\x00") {
+			continue
+		}
+		record := map[string]interface{}{}
+		if json.Unmarshal(s.State[key], &record) != nil {
+			continue
+		}
+		record["_id"] = key
+		if matchSelector(parsed.Selector, record) {
+			results = append(results, &queryresult.KV{Key: key, Value: s.State[key]})
+		}
+	}
+	return results, nil
+}
+
+func matchSelector(selector map[string]interface{}, record map[string]interface{}) bool {
+	for field, condition := range selector {
+		value, _ := record[field].(string)
+		operators, ok := condition.(map[string]interface{})
+		if !ok {
+			if record[field] != condition {
+				return false
+			}
+			continue
+		}
+		for operator, operand := range operators {
+			bound, _ := operand.(string)
+			switch {
+			case operator == "$gt" && !(value > bound),
+				operator == "$gte" && !(value >= bound),
+				operator == "$lt" && !(value < bound),
+				operator == "$lte" && !(value <= bound):
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type sliceIterator struct {
+	results []*queryresult.KV
+}
+
+func (it *sliceIterator) HasNext() bool {
+	return len(it.results) > 0
+}
+
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	next := it.results[0]
+	it.results = it.results[1:]
+	return next, nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// newCreator returns a serialized identity of mspID whose certificate carries attrs the way
+// the Fabric CA enrolls them, for cid to read back
+func newCreator(t *testing.T, mspID string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: attrs["id"], Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if len(attrs) > 0 {
+		attrsAsBytes, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attrsAsBytes}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+func expectSuccess(t *testing.T, resp pb.Response) []byte {
+	t.Helper()
+	if resp.Status != shim.OK {
+		t.Fatalf("expected success, got: %s", resp.Message)
+	}
+	return resp.Payload
+}
+
+func expectError(t *testing.T, resp pb.Response, contains string) {
+	t.Helper()
+	if resp.Status == shim.OK {
+		t.Fatalf("expected an error containing %q, got success", contains)
+	}
+	if !strings.Contains(resp.Message, contains) {
+		t.Fatalf("expected an error containing %q, got: %s", contains, resp.Message)
+	}
+}
+
+// setPurgeKey has an admin set the key patient ids are hashed with
+func setPurgeKey(t *testing.T, stub *testStub) {
+	admin := newCreator(t, "Org1MSP", map[string]string{"mspRole": "admin", "id": "keyadm"})
+	stub.transient = map[string][]byte{"purgeKey": []byte("0123456789abcdef0123456789abcdef")}
+	expectSuccess(t, stub.call(admin, (&User{}).SetPurgeKey))
+	stub.transient = nil
+}
+
+// registerProviderAndPatients registers a provider and, on their behalf, the given patients
+// as id, ssn, firstname, lastname, dob tuples
+func registerProviderAndPatients(t *testing.T, stub *testStub, patients ...[5]string) []byte {
+	u := &User{}
+	provider := newCreator(t, "Org1MSP", map[string]string{"mspRole": "client", "id": "prov1", "userrole": "Provider"})
+	expectSuccess(t, stub.call(provider, u.RegisterProvider, "prov1", "ehr", "http://ehr", "pat", "ward", "cardiology"))
+	for _, p := range patients {
+		expectSuccess(t, stub.call(provider, u.RegisterPatient, p[0], p[1], "http://"+p[0], p[2], p[3], p[4]))
+	}
+	return provider
+}
@@ -3,6 +3,10 @@ package implementation
 import (
 	"fmt"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
 	cid "github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/pkg/errors"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -90,4 +94,70 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	return buffer.Bytes(), nil
 }
 
+// dobLayouts are the date of birth formats accepted from clients, MM/DD/YYYY first
+var dobLayouts = []string{"01/02/2006", "01-02-2006", "2006-01-02"}
 
+// parseDOB parses a date of birth in any of the accepted layouts
+func parseDOB(dob string) (time.Time, error) {
+	for _, layout := range dobLayouts {
+		parsed, err := time.Parse(layout, dob)
+		if err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, errors.New("unrecognised date of birth " + dob)
+}
+
+// purgeKeyCollection holds the secret key patient ids are hashed with, readable by
+// both organisations but never written to the public ledger
+const purgeKeyCollection = "patientDetailsIn2Orgs"
+
+// purgeKeyName is the private data key of the patient id hashing key
+const purgeKeyName = "purgeKey"
+
+// minPurgeKeyLength is the shortest hashing key accepted, in bytes
+const minPurgeKeyLength = 32
+
+// hashPatientId returns the hex encoded HMAC-SHA256 of a patient id under the key set
+// with SetPurgeKey, used wherever a record must outlive the patient's data without
+// identifying them. Patient ids are too guessable for a plain hash, which anyone
+// could reverse by hashing candidate ids.
+func hashPatientId(stub shim.ChaincodeStubInterface, patientId string) (string, error) {
+	key, err := stub.GetPrivateData(purgeKeyCollection, purgeKeyName)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get purge key")
+	} else if key == nil {
+		return "", errors.New("no purge key is set, an admin must call SetPurgeKey first")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(patientId))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// distinct returns the given keys without repeats, in order
+func distinct(keys ...string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// privateDataPurger is implemented by shims that can purge private data, which also
+// removes the hashes and any history of the key from the collection peers
+type privateDataPurger interface {
+	PurgePrivateData(collection, key string) error
+}
+
+// purgePrivateData purges a private data key, falling back to DelPrivateData on
+// shims without purge support
+func purgePrivateData(stub shim.ChaincodeStubInterface, collection string, key string) error {
+	if purger, ok := stub.(privateDataPurger); ok {
+		return purger.PurgePrivateData(collection, key)
+	}
+	return stub.DelPrivateData(collection, key)
+}
@@ -0,0 +1,266 @@
+// Package index keeps composite key indexes over JSON records in chaincode state.
+//
+// Indexes are declared once per docType as a list of record fields. Records written through
+// a Manager have their index entries computed from the old and new value, so a field change
+// moves the entry and a delete drops it without each caller having to remember which indexes
+// exist. Rebuild regenerates every entry from the records. The names of the indexes last built
+// are kept under indexVersion, and Backfill rebuilds when the declared indexes differ from
+// them, so an upgrade adding an index covers existing records.
+//
+// The previous value is read with GetState, which does not see writes made earlier in the same
+// transaction, so a record must not be put or deleted through a Manager twice in one transaction.
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// indexVersionKeyType keys the names of the indexes the entries in state were built for
+const indexVersionKeyType = "indexVersion"
+
+// Definition is a composite key index over the listed record fields
+type Definition struct {
+	Name   string
+	Fields []string
+}
+
+// Manager keeps the indexes declared per docType in step with the records written through it
+type Manager struct {
+	DocTypeField string //record field holding the docType
+	Indexes      map[string][]Definition
+}
+
+// Put writes a record and moves its index entries from the old value to the new one
+func (m *Manager) Put(stub shim.ChaincodeStubInterface, key string, value []byte) error {
+	oldValue, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get state for %s: %s", key, err.Error())
+	}
+	oldKeys, err := m.indexKeys(stub, oldValue)
+	if err != nil {
+		return err
+	}
+	newKeys, err := m.indexKeys(stub, value)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	for indexKey := range oldKeys {
+		if !newKeys[indexKey] {
+			err = stub.DelState(indexKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for indexKey := range newKeys {
+		if !oldKeys[indexKey] {
+			// Only the key is needed; a nil value would delete it, so store a null character
+			err = stub.PutState(indexKey, []byte{0x00})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Del deletes a record together with its index entries
+func (m *Manager) Del(stub shim.ChaincodeStubInterface, key string) error {
+	oldValue, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get state for %s: %s", key, err.Error())
+	}
+	oldKeys, err := m.indexKeys(stub, oldValue)
+	if err != nil {
+		return err
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	for indexKey := range oldKeys {
+		err = stub.DelState(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuild deletes every entry of the declared indexes and recomputes them from the records in
+// state, returning the number of entries written per index
+func (m *Manager) Rebuild(stub shim.ChaincodeStubInterface) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, definitions := range m.Indexes {
+		for _, definition := range definitions {
+			if _, done := counts[definition.Name]; done {
+				continue
+			}
+			counts[definition.Name] = 0
+			err := deleteIndexEntries(stub, definition.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// an empty range covers every simple key; composite keys, index entries included, are not returned
+	recordsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer recordsIterator.Close()
+
+	for recordsIterator.HasNext() {
+		record, err := recordsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		indexKeys, err := m.indexKeys(stub, record.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", record.Key, err.Error())
+		}
+		for indexKey := range indexKeys {
+			// a later put of a key deleted above wins, so surviving entries are simply rewritten
+			err = stub.PutState(indexKey, []byte{0x00})
+			if err != nil {
+				return nil, err
+			}
+			indexName, _, err := stub.SplitCompositeKey(indexKey)
+			if err != nil {
+				return nil, err
+			}
+			counts[indexName]++
+		}
+	}
+
+	versionKey, err := stub.CreateCompositeKey(indexVersionKeyType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	namesAsBytes, err := json.Marshal(m.indexNames())
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(versionKey, namesAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Backfill rebuilds the indexes unless they were last built for the declared set of indexes.
+// It returns the counts of Rebuild, or nil when nothing needed to be done.
+func (m *Manager) Backfill(stub shim.ChaincodeStubInterface) (map[string]int, error) {
+	versionKey, err := stub.CreateCompositeKey(indexVersionKeyType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	builtAsBytes, err := stub.GetState(versionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index version: %s", err.Error())
+	}
+	declaredAsBytes, err := json.Marshal(m.indexNames())
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(builtAsBytes, declaredAsBytes) {
+		return nil, nil
+	}
+	return m.Rebuild(stub)
+}
+
+// indexNames returns the sorted names of the declared indexes
+func (m *Manager) indexNames() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, definitions := range m.Indexes {
+		for _, definition := range definitions {
+			if !seen[definition.Name] {
+				seen[definition.Name] = true
+				names = append(names, definition.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deleteIndexEntries deletes every composite key of an index
+func deleteIndexEntries(stub shim.ChaincodeStubInterface, indexName string) error {
+	entriesIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{})
+	if err != nil {
+		return err
+	}
+	defer entriesIterator.Close()
+
+	for entriesIterator.HasNext() {
+		entry, err := entriesIterator.Next()
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(entry.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKeys computes the index entries of a record value; values that are empty, not JSON
+// objects or of an undeclared docType have none
+func (m *Manager) indexKeys(stub shim.ChaincodeStubInterface, value []byte) (map[string]bool, error) {
+	keys := map[string]bool{}
+	if len(value) == 0 {
+		return keys, nil
+	}
+	record := map[string]interface{}{}
+	if json.Unmarshal(value, &record) != nil {
+		return keys, nil
+	}
+	docType, _ := record[m.DocTypeField].(string)
+
+	for _, definition := range m.Indexes[docType] {
+		attributes := make([]string, len(definition.Fields))
+		for i, field := range definition.Fields {
+			attribute, err := indexAttribute(record[field])
+			if err != nil {
+				return nil, fmt.Errorf("cannot index %s on field %s: %s", definition.Name, field, err.Error())
+			}
+			attributes[i] = attribute
+		}
+		indexKey, err := stub.CreateCompositeKey(definition.Name, attributes)
+		if err != nil {
+			return nil, err
+		}
+		keys[indexKey] = true
+	}
+	return keys, nil
+}
+
+// indexAttribute renders a decoded JSON field as a composite key attribute
+func indexAttribute(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", fmt.Errorf("field is missing")
+	}
+	return "", fmt.Errorf("field is not a string, number or boolean")
+}
@@ -0,0 +1,91 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var testIndexes = &Manager{
+	DocTypeField: "docType",
+	Indexes: map[string][]Definition{
+		"marble": {
+			{Name: "color~name", Fields: []string{"color", "name"}},
+		},
+	},
+}
+
+// transaction runs fn as one transaction of stub, failing the test on error
+func transaction(t *testing.T, stub *shim.MockStub, fn func() error) {
+	t.Helper()
+	stub.MockTransactionStart("tx")
+	defer stub.MockTransactionEnd("tx")
+	if err := fn(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func indexEntry(t *testing.T, stub *shim.MockStub, attributes ...string) []byte {
+	key, err := stub.CreateCompositeKey("color~name", attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub.State[key]
+}
+
+func TestPutMovesAndDelDropsEntries(t *testing.T) {
+	stub := shim.NewMockStub("index", nil)
+	transaction(t, stub, func() error {
+		return testIndexes.Put(stub, "marble1", []byte(`{"docType":"marble","name":"marble1","color":"blue"}`))
+	})
+	if indexEntry(t, stub, "blue", "marble1") == nil {
+		t.Fatal("expected a blue entry")
+	}
+
+	transaction(t, stub, func() error {
+		return testIndexes.Put(stub, "marble1", []byte(`{"docType":"marble","name":"marble1","color":"red"}`))
+	})
+	if indexEntry(t, stub, "blue", "marble1") != nil || indexEntry(t, stub, "red", "marble1") == nil {
+		t.Fatal("expected the entry to move from blue to red")
+	}
+
+	transaction(t, stub, func() error { return testIndexes.Del(stub, "marble1") })
+	if stub.State["marble1"] != nil || indexEntry(t, stub, "red", "marble1") != nil {
+		t.Fatal("expected the record and its entry to be deleted")
+	}
+
+	stub.MockTransactionStart("tx")
+	err := testIndexes.Put(stub, "marble2", []byte(`{"docType":"marble","name":"marble2"}`))
+	stub.MockTransactionEnd("tx")
+	if err == nil {
+		t.Fatal("expected a record missing an indexed field to be rejected")
+	}
+}
+
+func TestBackfillRebuildsOnceForDeclaredIndexes(t *testing.T) {
+	stub := shim.NewMockStub("index", nil)
+	stale, _ := stub.CreateCompositeKey("color~name", []string{"green", "marble1"})
+	transaction(t, stub, func() error {
+		// written before the index was declared, next to a stale entry
+		stub.PutState("marble1", []byte(`{"docType":"marble","name":"marble1","color":"blue"}`))
+		stub.PutState("owner1", []byte(`{"docType":"owner","name":"tom"}`))
+		return stub.PutState(stale, []byte{0x00})
+	})
+
+	var counts map[string]int
+	transaction(t, stub, func() (err error) {
+		counts, err = testIndexes.Backfill(stub)
+		return err
+	})
+	if counts["color~name"] != 1 || stub.State[stale] != nil || indexEntry(t, stub, "blue", "marble1") == nil {
+		t.Fatalf("expected the backfill to rebuild the color index, got %v", counts)
+	}
+
+	transaction(t, stub, func() (err error) {
+		counts, err = testIndexes.Backfill(stub)
+		return err
+	})
+	if counts != nil {
+		t.Fatalf("expected no rebuild for an unchanged set of indexes, got %v", counts)
+	}
+}
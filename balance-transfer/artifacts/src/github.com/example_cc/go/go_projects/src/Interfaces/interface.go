@@ -13,6 +13,17 @@ type InterfacePatient interface {
 	RegisterPatient(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	GetPatientBySSN(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	GetPatientByInformation(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	GetPatientByInformationWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	PurgePatient(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	CancelPurgeRequest(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	SetPurgeKey(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	RegisterPatientKey(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	ResetPatientKey(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	GetConsentReceiptHead(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	GetConsentReceipts(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	GetCohortStatistics(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	SetCohortThreshold(stub shim.ChaincodeStubInterface, args []string) pb.Response
+	RebuildIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	}
 
 type InterfaceProvider interface {
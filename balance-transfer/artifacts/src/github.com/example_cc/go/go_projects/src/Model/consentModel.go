@@ -0,0 +1,29 @@
+package entity
+
+// ConsentReceipt is a Kantara style consent receipt issued for every consent change.
+// Receipts of a patient form a chain through PreviousReceiptHash.
+type ConsentReceipt struct {
+	Version             string           `json:"version"`
+	ConsentReceiptID    string           `json:"consentReceiptID"`
+	ConsentTimestamp    int64            `json:"consentTimestamp"`
+	CollectionMethod    string           `json:"collectionMethod"`
+	PiiPrincipalId      string           `json:"piiPrincipalId"`
+	Sequence            uint64           `json:"sequence"`
+	Services            []ConsentService `json:"services"`
+	ConsentHash         string           `json:"consentHash"`
+	PreviousReceiptHash string           `json:"previousReceiptHash"`
+	Signature           string           `json:"signature,omitempty"`
+}
+
+type ConsentService struct {
+	Service    string `json:"service"`
+	ProviderId string `json:"providerId"`
+	StartTime  string `json:"starttime"`
+	EndTime    string `json:"endtime"`
+}
+
+// ConsentReceiptHead points at the latest receipt of a patient's chain
+type ConsentReceiptHead struct {
+	Sequence uint64 `json:"sequence"`
+	Hash     string `json:"hash"`
+}
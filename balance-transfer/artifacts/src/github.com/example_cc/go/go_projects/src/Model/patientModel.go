@@ -47,6 +47,30 @@ type PatientUnmarshal struct
 	Key string
 	Record Patient `json:"Patient"`
 }
+type PatientRecord struct {
+	Key    string  `json:"Key"`
+	Record Patient `json:"Record"`
+}
+type PatientPage struct {
+	Records      []PatientRecord `json:"records"`
+	FetchedCount int32           `json:"fetchedCount"`
+	ScannedCount int32           `json:"scannedCount"`
+	Bookmark     string          `json:"bookmark"`
+}
+type PurgeRequest struct {
+	ObjectType     string `json:"docType"`
+	PatientIdHash  string `json:"patientIdHash"`
+	Reason         string `json:"reason"`
+	RequestedBy    string `json:"requestedBy"`
+	RequestedByMSP string `json:"requestedByMSP"`
+}
+type PatientTombstone struct {
+	ObjectType    string   `json:"docType"`
+	PatientIdHash string   `json:"patientIdHash"`
+	Reason        string   `json:"reason"`
+	Approvers     []string `json:"approvers"`
+	Timestamp     string   `json:"timestamp"`
+}
 type PatientDetailsUnmarshal struct {
 	_id string
 	_rev string
@@ -55,4 +79,4 @@ type PatientDetailsUnmarshal struct {
 	Immunization  Immunization  `json:"immunization"`
 	Medications   Medications   `json:"medications"`
 	PastMedicalHx PastMedicalHx `json:"pastMedicalHx"`
-}
\ No newline at end of file
+}
\ No newline at end of file
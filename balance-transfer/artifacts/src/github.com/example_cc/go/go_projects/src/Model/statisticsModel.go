@@ -0,0 +1,29 @@
+package entity
+
+// CohortSpec describes a de-identified statistics request
+type CohortSpec struct {
+	Unit       string   `json:"unit"`
+	GroupBy    []string `json:"groupBy"`
+	Categories []string `json:"categories"`
+	K          int      `json:"k"`
+	BandWidth  int      `json:"bandWidth"` // fixed, accepted only for older clients
+}
+
+type CohortCell struct {
+	Group map[string]string `json:"group"`
+	Count int               `json:"count"`
+}
+
+// CohortStatistics only ever carries sums of cells at or above the k threshold.
+// Suppressed tells whether any cell below it was left out, not how many.
+type CohortStatistics struct {
+	Unit       string       `json:"unit"`
+	GroupBy    []string     `json:"groupBy"`
+	K          int          `json:"k"`
+	Cells      []CohortCell `json:"cells"`
+	Suppressed bool         `json:"suppressed"`
+}
+
+type CohortConfig struct {
+	MinK int `json:"minK"`
+}
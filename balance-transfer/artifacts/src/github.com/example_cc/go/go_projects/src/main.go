@@ -42,6 +42,28 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return inf.InterfacePatient.GetPatientBySSN(u, stub, args)
 	} else if function == "GetPatientByInformation" {
 		return inf.InterfacePatient.GetPatientByInformation(u, stub, args)
+	} else if function == "GetPatientByInformationWithPagination" {
+		return inf.InterfacePatient.GetPatientByInformationWithPagination(u, stub, args)
+	} else if function == "PurgePatient" {
+		return inf.InterfacePatient.PurgePatient(u, stub, args)
+	} else if function == "CancelPurgeRequest" {
+		return inf.InterfacePatient.CancelPurgeRequest(u, stub, args)
+	} else if function == "SetPurgeKey" {
+		return inf.InterfacePatient.SetPurgeKey(u, stub, args)
+	} else if function == "RegisterPatientKey" {
+		return inf.InterfacePatient.RegisterPatientKey(u, stub, args)
+	} else if function == "ResetPatientKey" {
+		return inf.InterfacePatient.ResetPatientKey(u, stub, args)
+	} else if function == "GetConsentReceiptHead" {
+		return inf.InterfacePatient.GetConsentReceiptHead(u, stub, args)
+	} else if function == "GetConsentReceipts" {
+		return inf.InterfacePatient.GetConsentReceipts(u, stub, args)
+	} else if function == "GetCohortStatistics" {
+		return inf.InterfacePatient.GetCohortStatistics(u, stub, args)
+	} else if function == "SetCohortThreshold" {
+		return inf.InterfacePatient.SetCohortThreshold(u, stub, args)
+	} else if function == "RebuildIndexes" {
+		return inf.InterfacePatient.RebuildIndexes(u, stub, args)
 	} else if function == "RegisterProvider" {
 		return inf.InterfaceProvider.RegisterProvider(u, stub, args)
 	} else if function == "GetProviderById" {
@@ -2,6 +2,10 @@
  SPDX-License-Identifier: Apache-2.0
 */
 
+// This copy of the marbles sample is kept for testAPIs.sh, which deploys it by path. New deployments
+// should use chaincode/marbles02/go, which offers these marbles functions on public state or on a
+// private data collection; see marbles_store.go there.
+
 // ====CHAINCODE EXECUTION SAMPLES (CLI) ==================
 
 // ==== Invoke marbles ====
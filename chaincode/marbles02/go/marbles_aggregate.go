@@ -0,0 +1,168 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ==== Aggregates =============================================================================
+// Aggregates are computed from the color~name and owner~name composite key indexes with
+// GetStateByPartialCompositeKey, so unlike queryMarblesByOwner they behave the same on LevelDB
+// and CouchDB. Counting only needs the index keys; totalling size reads each marble as well.
+// Marbles written before owner~name existed are indexed by the backfill Init runs on upgrade.
+// =============================================================================================
+
+// marbleGroupIndexes maps a groupable field to the composite key index led by it
+var marbleGroupIndexes = map[string]string{
+	"color": "color~name",
+	"owner": "owner~name",
+}
+
+type marbleGroup struct {
+	Count     int `json:"count"`
+	TotalSize int `json:"totalSize"`
+}
+
+// ============================================================
+// countMarblesByColor - number of marbles per color, or of one color
+// ============================================================
+func (t *SimpleChaincode) countMarblesByColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// ["blue"]
+	groups, err := aggregateMarbles(stub, "color", optionalArg(args, 0), false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	counts := map[string]int{}
+	for group, aggregate := range groups {
+		counts[group] = aggregate.Count
+	}
+	countsAsBytes, err := json.Marshal(counts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(countsAsBytes)
+}
+
+// ============================================================
+// sumSizeByOwner - total marble size per owner, or of one owner
+// ============================================================
+func (t *SimpleChaincode) sumSizeByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// ["tom"]
+	groups, err := aggregateMarbles(stub, "owner", optionalArg(args, 0), true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sums := map[string]int{}
+	for group, aggregate := range groups {
+		sums[group] = aggregate.TotalSize
+	}
+	sumsAsBytes, err := json.Marshal(sums)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(sumsAsBytes)
+}
+
+// ============================================================
+// groupMarbles - count and total size per color or per owner, optionally
+// narrowed to a single group
+// ============================================================
+func (t *SimpleChaincode) groupMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0        1
+	// "color", ["blue"]
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 1")
+	}
+
+	groups, err := aggregateMarbles(stub, args[0], optionalArg(args, 1), true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	groupsAsBytes, err := json.Marshal(groups)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(groupsAsBytes)
+}
+
+// aggregateMarbles scans the index led by field and aggregates per leading value. With
+// withSize unset only the index keys are read and TotalSize stays zero.
+func aggregateMarbles(stub shim.ChaincodeStubInterface, field string, value string, withSize bool) (map[string]*marbleGroup, error) {
+	indexName, ok := marbleGroupIndexes[field]
+	if !ok {
+		return nil, fmt.Errorf("Cannot group marbles by %s", field)
+	}
+
+	attributes := []string{}
+	if value != "" {
+		attributes = append(attributes, strings.ToLower(value))
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	groups := map[string]*marbleGroup{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		group := compositeKeyParts[0]
+		marbleName := compositeKeyParts[1]
+
+		aggregate, ok := groups[group]
+		if !ok {
+			aggregate = &marbleGroup{}
+			groups[group] = aggregate
+		}
+		aggregate.Count++
+
+		if withSize {
+			marbleAsBytes, err := stub.GetState(marbleName)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get marble: %s", err.Error())
+			} else if marbleAsBytes == nil {
+				return nil, fmt.Errorf("Index %s points at a missing marble: %s", indexName, marbleName)
+			}
+			indexed := marble{}
+			err = json.Unmarshal(marbleAsBytes, &indexed)
+			if err != nil {
+				return nil, err
+			}
+			aggregate.TotalSize += indexed.Size
+		}
+	}
+
+	return groups, nil
+}
+
+// optionalArg returns args[i], or an empty string when it was not passed
+func optionalArg(args []string, i int) string {
+	if len(args) > i {
+		return args[i]
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAggregateMarbles(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble2", "red", "50", "tom"))
+	expectSuccess(t, s.invoke(o["jerry"], "initMarble", "marble3", "blue", "20", "jerry"))
+	expectSuccess(t, s.invoke(o["tom"], "transferMarble", "marble2", "jerry"))
+
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "countMarblesByColor"))); got != `{"blue":2,"red":1}` {
+		t.Fatalf("unexpected color counts %s", got)
+	}
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "countMarblesByColor", "Blue"))); got != `{"blue":2}` {
+		t.Fatalf("unexpected blue count %s", got)
+	}
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "sumSizeByOwner"))); got != `{"jerry":70,"tom":35}` {
+		t.Fatalf("unexpected owner sums %s", got)
+	}
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "groupMarbles", "owner", "jerry"))); got != `{"jerry":{"count":2,"totalSize":70}}` {
+		t.Fatalf("unexpected owner group %s", got)
+	}
+	expectError(t, s.invoke(o["tom"], "groupMarbles", "size"), "Cannot group marbles by size")
+	expectError(t, s.invoke(o["tom"], "groupMarbles"), "Incorrect number of arguments")
+}
+
+func TestUpgradeBackfillsOwnerIndex(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+
+	// ==== Written by a chaincode version that only kept color~name ====
+	legacy := &marble{ObjectType: "marble", Name: "marble2", Color: "red", Size: 50, Owner: "tom"}
+	s.State["marble2"], _ = json.Marshal(legacy)
+	colorKey, _ := s.CreateCompositeKey("color~name", []string{"red", "marble2"})
+	s.State[colorKey] = []byte{0x00}
+	versionKey, _ := s.CreateCompositeKey("indexVersion", []string{})
+	s.State[versionKey] = []byte(`["color~name"]`)
+
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "sumSizeByOwner", "tom"))); got != `{"tom":35}` {
+		t.Fatalf("expected the legacy marble to be missing before the upgrade, got %s", got)
+	}
+
+	s.args = toArgs("init")
+	s.MockTransactionStart("upgrade")
+	expectSuccess(t, s.cc.Init(s))
+	s.MockTransactionEnd("upgrade")
+
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "sumSizeByOwner", "tom"))); got != `{"tom":85}` {
+		t.Fatalf("expected the backfill to index the legacy marble, got %s", got)
+	}
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "countMarblesByColor"))); got != `{"blue":1,"red":1}` {
+		t.Fatalf("backfill must not duplicate color entries, got %s", got)
+	}
+}
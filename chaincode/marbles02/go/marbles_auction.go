@@ -0,0 +1,405 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ==== Auctions ===============================================================================
+// An auction is keyed by auction~marble, so a marble can only be listed once at a time.
+// Bids are written under their own bid~marble~auctionId~txId keys instead of updating the
+// auction record, so concurrent bidders never conflict on the same key. closeAuction scans
+// the bids once the close time has passed and transfers the marble to the highest bidder.
+// While an auction is open the marble cannot be transferred, swapped or deleted. Should the
+// marble still have left the seller, for example in a transfer made before that rule, the
+// close voids the auction instead of selling it.
+// =============================================================================================
+
+type auction struct {
+	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	AuctionID  string `json:"auctionId"`
+	MarbleName string `json:"marbleName"`
+	Seller     string `json:"seller"`
+	Reserve    int    `json:"reserve"`
+	CloseTime  int64  `json:"closeTime"`
+	Status     string `json:"status"`
+	Winner     string `json:"winner,omitempty"`
+	WinningBid int    `json:"winningBid,omitempty"`
+}
+
+type bid struct {
+	ObjectType string `json:"docType"`
+	AuctionID  string `json:"auctionId"`
+	MarbleName string `json:"marbleName"`
+	Bidder     string `json:"bidder"`
+	Amount     int    `json:"amount"`
+	TxID       string `json:"txId"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+const (
+	auctionOpen   = "open"
+	auctionSold   = "sold"
+	auctionUnsold = "unsold"
+	auctionVoid   = "void"
+)
+
+// ============================================================
+// listForAuction - put a marble up for auction with a reserve price and close time
+// ============================================================
+func (t *SimpleChaincode) listForAuction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0         1               2
+	// "marble1", "100", "2019-06-01T12:00:00Z"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	marbleName := args[0]
+	reserve, err := strconv.Atoi(args[1])
+	if err != nil || reserve < 0 {
+		return shim.Error("2nd argument must be a non-negative numeric string")
+	}
+	closeTime, err := time.Parse(time.RFC3339, args[2])
+	if err != nil {
+		return shim.Error("3rd argument must be an RFC3339 timestamp")
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !closeTime.After(now) {
+		return shim.Error("Close time must be in the future")
+	}
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble: " + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist: " + marbleName)
+	}
+	marbleToList := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToList)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = authorizeMarbleOwner(stub, &marbleToList)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = checkMarbleUnlocked(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	existing, err := getAuction(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if existing != nil && existing.Status == auctionOpen {
+		return shim.Error("Marble is already listed for auction: " + marbleName)
+	}
+
+	listing := &auction{
+		ObjectType: "auction",
+		AuctionID:  stub.GetTxID(),
+		MarbleName: marbleName,
+		Seller:     marbleToList.Owner,
+		Reserve:    reserve,
+		CloseTime:  closeTime.Unix(),
+		Status:     auctionOpen,
+	}
+	err = putAuction(stub, listing)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(listing.AuctionID))
+}
+
+// ============================================================
+// placeBid - bid on an open auction before its close time
+// ============================================================
+func (t *SimpleChaincode) placeBid(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0        1
+	// "marble1", "120"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	marbleName := args[0]
+	amount, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
+	bidder, err := getCallerAlias(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	listing, err := getAuction(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if listing == nil || listing.Status != auctionOpen {
+		return shim.Error("Marble is not listed for auction: " + marbleName)
+	}
+	if bidder == listing.Seller {
+		return shim.Error("Seller cannot bid on their own marble")
+	}
+	if amount < listing.Reserve {
+		return shim.Error(fmt.Sprintf("Bid must meet the reserve of %d", listing.Reserve))
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Unix() >= listing.CloseTime {
+		return shim.Error("Auction has closed")
+	}
+
+	newBid := &bid{
+		ObjectType: "bid",
+		AuctionID:  listing.AuctionID,
+		MarbleName: marbleName,
+		Bidder:     bidder,
+		Amount:     amount,
+		TxID:       stub.GetTxID(),
+		Timestamp:  now.Unix(),
+	}
+	bidAsBytes, err := json.Marshal(newBid)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bidKey, err := stub.CreateCompositeKey("bid", []string{marbleName, listing.AuctionID, newBid.TxID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(bidKey, bidAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================
+// closeAuction - after the close time, transfer the marble to the highest bidder.
+// Ties go to the earliest bid. The seller keeps the marble if nobody met the reserve,
+// and the auction is void if the seller no longer has it.
+// ============================================================
+func (t *SimpleChaincode) closeAuction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	listing, err := getAuction(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if listing == nil || listing.Status != auctionOpen {
+		return shim.Error("Marble is not listed for auction: " + marbleName)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Unix() < listing.CloseTime {
+		return shim.Error("Auction is still open until " + time.Unix(listing.CloseTime, 0).UTC().Format(time.RFC3339))
+	}
+
+	bidsIterator, err := stub.GetStateByPartialCompositeKey("bid", []string{marbleName, listing.AuctionID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer bidsIterator.Close()
+
+	var highest *bid
+	for bidsIterator.HasNext() {
+		responseRange, err := bidsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		candidate := &bid{}
+		err = json.Unmarshal(responseRange.Value, candidate)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if highest == nil || candidate.Amount > highest.Amount ||
+			(candidate.Amount == highest.Amount && candidate.Timestamp < highest.Timestamp) {
+			highest = candidate
+		}
+	}
+
+	// The seller may have moved the marble on or deleted it since listing
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble: " + err.Error())
+	}
+	marbleToSell := marble{}
+	if marbleAsBytes != nil {
+		err = json.Unmarshal(marbleAsBytes, &marbleToSell)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	listing.Status = auctionUnsold
+	var sold *marbleEventEntry
+	if marbleAsBytes == nil || marbleToSell.Owner != listing.Seller {
+		listing.Status = auctionVoid
+	} else if highest != nil {
+		winner, err := getOwnerByAlias(stub, highest.Bidder)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if winner == nil {
+			return shim.Error("Owner is not registered: " + highest.Bidder)
+		}
+
+		// Only the owner is rewritten, so the color~name index stays intact
+		before := marbleToSell
+		err = setMarbleOwner(stub, &marbleToSell, winner)
+		if err != nil {
+			return shim.Error("Transfer failed: " + err.Error())
+		}
+		entry := newMarbleEventEntry(&before, &marbleToSell)
+		sold = &entry
+		listing.Status = auctionSold
+		listing.Winner = highest.Bidder
+		listing.WinningBid = highest.Amount
+	}
+
+	err = putAuction(stub, listing)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if sold != nil {
+		err = setMarbleEvent(stub, &marbleEvent{Type: eventMarbleTransferred, Marbles: []marbleEventEntry{*sold}})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	auctionAsBytes, err := json.Marshal(listing)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(auctionAsBytes)
+}
+
+// ============================================================
+// getBidsForAuction - list the bids of a marble's current auction, or of an
+// earlier auction when its auction id is given
+// ============================================================
+func (t *SimpleChaincode) getBidsForAuction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0          1
+	// "marble1", ["auctionId"]
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	auctionID := ""
+	if len(args) > 1 {
+		auctionID = args[1]
+	} else {
+		listing, err := getAuction(stub, marbleName)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if listing == nil {
+			return shim.Error("Marble has never been listed for auction: " + marbleName)
+		}
+		auctionID = listing.AuctionID
+	}
+
+	bidsIterator, err := stub.GetStateByPartialCompositeKey("bid", []string{marbleName, auctionID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer bidsIterator.Close()
+
+	results, err := constructQueryResponseFromIterator(bidsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := constructQueryResponse(results, nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- getBidsForAuction queryResult:\n%s\n", string(queryResults))
+
+	return shim.Success(queryResults)
+}
+
+// checkMarbleNotAuctioned fails if a marble is listed in an open auction
+func checkMarbleNotAuctioned(stub shim.ChaincodeStubInterface, marbleName string) error {
+	listing, err := getAuction(stub, marbleName)
+	if err != nil {
+		return err
+	} else if listing != nil && listing.Status == auctionOpen {
+		return fmt.Errorf("Marble is listed for auction: %s", marbleName)
+	}
+	return nil
+}
+
+// getAuction reads the latest auction of a marble, nil if it was never listed
+func getAuction(stub shim.ChaincodeStubInterface, marbleName string) (*auction, error) {
+	auctionKey, err := stub.CreateCompositeKey("auction", []string{marbleName})
+	if err != nil {
+		return nil, err
+	}
+	auctionAsBytes, err := stub.GetState(auctionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get auction: %s", err.Error())
+	} else if auctionAsBytes == nil {
+		return nil, nil
+	}
+
+	listing := &auction{}
+	err = json.Unmarshal(auctionAsBytes, listing)
+	if err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
+
+// putAuction writes an auction under its marble's auction key
+func putAuction(stub shim.ChaincodeStubInterface, listing *auction) error {
+	auctionKey, err := stub.CreateCompositeKey("auction", []string{listing.MarbleName})
+	if err != nil {
+		return err
+	}
+	auctionAsBytes, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(auctionKey, auctionAsBytes)
+}
+
+// getTxTime returns the transaction timestamp, which is the same on every endorser
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
@@ -0,0 +1,105 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func readTestAuction(t *testing.T, payload []byte) *auction {
+	t.Helper()
+	listing := &auction{}
+	err := json.Unmarshal(payload, listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listing
+}
+
+func TestAuctionSellsToHighestBidder(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry", "spike")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	closeTime := s.now.Add(time.Hour).Format(time.RFC3339)
+
+	expectError(t, s.invoke(o["jerry"], "listForAuction", "marble1", "100", closeTime), "not the owner")
+	expectError(t, s.invoke(o["tom"], "listForAuction", "marble1", "100", s.now.Format(time.RFC3339)), "in the future")
+	expectSuccess(t, s.invoke(o["tom"], "listForAuction", "marble1", "100", closeTime))
+	expectError(t, s.invoke(o["tom"], "listForAuction", "marble1", "100", closeTime), "already listed")
+
+	expectError(t, s.invoke(o["tom"], "placeBid", "marble1", "150"), "own marble")
+	expectError(t, s.invoke(o["jerry"], "placeBid", "marble1", "99"), "reserve of 100")
+	expectSuccess(t, s.invoke(o["jerry"], "placeBid", "marble1", "120"))
+	s.advance(time.Minute)
+	expectSuccess(t, s.invoke(o["spike"], "placeBid", "marble1", "130"))
+	s.advance(time.Minute)
+	expectSuccess(t, s.invoke(o["jerry"], "placeBid", "marble1", "130"))
+
+	// ==== The marble stays with the seller while the auction is open ====
+	expectError(t, s.invoke(o["tom"], "transferMarble", "marble1", "jerry"), "listed for auction")
+	expectError(t, s.invoke(o["tom"], "delete", "marble1"), "listed for auction")
+	expectError(t, s.invoke(o["tom"], "closeAuction", "marble1"), "still open")
+
+	s.advance(time.Hour)
+	expectError(t, s.invoke(o["jerry"], "placeBid", "marble1", "200"), "has closed")
+	listing := readTestAuction(t, expectSuccess(t, s.invoke(o["jerry"], "closeAuction", "marble1")))
+	if listing.Status != auctionSold || listing.Winner != "spike" || listing.WinningBid != 130 {
+		t.Fatalf("expected the earliest highest bid of spike to win, got %+v", listing)
+	}
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "spike" {
+		t.Fatalf("marble was not transferred to the winner, owner is %s", m.Owner)
+	}
+	if s.event == nil || s.event.EventName != eventMarbleTransferred {
+		t.Fatal("expected a transfer event for the sale")
+	}
+	expectError(t, s.invoke(o["jerry"], "closeAuction", "marble1"), "not listed")
+	expectSuccess(t, s.invoke(o["spike"], "transferMarble", "marble1", "jerry"))
+}
+
+func TestAuctionWithoutBidsIsUnsold(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "listForAuction", "marble1", "100", s.now.Add(time.Hour).Format(time.RFC3339)))
+
+	s.advance(2 * time.Hour)
+	listing := readTestAuction(t, expectSuccess(t, s.invoke(o["tom"], "closeAuction", "marble1")))
+	if listing.Status != auctionUnsold {
+		t.Fatalf("expected the auction to close unsold, got %s", listing.Status)
+	}
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "tom" {
+		t.Fatalf("seller should keep an unsold marble, owner is %s", m.Owner)
+	}
+}
+
+func TestAuctionIsVoidWhenSellerLostMarble(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble2", "red", "50", "tom"))
+	closeTime := s.now.Add(time.Hour).Format(time.RFC3339)
+	expectSuccess(t, s.invoke(o["tom"], "listForAuction", "marble1", "100", closeTime))
+	expectSuccess(t, s.invoke(o["tom"], "listForAuction", "marble2", "100", closeTime))
+	expectSuccess(t, s.invoke(o["jerry"], "placeBid", "marble1", "120"))
+
+	// ==== Moved on, or deleted, by a chaincode version without the auction check ====
+	moved := readTestMarble(t, s, "marble1")
+	moved.Owner = "jerry"
+	s.State["marble1"], _ = json.Marshal(moved)
+	delete(s.State, "marble2")
+
+	s.advance(2 * time.Hour)
+	for _, name := range []string{"marble1", "marble2"} {
+		listing := readTestAuction(t, expectSuccess(t, s.invoke(o["jerry"], "closeAuction", name)))
+		if listing.Status != auctionVoid || listing.Winner != "" {
+			t.Fatalf("expected the auction of %s to be void, got %+v", name, listing)
+		}
+	}
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "jerry" {
+		t.Fatalf("void auction must not move the marble, owner is %s", m.Owner)
+	}
+}
@@ -4,18 +4,44 @@
 
 // ====CHAINCODE EXECUTION SAMPLES (CLI) ==================
 
+// ==== Instantiate marbles ====
+// Marbles are kept in public state by default, or in a private data collection; see marbles_store.go.
+// An upgrade keeps the backend chosen at instantiate.
+// peer chaincode instantiate -C myc1 -n marbles -v 1.0 -c '{"Args":["init"]}' -P "OR('Org1MSP.member','Org2MSP.member')"
+// peer chaincode instantiate -C myc1 -n marbles -v 1.0 -c '{"Args":["init","private","collectionMarbles"]}' -P "OR('Org1MSP.member','Org2MSP.member')" --collections-config $GOPATH/src/github.com/hyperledger/fabric-samples/chaincode/marbles02/collections_config.json
+
 // ==== Invoke marbles ====
+// Marbles are owned by the submitting client identity; the owner argument is its display alias.
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["registerOwner","jerry"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble1","blue","35","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble2","red","50","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble3","blue","70","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["setOperator","jerry","true"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["importMarbles","[{\"name\":\"marble4\",\"color\":\"green\",\"size\":20}]","false"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["importMarbles","","true"]}' --transient "{\"marbles\":\"$(echo -n '[...]' | base64)\"}"
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["listForAuction","marble3","100","2019-06-01T12:00:00Z"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["placeBid","marble3","120"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["closeAuction","marble3"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["proposeSwap","marble1","marble2","2019-06-01T12:00:00Z"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["acceptSwap","<swapId>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["cancelSwap","<swapId>"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["rebuildIndexes"]}'
 
 // ==== Query marbles ====
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarble","marble1"]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble3"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRangeWithPagination","marble1","marble3","2",""]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByColorWithPagination","blue","2",""]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1","2019-01-01T00:00:00Z","","owner"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getBidsForAuction","marble3"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["readSwap","<swapId>"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["countMarblesByColor"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["sumSizeByOwner","tom"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["groupMarbles","color","blue"]}'
 
 // Rich Query (Only supported if CouchDB is used as state database):
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
@@ -33,8 +59,11 @@
 // CouchDB index JSON syntax as documented at:
 // http://docs.couchdb.org/en/2.1.1/api/database/find.html#db-index
 //
-// This marbles02 example chaincode demonstrates a packaged
-// index which you can find in META-INF/statedb/couchdb/indexes/indexOwner.json.
+// This marbles02 example chaincode demonstrates packaged
+// indexes which you can find in META-INF/statedb/couchdb/indexes/indexOwner.json
+// and indexSizeSortDesc.json, with copies for the private backend under
+// META-INF/statedb/couchdb/collections/collectionMarbles/indexes. Ad hoc queries may only sort on these indexes; when adding
+// an index file, also add it to packagedIndexes in marbles_query.go.
 // For deployment of chaincode to production environments, it is recommended
 // to define any indexes alongside chaincode so that the chaincode and supporting indexes
 // are deployed automatically as a unit, once the chaincode has been installed on a peer and
@@ -80,7 +109,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strconv"
@@ -96,11 +124,14 @@ type SimpleChaincode struct {
 }
 
 type marble struct {
-	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
-	Name       string `json:"name"`    //the fieldtags are needed to keep case from bouncing around
-	Color      string `json:"color"`
-	Size       int    `json:"size"`
-	Owner      string `json:"owner"`
+	ObjectType string     `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name       string     `json:"name"`    //the fieldtags are needed to keep case from bouncing around
+	Color      string     `json:"color"`
+	Size       int        `json:"size"`
+	Owner      string     `json:"owner"`   //display alias of the owner, see marbles_owner.go
+	OwnerID    string     `json:"ownerId"` //cid.GetID of the owning client
+	OwnerMSP   string     `json:"ownerMSP"`
+	ModifiedBy *submitter `json:"modifiedBy,omitempty"` //identity of the last transaction writing the marble, see marbles_history.go
 }
 
 // ===================================================================================
@@ -116,6 +147,18 @@ func main() {
 // Init initializes chaincode
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	// ==== Select the storage backend, or keep it on upgrade, see marbles_store.go ====
+	config, err := initStorageConfig(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Build indexes added since the last instantiate or upgrade over the existing marbles ====
+	_, err = marbleIndexes.Backfill(config.stub(stub))
+	if err != nil {
+		return shim.Error("Failed to backfill indexes: " + err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -125,6 +168,12 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Println("invoke is running " + function)
 
+	// Run every function against the storage backend selected at Init
+	stub, err := storageStub(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// Handle different functions
 	if function == "initMarble" { //create a new marble
 		return t.initMarble(stub, args)
@@ -146,8 +195,42 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.getMarblesByRange(stub, args)
 	} else if function == "getMarblesByRangeWithPagination" {
 		return t.getMarblesByRangeWithPagination(stub, args)
+	} else if function == "rebuildIndexes" { //admin only, regenerate the composite key indexes from the marbles
+		return t.rebuildIndexes(stub, args)
+	} else if function == "getMarblesByColorWithPagination" { //page through marbles of a color using the color~name index
+		return t.getMarblesByColorWithPagination(stub, args)
 	} else if function == "queryMarblesWithPagination" {
 		return t.queryMarblesWithPagination(stub, args)
+	} else if function == "listForAuction" { //put a marble up for auction
+		return t.listForAuction(stub, args)
+	} else if function == "placeBid" { //bid on an open auction
+		return t.placeBid(stub, args)
+	} else if function == "closeAuction" { //sell an auctioned marble to the highest bidder
+		return t.closeAuction(stub, args)
+	} else if function == "getBidsForAuction" { //get the bid history of an auction
+		return t.getBidsForAuction(stub, args)
+	} else if function == "proposeSwap" { //offer one marble for another
+		return t.proposeSwap(stub, args)
+	} else if function == "acceptSwap" { //exchange both marbles of a proposed swap
+		return t.acceptSwap(stub, args)
+	} else if function == "cancelSwap" { //withdraw a swap proposal
+		return t.cancelSwap(stub, args)
+	} else if function == "readSwap" { //read a swap proposal
+		return t.readSwap(stub, args)
+	} else if function == "registerOwner" { //bind an owner alias to the calling identity
+		return t.registerOwner(stub, args)
+	} else if function == "setOperator" { //approve another owner to move the caller's marbles
+		return t.setOperator(stub, args)
+	} else if function == "migrateMarbleOwner" { //admin only, bind a legacy marble to its registered owner alias
+		return t.migrateMarbleOwner(stub, args)
+	} else if function == "importMarbles" { //create many marbles in one proposal
+		return t.importMarbles(stub, args)
+	} else if function == "countMarblesByColor" { //count marbles per color from the color~name index
+		return t.countMarblesByColor(stub, args)
+	} else if function == "sumSizeByOwner" { //total marble size per owner from the owner~name index
+		return t.sumSizeByOwner(stub, args)
+	} else if function == "groupMarbles" { //count and total size per color or owner
+		return t.groupMarbles(stub, args)
 	}
 
 	fmt.Println("invoke did not find func: " + function) //error
@@ -182,10 +265,16 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	}
 	marbleName := args[0]
 	color := strings.ToLower(args[1])
-	owner := strings.ToLower(args[3])
+	alias := strings.ToLower(args[3])
 	size, err := strconv.Atoi(args[2])
+	if err != nil || size <= 0 {
+		return shim.Error("3rd argument must be a positive numeric string")
+	}
+
+	// ==== The caller owns the new marble, under the alias given ====
+	marbleOwner, err := claimOwnerAlias(stub, alias)
 	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return shim.Error(err.Error())
 	}
 
 	// ==== Check if marble already exists ====
@@ -197,43 +286,49 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error("This marble already exists: " + marbleName)
 	}
 
-	// ==== Create marble object and marshal to JSON ====
+	// ==== Create marble object, save and index it ====
 	objectType := "marble"
-	marble := &marble{objectType, marbleName, color, size, owner}
-	marbleJSONasBytes, err := json.Marshal(marble)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	//Alternatively, build the marble json string manually if you don't want to use struct marshalling
-	//marbleJSONasString := `{"docType":"Marble",  "name": "` + marbleName + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "owner": "` + owner + `"}`
-	//marbleJSONasBytes := []byte(str)
-
-	// === Save marble to state ===
-	err = stub.PutState(marbleName, marbleJSONasBytes)
+	marble := &marble{objectType, marbleName, color, size, marbleOwner.Alias, marbleOwner.ID, marbleOwner.MSPID, nil}
+	err = createMarble(stub, marble)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	//  ==== Index the marble to enable color-based range queries, e.g. return all blue marbles ====
-	//  An 'index' is a normal key/value entry in state.
-	//  The key is a composite key, with the elements that you want to range query on listed first.
-	//  In our case, the composite key is based on indexName~color~name.
-	//  This will enable very efficient state range queries based on composite keys matching indexName~color~*
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marble.Color, marble.Name})
+	err = setMarbleEvent(stub, &marbleEvent{Type: eventMarbleCreated, Marbles: []marbleEventEntry{newMarbleEventEntry(nil, marble)}})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
-	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(colorNameIndexKey, value)
 
 	// ==== Marble saved and indexed. Return success ====
 	fmt.Println("- end init marble")
 	return shim.Success(nil)
 }
 
+// ============================================================
+// createMarble - save a new marble to state and index it
+// ============================================================
+func createMarble(stub shim.ChaincodeStubInterface, marble *marble) error {
+	var err error
+	marble.ModifiedBy, err = getSubmitter(stub)
+	if err != nil {
+		return err
+	}
+	marbleJSONasBytes, err := json.Marshal(marble)
+	if err != nil {
+		return err
+	}
+	//Alternatively, build the marble json string manually if you don't want to use struct marshalling
+	//marbleJSONasString := `{"docType":"Marble",  "name": "` + marbleName + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "owner": "` + owner + `"}`
+	//marbleJSONasBytes := []byte(str)
+
+	//  ==== Save marble to state and index it ====
+	//  An 'index' is a normal key/value entry in state.
+	//  The key is a composite key, with the elements that you want to range query on listed first.
+	//  marbleIndexes maintains color~name, for color-based range queries e.g. return all blue marbles,
+	//  and owner~name, for owner aggregates without rich queries.
+	return marbleIndexes.Put(stub, marble.Name, marbleJSONasBytes)
+}
+
 // ===============================================
 // readMarble - read a marble from chaincode state
 // ===============================================
@@ -269,7 +364,7 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 	}
 	marbleName := args[0]
 
-	// to maintain the color~name index, we need to read the marble first and get its color
+	// read the marble first to check who may delete it
 	valAsbytes, err := stub.GetState(marbleName) //get the marble from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + marbleName + "\"}"
@@ -285,23 +380,33 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error(jsonResp)
 	}
 
-	err = stub.DelState(marbleName) //remove the marble from chaincode state
+	err = authorizeMarbleOwner(stub, &marbleJSON)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	// maintain the index
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marbleJSON.Color, marbleJSON.Name})
+	err = checkMarbleUnlocked(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkMarbleNotAuctioned(stub, marbleName)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	//  Delete index entry to state.
-	err = stub.DelState(colorNameIndexKey)
+	err = marbleIndexes.Del(stub, marbleName) //remove the marble and its index entries from chaincode state
 	if err != nil {
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
+	err = recordMarbleDeletion(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = setMarbleEvent(stub, &marbleEvent{Type: eventMarbleDeleted, Marbles: []marbleEventEntry{newMarbleEventEntry(&marbleJSON, nil)}})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -320,81 +425,109 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	newOwner := strings.ToLower(args[1])
 	fmt.Println("- start transferMarble ", marbleName, newOwner)
 
+	transferred, err := transferMarbleTo(stub, marbleName, newOwner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = setMarbleEvent(stub, &marbleEvent{Type: eventMarbleTransferred, Marbles: []marbleEventEntry{transferred}})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transferMarble (success)")
+	return shim.Success(nil)
+}
+
+// transferMarbleTo moves one marble to a registered owner, returning the change for the event
+func transferMarbleTo(stub shim.ChaincodeStubInterface, marbleName string, newOwner string) (marbleEventEntry, error) {
 	marbleAsBytes, err := stub.GetState(marbleName)
 	if err != nil {
-		return shim.Error("Failed to get marble:" + err.Error())
+		return marbleEventEntry{}, fmt.Errorf("Failed to get marble:%s", err.Error())
 	} else if marbleAsBytes == nil {
-		return shim.Error("Marble does not exist")
+		return marbleEventEntry{}, fmt.Errorf("Marble does not exist")
+	}
+
+	err = checkMarbleUnlocked(stub, marbleName)
+	if err != nil {
+		return marbleEventEntry{}, err
+	}
+	err = checkMarbleNotAuctioned(stub, marbleName)
+	if err != nil {
+		return marbleEventEntry{}, err
 	}
 
 	marbleToTransfer := marble{}
 	err = json.Unmarshal(marbleAsBytes, &marbleToTransfer) //unmarshal it aka JSON.parse()
 	if err != nil {
-		return shim.Error(err.Error())
+		return marbleEventEntry{}, err
 	}
-	marbleToTransfer.Owner = newOwner //change the owner
+	before := marbleToTransfer
 
-	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
-	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble
+	err = authorizeMarbleOwner(stub, &marbleToTransfer)
 	if err != nil {
-		return shim.Error(err.Error())
+		return marbleEventEntry{}, err
 	}
 
-	fmt.Println("- end transferMarble (success)")
-	return shim.Success(nil)
+	recipient, err := getOwnerByAlias(stub, newOwner)
+	if err != nil {
+		return marbleEventEntry{}, err
+	} else if recipient == nil {
+		return marbleEventEntry{}, fmt.Errorf("Owner is not registered: %s", newOwner)
+	}
+
+	err = setMarbleOwner(stub, &marbleToTransfer, recipient) //change the owner and rewrite the marble
+	if err != nil {
+		return marbleEventEntry{}, err
+	}
+	return newMarbleEventEntry(&before, &marbleToTransfer), nil
 }
 
 // ===========================================================================================
-// constructQueryResponseFromIterator constructs a JSON array containing query results from
-// a given result iterator
+// queryResult is one record of a query response. Record is a JSON object, so it is kept as-is.
 // ===========================================================================================
-func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+type queryResult struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+// ===========================================================================================
+// queryResponse is the envelope returned by every marbles list query. Queries that are not
+// paginated return all of their results and an empty bookmark.
+// ===========================================================================================
+type queryResponse struct {
+	Results             []queryResult `json:"results"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
 
-	bArrayMemberAlreadyWritten := false
+// ===========================================================================================
+// constructQueryResponseFromIterator collects the query results of a given result iterator
+// ===========================================================================================
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) ([]queryResult, error) {
+	results := []queryResult{}
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
 			return nil, err
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+		results = append(results, queryResult{Key: queryResponse.Key, Record: queryResponse.Value})
 	}
-	buffer.WriteString("]")
-
-	return &buffer, nil
+	return results, nil
 }
 
 // ===========================================================================================
-// addPaginationMetadataToQueryResults adds QueryResponseMetadata, which contains pagination
-// info, to the constructed query results
+// constructQueryResponse wraps query results in the response envelope. responseMetadata,
+// which contains pagination info, is nil for queries that are not paginated. The count is
+// always that of the results returned, which is less than the metadata's count when a query
+// skipped some of the records it fetched.
 // ===========================================================================================
-func addPaginationMetadataToQueryResults(buffer *bytes.Buffer, responseMetadata *pb.QueryResponseMetadata) *bytes.Buffer {
-
-	buffer.WriteString("[{\"ResponseMetadata\":{\"RecordsCount\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(fmt.Sprintf("%v", responseMetadata.FetchedRecordsCount))
-	buffer.WriteString("\"")
-	buffer.WriteString(", \"Bookmark\":")
-	buffer.WriteString("\"")
-	buffer.WriteString(responseMetadata.Bookmark)
-	buffer.WriteString("\"}}]")
-
-	return buffer
+func constructQueryResponse(results []queryResult, responseMetadata *pb.QueryResponseMetadata) ([]byte, error) {
+	response := queryResponse{Results: results, FetchedRecordsCount: int32(len(results))}
+	if responseMetadata != nil {
+		response.Bookmark = responseMetadata.Bookmark
+	}
+	return json.Marshal(response)
 }
 
 // ===========================================================================================
@@ -423,18 +556,25 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 	}
 	defer resultsIterator.Close()
 
-	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	results, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := constructQueryResponse(results, nil)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", buffer.String())
+	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", string(queryResults))
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(queryResults)
 }
 
 // ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
-// transferMarblesBasedOnColor will transfer marbles of a given color to a certain new owner.
+// transferMarblesBasedOnColor will transfer the caller's marbles of a given color to a certain new
+// owner. Marbles of that color the caller may not move, as neither their owner nor an approved
+// operator, are left where they are; any other failure aborts the whole transfer.
 // Uses a GetStateByPartialCompositeKey (range query) against color~name 'index'.
 // Committing peers will re-execute range queries to guarantee that result sets are stable
 // between endorsement time and commit time. The transaction is invalidated by the
@@ -461,9 +601,9 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 	}
 	defer coloredMarbleResultsIterator.Close()
 
-	// Iterate through result set and for each marble found, transfer to newOwner
-	var i int
-	for i = 0; coloredMarbleResultsIterator.HasNext(); i++ {
+	// Iterate through result set and for each marble of the caller found, transfer to newOwner
+	transferred := []marbleEventEntry{}
+	for coloredMarbleResultsIterator.HasNext() {
 		// Note that we don't get the value (2nd return variable), we'll just get the marble name from the composite key
 		responseRange, err := coloredMarbleResultsIterator.Next()
 		if err != nil {
@@ -479,16 +619,40 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 		returnedMarbleName := compositeKeyParts[1]
 		fmt.Printf("- found a marble from index:%s color:%s name:%s\n", objectType, returnedColor, returnedMarbleName)
 
-		// Now call the transfer function for the found marble.
+		// Skip the marbles of other owners
+		marbleAsBytes, err := stub.GetState(returnedMarbleName)
+		if err != nil {
+			return shim.Error("Failed to get marble: " + err.Error())
+		}
+		coloredMarble := marble{}
+		err = json.Unmarshal(marbleAsBytes, &coloredMarble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		allowed, err := callerMovesMarble(stub, &coloredMarble)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if !allowed {
+			continue
+		}
+
+		// Now transfer the found marble.
 		// Re-use the same function that is used to transfer individual marbles
-		response := t.transferMarble(stub, []string{returnedMarbleName, newOwner})
+		entry, err := transferMarbleTo(stub, returnedMarbleName, newOwner)
 		// if the transfer failed break out of loop and return error
-		if response.Status != shim.OK {
-			return shim.Error("Transfer failed: " + response.Message)
+		if err != nil {
+			return shim.Error("Transfer failed: " + err.Error())
 		}
+		transferred = append(transferred, entry)
+	}
+
+	// One event summarises every marble moved, as a transaction can only set one
+	err = setMarbleEvent(stub, &marbleEvent{Type: eventBulkColorTransfer, Color: color, Marbles: transferred})
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	responsePayload := fmt.Sprintf("Transferred %d %s marbles to %s", i, color, newOwner)
+	responsePayload := fmt.Sprintf("Transferred %d %s marbles to %s", len(transferred), color, newOwner)
 	fmt.Println("- end transferMarblesBasedOnColor: " + responsePayload)
 	return shim.Success([]byte(responsePayload))
 }
@@ -522,7 +686,10 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 
 	owner := strings.ToLower(args[0])
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
+	queryString, err := buildMarbleQuery(map[string]interface{}{"owner": owner})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
@@ -533,7 +700,8 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 
 // ===== Example: Ad hoc rich query ========================================================
 // queryMarbles uses a query string to perform a query for marbles.
-// Query string matching state database syntax is passed in and executed as is.
+// Query string matching state database syntax is passed in and checked by validateRichQuery,
+// which limits it to marbles, allowed fields and operators, and sorts backed by an index.
 // Supports ad hoc queries that can be defined at runtime by the client.
 // If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
 // Only available on state databases that support rich query (e.g. CouchDB)
@@ -546,7 +714,10 @@ func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	queryString := args[0]
+	queryString, err := validateRichQuery(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
@@ -569,14 +740,19 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	}
 	defer resultsIterator.Close()
 
-	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	results, err := constructQueryResponseFromIterator(resultsIterator)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+	queryResults, err := constructQueryResponse(results, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	return buffer.Bytes(), nil
+	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", string(queryResults))
+
+	return queryResults, nil
 }
 
 // ====== Pagination =========================================================================
@@ -586,9 +762,13 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 // the next query to retrieve the next page of results.  Paginated queries extend
 // rich queries and range queries to include a pagesize and bookmark.
 //
-// Two examples are provided in this example.  The first is getMarblesByRangeWithPagination
+// Three examples are provided in this example.  The first is getMarblesByRangeWithPagination
 // which executes a paginated range query.
-// The second example is a paginated query for rich ad-hoc queries.
+// The second is getMarblesByColorWithPagination, a paginated query against the color~name index.
+// The third example is a paginated query for rich ad-hoc queries.
+//
+// Every list query, paginated or not, returns the same envelope:
+// {"results":[{"Key":...,"Record":...}],"fetchedRecordsCount":n,"bookmark":"..."}
 // =========================================================================================
 
 // ====== Example: Pagination with Range Query ===============================================
@@ -619,21 +799,87 @@ func (t *SimpleChaincode) getMarblesByRangeWithPagination(stub shim.ChaincodeStu
 	}
 	defer resultsIterator.Close()
 
-	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	results, err := constructQueryResponseFromIterator(resultsIterator)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+	queryResults, err := constructQueryResponse(results, responseMetadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", bufferWithPaginationInfo.String())
+	fmt.Printf("- getMarblesByRangeWithPagination queryResult:\n%s\n", string(queryResults))
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(queryResults)
+}
+
+// ====== Example: Pagination with Composite Key Query ======================================
+// getMarblesByColorWithPagination pages through the color~name index for a color and
+// returns the marbles the index entries point to, keyed by marble name.
+
+// The number of fetched records will be equal to or lesser than the page size.
+// Paginated composite key queries are only valid for read only transactions.
+// ===========================================================================================
+func (t *SimpleChaincode) getMarblesByColorWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0      1    2
+	// "blue", "3", ""
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	color := strings.ToLower(args[0])
+	//return type of ParseInt is int64
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bookmark := args[2]
+
+	coloredMarbleResultsIterator, responseMetadata, err := stub.GetStateByPartialCompositeKeyWithPagination("color~name", []string{color}, int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer coloredMarbleResultsIterator.Close()
+
+	results := []queryResult{}
+	for coloredMarbleResultsIterator.HasNext() {
+		responseRange, err := coloredMarbleResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marbleName := compositeKeyParts[1]
+
+		marbleAsBytes, err := stub.GetState(marbleName)
+		if err != nil {
+			return shim.Error("Failed to get marble: " + err.Error())
+		} else if marbleAsBytes == nil {
+			// the index entry outlived its marble; skip it rather than fail the page
+			continue
+		}
+		results = append(results, queryResult{Key: marbleName, Record: marbleAsBytes})
+	}
+
+	queryResults, err := constructQueryResponse(results, responseMetadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- getMarblesByColorWithPagination queryResult:\n%s\n", string(queryResults))
+
+	return shim.Success(queryResults)
 }
 
 // ===== Example: Pagination with Ad hoc Rich Query ========================================================
 // queryMarblesWithPagination uses a query string, page size and a bookmark to perform a query
-// for marbles. Query string matching state database syntax is passed in and executed as is.
+// for marbles. Query string matching state database syntax is passed in and checked by
+// validateRichQuery, and the page size is capped like the query limit.
 // The number of fetched records would be equal to or lesser than the specified page size.
 // Supports ad hoc queries that can be defined at runtime by the client.
 // If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
@@ -648,12 +894,18 @@ func (t *SimpleChaincode) queryMarblesWithPagination(stub shim.ChaincodeStubInte
 		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
-	queryString := args[0]
+	queryString, err := validateRichQuery(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	//return type of ParseInt is int64
 	pageSize, err := strconv.ParseInt(args[1], 10, 32)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if pageSize <= 0 || pageSize > maxRichQueryLimit {
+		return shim.Error(fmt.Sprintf("Page size must be between 1 and %d", maxRichQueryLimit))
+	}
 	bookmark := args[2]
 
 	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, int32(pageSize), bookmark)
@@ -677,25 +929,45 @@ func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface
 	}
 	defer resultsIterator.Close()
 
-	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	results, err := constructQueryResponseFromIterator(resultsIterator)
 	if err != nil {
 		return nil, err
 	}
 
-	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+	queryResults, err := constructQueryResponse(results, responseMetadata)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", bufferWithPaginationInfo.String())
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryResult:\n%s\n", string(queryResults))
 
-	return buffer.Bytes(), nil
+	return queryResults, nil
 }
 
+// ===========================================================================================
+// getHistoryForMarble returns every version of a marble, oldest first, with the fields
+// that changed from the previous version and the identity that submitted the change.
+// Versions can be narrowed to a time range (RFC3339, either bound may be empty) and to
+// those that changed a given field.
+// ===========================================================================================
 func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	//     0           1                       2                  3
+	// "marble1", ["2019-01-01T00:00:00Z"], ["2019-12-31T00:00:00Z"], ["owner"]
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return shim.Error("Incorrect number of arguments. Expecting at least 1")
 	}
 
 	marbleName := args[0]
+	var from, to time.Time
+	var err error
+	if from, err = parseOptionalTime(optionalArg(args, 1)); err != nil {
+		return shim.Error("2nd argument must be an RFC3339 timestamp")
+	}
+	if to, err = parseOptionalTime(optionalArg(args, 2)); err != nil {
+		return shim.Error("3rd argument must be an RFC3339 timestamp")
+	}
+	field := optionalArg(args, 3)
 
 	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
 
@@ -705,51 +977,18 @@ func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface,
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing historic values for the marble
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON marble)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
-		}
-
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
+	versions, err := buildMarbleHistory(stub, marbleName, resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	versions = filterMarbleHistory(versions, from, to, field)
 
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	historyAsBytes, err := json.Marshal(versions)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- getHistoryForMarble returning:\n%s\n", buffer.String())
+	fmt.Printf("- getHistoryForMarble returning:\n%s\n", string(historyAsBytes))
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(historyAsBytes)
 }
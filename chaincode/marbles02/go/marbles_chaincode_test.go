@@ -0,0 +1,74 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func readTestPage(t *testing.T, payload []byte) queryResponse {
+	t.Helper()
+	page := queryResponse{}
+	err := json.Unmarshal(payload, &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func pageKeys(page queryResponse) []string {
+	keys := []string{}
+	for _, result := range page.Results {
+		keys = append(keys, result.Key)
+	}
+	return keys
+}
+
+func TestListQueriesReturnPaginatedEnvelope(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom")
+	for i, color := range []string{"blue", "red", "blue", "blue", "red"} {
+		expectSuccess(t, s.invoke(o["tom"], "initMarble", fmt.Sprintf("marble%d", i+1), color, "10", "tom"))
+	}
+
+	all := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByRange", "marble1", "marble9")))
+	if all.FetchedRecordsCount != 5 || all.Bookmark != "" || len(all.Results) != 5 {
+		t.Fatalf("unexpected range envelope %+v", all)
+	}
+
+	first := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByRangeWithPagination", "marble1", "marble9", "3", "")))
+	if first.FetchedRecordsCount != 3 || first.Bookmark != "marble4" {
+		t.Fatalf("expected the bookmark of the next page, got %+v", first)
+	}
+	second := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByRangeWithPagination", "marble1", "marble9", "3", first.Bookmark)))
+	if keys := pageKeys(second); len(keys) != 2 || keys[0] != "marble4" || second.Bookmark != "" {
+		t.Fatalf("unexpected second range page %+v", second)
+	}
+
+	blue := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByColorWithPagination", "Blue", "2", "")))
+	if keys := pageKeys(blue); len(keys) != 2 || keys[0] != "marble1" || keys[1] != "marble3" || blue.Bookmark == "" {
+		t.Fatalf("unexpected first color page %+v", blue)
+	}
+	blue = readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByColorWithPagination", "blue", "2", blue.Bookmark)))
+	if keys := pageKeys(blue); len(keys) != 1 || keys[0] != "marble4" || blue.Bookmark != "" {
+		t.Fatalf("unexpected last color page %+v", blue)
+	}
+	var record marble
+	if err := json.Unmarshal(blue.Results[0].Record, &record); err != nil || record.Color != "blue" {
+		t.Fatalf("expected the marble record in the color page, got %s", blue.Results[0].Record)
+	}
+
+	// ==== A stale index entry is skipped and not counted ====
+	delete(s.State, "marble3")
+	blue = readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByColorWithPagination", "blue", "2", "")))
+	if keys := pageKeys(blue); len(keys) != 1 || keys[0] != "marble1" || blue.FetchedRecordsCount != 1 || blue.Bookmark == "" {
+		t.Fatalf("expected the stale marble3 entry to be left out of the page and its count, got %+v", blue)
+	}
+
+	expectError(t, s.invoke(o["tom"], "getMarblesByColorWithPagination", "blue", "2"), "Expecting 3")
+	expectError(t, s.invoke(o["tom"], "getMarblesByRangeWithPagination", "marble1", "marble9", "three", ""), "invalid syntax")
+}
@@ -0,0 +1,79 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ==== Events =================================================================================
+// Every transaction that creates, moves or deletes marbles sets one chaincode event named after
+// its type, with a JSON payload listing the marbles affected. Fabric keeps a single event per
+// transaction, so functions touching several marbles emit one event that summarises all of them.
+// The payload carries a version, to be raised whenever a field changes meaning or is removed.
+// =============================================================================================
+
+// marbleEventVersion is the version of the event payload layout
+const marbleEventVersion = 1
+
+const (
+	eventMarbleCreated     = "MarbleCreated"
+	eventMarbleTransferred = "MarbleTransferred"
+	eventMarbleDeleted     = "MarbleDeleted"
+	eventBulkColorTransfer = "BulkColorTransfer"
+)
+
+type marbleEventEntry struct {
+	Name          string `json:"name"`
+	Color         string `json:"color"`
+	Size          int    `json:"size"`
+	PreviousOwner string `json:"previousOwner,omitempty"` //empty for created marbles
+	Owner         string `json:"owner,omitempty"`         //empty for deleted marbles
+}
+
+type marbleEvent struct {
+	Version int                `json:"version"`
+	Type    string             `json:"type"`
+	TxID    string             `json:"txId"`
+	Color   string             `json:"color,omitempty"` //set for BulkColorTransfer
+	Marbles []marbleEventEntry `json:"marbles"`
+}
+
+// newMarbleEventEntry describes a marble before and after a change; either may be nil
+func newMarbleEventEntry(before *marble, after *marble) marbleEventEntry {
+	entry := marbleEventEntry{}
+	for _, m := range []*marble{before, after} {
+		if m != nil {
+			entry.Name = m.Name
+			entry.Color = m.Color
+			entry.Size = m.Size
+		}
+	}
+	if before != nil {
+		entry.PreviousOwner = before.Owner
+	}
+	if after != nil {
+		entry.Owner = after.Owner
+	}
+	return entry
+}
+
+// setMarbleEvent sets the event of the current transaction
+func setMarbleEvent(stub shim.ChaincodeStubInterface, event *marbleEvent) error {
+	event.Version = marbleEventVersion
+	event.TxID = stub.GetTxID()
+	if isPrivateStorage(stub) {
+		// events are readable by the whole channel, so they must not reveal private marbles
+		event.Color = ""
+		event.Marbles = []marbleEventEntry{}
+	}
+	eventAsBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(event.Type, eventAsBytes)
+}
@@ -0,0 +1,79 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func readTestEvent(t *testing.T, s *testStub, eventType string) *marbleEvent {
+	t.Helper()
+	if s.event == nil || s.event.EventName != eventType {
+		t.Fatalf("expected a %s event, got %v", eventType, s.event)
+	}
+	event := &marbleEvent{}
+	err := json.Unmarshal(s.event.Payload, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Version != marbleEventVersion || event.Type != eventType || event.TxID != fmt.Sprintf("tx%d", s.txCount) {
+		t.Fatalf("unexpected event header %+v", event)
+	}
+	return event
+}
+
+func TestMarbleLifecycleEvents(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	if event := readTestEvent(t, s, eventMarbleCreated); len(event.Marbles) != 1 || event.Marbles[0].Owner != "tom" || event.Marbles[0].PreviousOwner != "" {
+		t.Fatalf("unexpected creation event %+v", event)
+	}
+
+	expectSuccess(t, s.invoke(o["tom"], "transferMarble", "marble1", "jerry"))
+	if event := readTestEvent(t, s, eventMarbleTransferred); event.Marbles[0].PreviousOwner != "tom" || event.Marbles[0].Owner != "jerry" {
+		t.Fatalf("unexpected transfer event %+v", event)
+	}
+
+	expectSuccess(t, s.invoke(o["jerry"], "delete", "marble1"))
+	if event := readTestEvent(t, s, eventMarbleDeleted); event.Marbles[0].PreviousOwner != "jerry" || event.Marbles[0].Owner != "" || event.Marbles[0].Size != 35 {
+		t.Fatalf("unexpected delete event %+v", event)
+	}
+
+	expectError(t, s.invoke(o["tom"], "initMarble", "marble2", "blue", "-1", "tom"), "positive")
+	if s.event != nil {
+		t.Fatal("a failed transaction must not set an event")
+	}
+}
+
+func TestBulkColorTransferSetsOneEvent(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble2", "red", "50", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble3", "blue", "20", "tom"))
+
+	expectSuccess(t, s.invoke(o["tom"], "transferMarblesBasedOnColor", "blue", "jerry"))
+	event := readTestEvent(t, s, eventBulkColorTransfer)
+	if event.Color != "blue" || len(event.Marbles) != 2 || event.Marbles[0].Name != "marble1" || event.Marbles[1].Name != "marble3" {
+		t.Fatalf("unexpected bulk transfer event %+v", event)
+	}
+	for _, entry := range event.Marbles {
+		if entry.PreviousOwner != "tom" || entry.Owner != "jerry" {
+			t.Fatalf("unexpected bulk transfer entry %+v", entry)
+		}
+	}
+}
+
+func TestPrivateStorageEventsOmitMarbles(t *testing.T) {
+	s := newTestStub(t, "private", "collectionMarbles")
+	o := owners(t, s, "tom")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	if event := readTestEvent(t, s, eventMarbleCreated); len(event.Marbles) != 0 {
+		t.Fatalf("private events must not list marbles, got %+v", event)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ==== History ================================================================================
+// The history database only keeps the value, txId and timestamp of each write, not who made
+// it. Every marble write therefore carries its submitter in the modifiedBy field, and a delete,
+// which leaves no value behind, writes its submitter to marbleDeletion~name instead, whose own
+// history getHistoryForMarble looks the deleting transaction up in.
+// =============================================================================================
+
+// modifiedByField is the marble field carrying the submitter, left out of values and diffs
+const modifiedByField = "modifiedBy"
+
+type submitter struct {
+	ID    string `json:"id"`
+	MSPID string `json:"mspId"`
+}
+
+type fieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type marbleVersion struct {
+	TxID      string                 `json:"txId"`
+	Timestamp time.Time              `json:"timestamp"`
+	IsDelete  bool                   `json:"isDelete"`
+	Value     map[string]interface{} `json:"value"`
+	Changes   []fieldChange          `json:"changes"`
+	Submitter *submitter             `json:"submitter"`
+}
+
+// getSubmitter returns the identity submitting the current transaction
+func getSubmitter(stub shim.ChaincodeStubInterface) (*submitter, error) {
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get client id: %s", err.Error())
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get client MSP id: %s", err.Error())
+	}
+	return &submitter{ID: id, MSPID: mspID}, nil
+}
+
+// recordMarbleDeletion stores the identity deleting a marble, overwriting the previous deletion
+func recordMarbleDeletion(stub shim.ChaincodeStubInterface, marbleName string) error {
+	deleter, err := getSubmitter(stub)
+	if err != nil {
+		return err
+	}
+	deleterAsBytes, err := json.Marshal(deleter)
+	if err != nil {
+		return err
+	}
+	deletionKey, err := stub.CreateCompositeKey("marbleDeletion", []string{marbleName})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(deletionKey, deleterAsBytes)
+}
+
+// getMarbleDeleters maps the txId of every recorded deletion of a marble to its submitter
+func getMarbleDeleters(stub shim.ChaincodeStubInterface, marbleName string) (map[string]*submitter, error) {
+	deletionKey, err := stub.CreateCompositeKey("marbleDeletion", []string{marbleName})
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := stub.GetHistoryForKey(deletionKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	deleters := map[string]*submitter{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		deleter := &submitter{}
+		err = json.Unmarshal(response.Value, deleter)
+		if err != nil {
+			return nil, err
+		}
+		deleters[response.TxId] = deleter
+	}
+	return deleters, nil
+}
+
+// buildMarbleHistory reads all versions of a marble in the order the history database returns
+// them, which is commit order, oldest first, and diffs each version against the one before it.
+// Versions written before submitters were recorded have a nil submitter.
+func buildMarbleHistory(stub shim.ChaincodeStubInterface, marbleName string, resultsIterator shim.HistoryQueryIteratorInterface) ([]marbleVersion, error) {
+	versions := []marbleVersion{}
+	var deleters map[string]*submitter
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		version := marbleVersion{
+			TxID:      response.TxId,
+			Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC(),
+			IsDelete:  response.IsDelete,
+		}
+		if response.IsDelete {
+			if deleters == nil {
+				deleters, err = getMarbleDeleters(stub, marbleName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			version.Submitter = deleters[response.TxId]
+		} else {
+			err = json.Unmarshal(response.Value, &version.Value)
+			if err != nil {
+				return nil, err
+			}
+			recorded := marble{}
+			err = json.Unmarshal(response.Value, &recorded)
+			if err != nil {
+				return nil, err
+			}
+			version.Submitter = recorded.ModifiedBy
+			delete(version.Value, modifiedByField)
+		}
+		versions = append(versions, version)
+	}
+
+	var previous map[string]interface{}
+	for i := range versions {
+		versions[i].Changes = diffMarbleValues(previous, versions[i].Value)
+		previous = versions[i].Value
+	}
+	return versions, nil
+}
+
+// diffMarbleValues lists the fields that differ between two marble versions, in field order.
+// A nil version stands for the marble not existing.
+func diffMarbleValues(before map[string]interface{}, after map[string]interface{}) []fieldChange {
+	fields := map[string]bool{}
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	changes := []fieldChange{}
+	for _, field := range names {
+		if !reflect.DeepEqual(before[field], after[field]) {
+			changes = append(changes, fieldChange{Field: field, From: before[field], To: after[field]})
+		}
+	}
+	return changes
+}
+
+// filterMarbleHistory keeps the versions inside [from, to] that changed field. Zero times
+// and an empty field do not filter. Diffs are computed before filtering, so they always
+// describe the change from the immediately preceding version.
+func filterMarbleHistory(versions []marbleVersion, from time.Time, to time.Time, field string) []marbleVersion {
+	filtered := []marbleVersion{}
+	for _, version := range versions {
+		if !from.IsZero() && version.Timestamp.Before(from) {
+			continue
+		}
+		if !to.IsZero() && version.Timestamp.After(to) {
+			continue
+		}
+		if field != "" {
+			changes := []fieldChange{}
+			for _, change := range version.Changes {
+				if change.Field == field {
+					changes = append(changes, change)
+				}
+			}
+			if len(changes) == 0 {
+				continue
+			}
+			version.Changes = changes
+		}
+		filtered = append(filtered, version)
+	}
+	return filtered
+}
+
+// parseOptionalTime parses an RFC3339 argument, returning the zero time when it is empty
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,95 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTestHistory(t *testing.T, payload []byte) []marbleVersion {
+	t.Helper()
+	var versions []marbleVersion
+	err := json.Unmarshal(payload, &versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func TestMarbleHistoryKeepsCommitOrderAndSubmitters(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry", "spike")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "setOperator", "spike", "true"))
+
+	// ==== Both transfers share a block timestamp; only commit order tells them apart ====
+	s.advance(time.Hour)
+	expectSuccess(t, s.invoke(o["spike"], "transferMarble", "marble1", "jerry"))
+	expectSuccess(t, s.invoke(o["jerry"], "transferMarble", "marble1", "tom"))
+	s.advance(time.Hour)
+	expectSuccess(t, s.invoke(o["tom"], "delete", "marble1"))
+
+	versions := readTestHistory(t, expectSuccess(t, s.invoke(o["tom"], "getHistoryForMarble", "marble1")))
+	if len(versions) != 4 {
+		t.Fatalf("expected 4 versions, got %d", len(versions))
+	}
+	submitters := []string{}
+	for _, version := range versions {
+		id, err := base64.StdEncoding.DecodeString(version.Submitter.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitters = append(submitters, string(id))
+		if _, ok := version.Value[modifiedByField]; ok {
+			t.Fatal("submitter must not be reported as part of the value")
+		}
+	}
+	for i, name := range []string{"tom", "spike", "jerry", "tom"} {
+		if !strings.Contains(submitters[i], "CN="+name) {
+			t.Fatalf("expected version %d to be submitted by %s, got %v", i, name, submitters)
+		}
+	}
+	if changes := versions[1].Changes; len(changes) != 3 || changes[0].Field != "owner" || changes[0].From != "tom" || changes[0].To != "jerry" {
+		t.Fatalf("unexpected changes of the first transfer %+v", changes)
+	}
+	if changes := versions[2].Changes; changes[0].From != "jerry" || changes[0].To != "tom" {
+		t.Fatalf("unexpected changes of the second transfer %+v", changes)
+	}
+	if !versions[3].IsDelete || versions[3].Value != nil || len(versions[3].Changes) != 7 {
+		t.Fatalf("unexpected delete version %+v", versions[3])
+	}
+
+	for key := range s.State {
+		if strings.HasPrefix(key, "\x00marbleTx\x00") {
+			t.Fatal("no per transaction submitter rows may be written")
+		}
+	}
+}
+
+func TestMarbleHistoryFilters(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	start := s.now
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	s.advance(time.Hour)
+	expectSuccess(t, s.invoke(o["tom"], "transferMarble", "marble1", "jerry"))
+	s.advance(time.Hour)
+	expectSuccess(t, s.invoke(o["jerry"], "transferMarble", "marble1", "tom"))
+
+	from := start.Add(30 * time.Minute).Format(time.RFC3339)
+	to := start.Add(90 * time.Minute).Format(time.RFC3339)
+	if versions := readTestHistory(t, expectSuccess(t, s.invoke(o["tom"], "getHistoryForMarble", "marble1", from, to))); len(versions) != 1 || versions[0].Value["owner"] != "jerry" {
+		t.Fatalf("expected only the first transfer in the time range, got %+v", versions)
+	}
+	versions := readTestHistory(t, expectSuccess(t, s.invoke(o["tom"], "getHistoryForMarble", "marble1", "", "", "color")))
+	if len(versions) != 1 || len(versions[0].Changes) != 1 || versions[0].Changes[0].To != "blue" {
+		t.Fatalf("expected only the creation to change color, got %+v", versions)
+	}
+	expectError(t, s.invoke(o["tom"], "getHistoryForMarble", "marble1", "yesterday"), "RFC3339")
+}
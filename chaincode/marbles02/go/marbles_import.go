@@ -0,0 +1,163 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type marbleImport struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+	Size  int    `json:"size"`
+	Owner string `json:"owner"`
+}
+
+type marbleImportResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ============================================================
+// importMarbles - create many marbles in one proposal. Every item is validated on its
+// own; valid items are written and indexed, invalid ones are reported and skipped. In
+// dry-run mode nothing is written. As with initMarble the caller owns every item: an owner
+// given must be the caller's alias, or a free alias the first item then claims for the caller.
+// ============================================================
+func (t *SimpleChaincode) importMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0                                                      1
+	// "[{\"name\":\"marble4\",\"color\":\"green\",\"size\":20}]", "true"
+	// An empty 1st argument reads the array from the "marbles" transient field instead
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 1")
+	}
+
+	dryRun := false
+	if len(args) > 1 {
+		var err error
+		dryRun, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return shim.Error("2nd argument must be true or false")
+		}
+	}
+
+	importJSON := []byte(args[0])
+	if len(args[0]) == 0 {
+		transMap, err := stub.GetTransient()
+		if err != nil {
+			return shim.Error("Error getting transient: " + err.Error())
+		}
+		if _, ok := transMap["marbles"]; !ok {
+			return shim.Error("marbles must be a key in the transient map when the 1st argument is empty")
+		}
+		importJSON = transMap["marbles"]
+	}
+
+	var items []marbleImport
+	err := json.Unmarshal(importJSON, &items)
+	if err != nil {
+		return shim.Error("Failed to decode marbles JSON array: " + err.Error())
+	}
+
+	fmt.Printf("- start importMarbles count:%d dryRun:%t\n", len(items), dryRun)
+
+	// ==== Like initMarble, the caller owns every marble it imports ====
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	results := make([]marbleImportResult, 0, len(items))
+	created := []marbleEventEntry{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		result := marbleImportResult{Name: item.Name, Status: "ok"}
+
+		newMarble, err := validateMarbleImport(stub, item, caller, seen)
+		if err == nil && !dryRun {
+			if caller.Alias == "" {
+				_, err = claimOwnerAlias(stub, newMarble.Owner)
+			}
+			if err == nil {
+				err = createMarble(stub, newMarble)
+			}
+		}
+		if err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+		} else {
+			seen[item.Name] = true
+			caller.Alias = newMarble.Owner
+			if !dryRun {
+				created = append(created, newMarbleEventEntry(nil, newMarble))
+			}
+		}
+		results = append(results, result)
+	}
+
+	if len(created) > 0 {
+		err = setMarbleEvent(stub, &marbleEvent{Type: eventMarbleCreated, Marbles: created})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultsAsBytes)
+}
+
+// validateMarbleImport applies the initMarble checks to one import item and builds the
+// marble to create for caller. seen holds the names already accepted earlier in the batch.
+func validateMarbleImport(stub shim.ChaincodeStubInterface, item marbleImport, caller *owner, seen map[string]bool) (*marble, error) {
+	if len(item.Name) <= 0 {
+		return nil, fmt.Errorf("name must be a non-empty string")
+	}
+	if len(item.Color) <= 0 {
+		return nil, fmt.Errorf("color must be a non-empty string")
+	}
+	if item.Size <= 0 {
+		return nil, fmt.Errorf("size must be a positive number")
+	}
+	if seen[item.Name] {
+		return nil, fmt.Errorf("Duplicate marble in import: %s", item.Name)
+	}
+
+	marbleAsBytes, err := stub.GetState(item.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get marble: %s", err.Error())
+	} else if marbleAsBytes != nil {
+		return nil, fmt.Errorf("This marble already exists: %s", item.Name)
+	}
+
+	alias := strings.ToLower(item.Owner)
+	if len(alias) == 0 {
+		if caller.Alias == "" {
+			return nil, fmt.Errorf("Caller has not registered an owner alias")
+		}
+		alias = caller.Alias
+	} else if caller.Alias != "" && alias != caller.Alias {
+		return nil, fmt.Errorf("Caller is registered as %s and can only import its own marbles", caller.Alias)
+	} else if caller.Alias == "" {
+		registered, err := getOwnerByAlias(stub, alias)
+		if err != nil {
+			return nil, err
+		} else if registered != nil {
+			return nil, fmt.Errorf("Alias %s belongs to another identity", alias)
+		}
+	}
+
+	return &marble{"marble", item.Name, strings.ToLower(item.Color), item.Size, alias, caller.ID, caller.MSPID, nil}, nil
+}
@@ -0,0 +1,85 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func importResults(t *testing.T, payload []byte) map[string]string {
+	t.Helper()
+	var results []marbleImportResult
+	err := json.Unmarshal(payload, &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errors := map[string]string{}
+	for _, result := range results {
+		errors[result.Name] = result.Error
+	}
+	return errors
+}
+
+func TestImportMarblesValidatesEachItem(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+
+	batch := `[
+		{"name":"marble2","color":"Red","size":50},
+		{"name":"marble3","color":"green","size":20,"owner":"Tom"},
+		{"name":"marble1","color":"blue","size":35},
+		{"name":"marble2","color":"red","size":50},
+		{"name":"marble4","color":"red","size":0},
+		{"name":"marble5","color":"","size":10},
+		{"name":"marble6","color":"red","size":10,"owner":"jerry"}
+	]`
+	errors := importResults(t, expectSuccess(t, s.invoke(o["tom"], "importMarbles", batch, "true")))
+	for name, want := range map[string]string{"marble2": "Duplicate", "marble3": "", "marble1": "already exists", "marble4": "positive", "marble5": "color", "marble6": "only import its own"} {
+		if want == "" && errors[name] != "" || want != "" && !strings.Contains(errors[name], want) {
+			t.Errorf("%s: expected error %q, got %q", name, want, errors[name])
+		}
+	}
+	if _, written := s.State["marble3"]; written {
+		t.Fatal("dry run must not write marbles")
+	}
+
+	importResults(t, expectSuccess(t, s.invoke(o["tom"], "importMarbles", batch)))
+	if m := readTestMarble(t, s, "marble2"); m.Owner != "tom" || m.Color != "red" || m.OwnerMSP != "Org1MSP" {
+		t.Fatalf("unexpected imported marble %+v", m)
+	}
+	if s.event == nil || s.event.EventName != eventMarbleCreated {
+		t.Fatal("expected a creation event for the import")
+	}
+	if _, written := s.State["marble6"]; written {
+		t.Fatal("marble for another owner was imported")
+	}
+}
+
+func TestImportMarblesClaimsAliasForNewCaller(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom")
+	spike := newCreator(t, "Org2MSP", "spike", nil)
+
+	errors := importResults(t, expectSuccess(t, s.invoke(spike, "importMarbles", `[
+		{"name":"marble1","color":"red","size":10},
+		{"name":"marble2","color":"red","size":10,"owner":"tom"},
+		{"name":"marble3","color":"red","size":10,"owner":"spike"},
+		{"name":"marble4","color":"red","size":10,"owner":"tyke"},
+		{"name":"marble5","color":"red","size":10}
+	]`)))
+	for name, want := range map[string]string{"marble1": "not registered an owner alias", "marble2": "belongs to another identity", "marble3": "", "marble4": "registered as spike", "marble5": ""} {
+		if want == "" && errors[name] != "" || want != "" && !strings.Contains(errors[name], want) {
+			t.Errorf("%s: expected error %q, got %q", name, want, errors[name])
+		}
+	}
+	if m := readTestMarble(t, s, "marble5"); m.Owner != "spike" {
+		t.Fatalf("expected marble5 to go to the alias claimed in the batch, owner is %s", m.Owner)
+	}
+	expectError(t, s.invoke(spike, "registerOwner", "tyke"), "already registered as spike")
+	expectError(t, s.invoke(o["tom"], "transferMarble", "marble3", "tom"), "not the owner")
+}
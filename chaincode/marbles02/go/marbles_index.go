@@ -0,0 +1,55 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	index "Index"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ==== Secondary indexes ======================================================================
+// Composite key indexes are kept by the vendored Index package, shared with the healthcare
+// chaincode. Marbles are written and deleted through marbleIndexes, which moves their index
+// entries along; Init backfills indexes added by an upgrade and rebuildIndexes regenerates them.
+// =============================================================================================
+
+// marbleIndexes are the composite key indexes kept for marbles
+var marbleIndexes = &index.Manager{
+	DocTypeField: "docType",
+	Indexes: map[string][]index.Definition{
+		"marble": {
+			{Name: "color~name", Fields: []string{"color", "name"}},
+			{Name: "owner~name", Fields: []string{"owner", "name"}},
+		},
+	},
+}
+
+// ============================================================
+// rebuildIndexes - admin only, drop and regenerate every composite key index from the records
+// ============================================================
+func (t *SimpleChaincode) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	err := authorizeAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	counts, err := marbleIndexes.Rebuild(stub)
+	if err != nil {
+		return shim.Error("Failed to rebuild indexes: " + err.Error())
+	}
+
+	countsAsBytes, err := json.Marshal(counts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(countsAsBytes)
+}
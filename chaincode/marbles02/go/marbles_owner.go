@@ -0,0 +1,312 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ==== Owners =================================================================================
+// A marble is owned by a client identity, the cid.GetID / cid.GetMSPID pair of whoever created
+// or received it. Owners are addressed by a display alias, which is bound one to one to an
+// identity under ownerAlias~alias and ownerIdentity~mspId~id. Only the owner, or an operator the
+// owner approved under operator~ownerMSP~ownerID~operatorMSP~operatorID, may move or delete it.
+// Marbles written before owner identities carry only the free-form owner string; nobody can move
+// them until an admin binds them to the identity registered under that alias with migrateMarbleOwner.
+// =============================================================================================
+
+type owner struct {
+	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Alias      string `json:"alias"`
+	ID         string `json:"id"`
+	MSPID      string `json:"mspId"`
+}
+
+// ============================================================
+// registerOwner - bind a display alias to the calling identity
+// ============================================================
+func (t *SimpleChaincode) registerOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "tom"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	registered, err := claimOwnerAlias(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ownerAsBytes, err := json.Marshal(registered)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ownerAsBytes)
+}
+
+// ============================================================
+// setOperator - approve or revoke another owner to move all of the caller's marbles
+// ============================================================
+func (t *SimpleChaincode) setOperator(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "jerry", "true"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	approved, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be true or false")
+	}
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	operator, err := getOwnerByAlias(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if operator == nil {
+		return shim.Error("Owner is not registered: " + args[0])
+	}
+
+	operatorKey, err := stub.CreateCompositeKey("operator", []string{caller.MSPID, caller.ID, operator.MSPID, operator.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if approved {
+		err = stub.PutState(operatorKey, []byte{0x00})
+	} else {
+		err = stub.DelState(operatorKey)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================
+// migrateMarbleOwner - admin only, bind a legacy marble to the identity registered under its owner alias
+// ============================================================
+func (t *SimpleChaincode) migrateMarbleOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err := authorizeAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marbleAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error("Failed to get marble: " + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist: " + args[0])
+	}
+	legacyMarble := &marble{}
+	err = json.Unmarshal(marbleAsBytes, legacyMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if legacyMarble.OwnerID != "" || legacyMarble.OwnerMSP != "" {
+		return shim.Error("Marble is already bound to an owner identity: " + args[0])
+	}
+
+	registered, err := getOwnerByAlias(stub, legacyMarble.Owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if registered == nil {
+		return shim.Error("Owner is not registered: " + legacyMarble.Owner)
+	}
+
+	err = setMarbleOwner(stub, legacyMarble, registered)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// getCaller returns the identity of the submitting client, with its alias if registered
+func getCaller(stub shim.ChaincodeStubInterface) (*owner, error) {
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get client id: %s", err.Error())
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get client MSP id: %s", err.Error())
+	}
+
+	identityKey, err := stub.CreateCompositeKey("ownerIdentity", []string{mspID, id})
+	if err != nil {
+		return nil, err
+	}
+	alias, err := stub.GetState(identityKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get owner: %s", err.Error())
+	}
+
+	return &owner{ObjectType: "owner", Alias: string(alias), ID: id, MSPID: mspID}, nil
+}
+
+// getCallerAlias returns the alias registered to the submitting client
+func getCallerAlias(stub shim.ChaincodeStubInterface) (string, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return "", err
+	} else if caller.Alias == "" {
+		return "", fmt.Errorf("Caller has not registered an owner alias")
+	}
+	return caller.Alias, nil
+}
+
+// getOwnerByAlias resolves an alias to its owner, nil if the alias is unregistered
+func getOwnerByAlias(stub shim.ChaincodeStubInterface, alias string) (*owner, error) {
+	aliasKey, err := stub.CreateCompositeKey("ownerAlias", []string{alias})
+	if err != nil {
+		return nil, err
+	}
+	ownerAsBytes, err := stub.GetState(aliasKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get owner: %s", err.Error())
+	} else if ownerAsBytes == nil {
+		return nil, nil
+	}
+
+	registered := &owner{}
+	err = json.Unmarshal(ownerAsBytes, registered)
+	if err != nil {
+		return nil, err
+	}
+	return registered, nil
+}
+
+// claimOwnerAlias binds alias to the caller unless either is already bound elsewhere
+func claimOwnerAlias(stub shim.ChaincodeStubInterface, alias string) (*owner, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller.Alias == alias {
+		return caller, nil
+	} else if caller.Alias != "" {
+		return nil, fmt.Errorf("Caller is already registered as %s", caller.Alias)
+	}
+
+	registered, err := getOwnerByAlias(stub, alias)
+	if err != nil {
+		return nil, err
+	} else if registered != nil {
+		return nil, fmt.Errorf("Alias %s belongs to another identity", alias)
+	}
+
+	caller.Alias = alias
+	ownerAsBytes, err := json.Marshal(caller)
+	if err != nil {
+		return nil, err
+	}
+	aliasKey, err := stub.CreateCompositeKey("ownerAlias", []string{alias})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(aliasKey, ownerAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	identityKey, err := stub.CreateCompositeKey("ownerIdentity", []string{caller.MSPID, caller.ID})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(identityKey, []byte(alias))
+	if err != nil {
+		return nil, err
+	}
+	return caller, nil
+}
+
+// authorizeMarbleOwner fails unless the caller owns the marble or is an approved operator
+func authorizeMarbleOwner(stub shim.ChaincodeStubInterface, m *marble) error {
+	if m.OwnerID == "" && m.OwnerMSP == "" {
+		return fmt.Errorf("Marble %s predates owner identities, an admin must migrate it to %s first", m.Name, m.Owner)
+	}
+
+	allowed, err := callerMovesMarble(stub, m)
+	if err != nil {
+		return err
+	} else if !allowed {
+		return fmt.Errorf("Caller is not the owner of %s or an approved operator", m.Name)
+	}
+	return nil
+}
+
+// callerMovesMarble reports whether the caller owns the marble or is an approved operator.
+// Marbles that predate owner identities are moved by nobody.
+func callerMovesMarble(stub shim.ChaincodeStubInterface, m *marble) (bool, error) {
+	if m.OwnerID == "" && m.OwnerMSP == "" {
+		return false, nil
+	}
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return false, err
+	}
+	if caller.ID == m.OwnerID && caller.MSPID == m.OwnerMSP {
+		return true, nil
+	}
+
+	operatorKey, err := stub.CreateCompositeKey("operator", []string{m.OwnerMSP, m.OwnerID, caller.MSPID, caller.ID})
+	if err != nil {
+		return false, err
+	}
+	approval, err := stub.GetState(operatorKey)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get operator approval: %s", err.Error())
+	}
+	return approval != nil, nil
+}
+
+// authorizeAdmin fails unless the caller's certificate carries the admin identity type
+func authorizeAdmin(stub shim.ChaincodeStubInterface) error {
+	err := cid.AssertAttributeValue(stub, "hf.Type", "admin")
+	if err != nil {
+		return fmt.Errorf("Caller is not an admin: %s", err.Error())
+	}
+	return nil
+}
+
+// setMarbleOwner hands a marble to a new owner and rewrites it, moving its owner~name entry.
+// Callers are expected to have authorized the move already.
+func setMarbleOwner(stub shim.ChaincodeStubInterface, m *marble, newOwner *owner) error {
+	m.Owner = newOwner.Alias
+	m.OwnerID = newOwner.ID
+	m.OwnerMSP = newOwner.MSPID
+
+	var err error
+	m.ModifiedBy, err = getSubmitter(stub)
+	if err != nil {
+		return err
+	}
+	marbleJSONasBytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return marbleIndexes.Put(stub, m.Name, marbleJSONasBytes)
+}
@@ -0,0 +1,85 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOnlyOwnerOrOperatorMovesMarble(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry", "spike")
+	expectError(t, s.invoke(o["tom"], "registerOwner", "jerry"), "already registered as tom")
+	expectError(t, s.invoke(newCreator(t, "Org1MSP", "impostor", nil), "registerOwner", "tom"), "belongs to another identity")
+
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble2", "blue", "50", "tom"))
+	expectError(t, s.invoke(o["jerry"], "transferMarble", "marble1", "jerry"), "not the owner")
+	expectError(t, s.invoke(o["jerry"], "delete", "marble1"), "not the owner")
+	expectError(t, s.invoke(o["tom"], "transferMarble", "marble1", "nobody"), "not registered")
+
+	// ==== An approved operator moves every marble of the owner until revoked ====
+	expectSuccess(t, s.invoke(o["tom"], "setOperator", "jerry", "true"))
+	expectSuccess(t, s.invoke(o["jerry"], "transferMarble", "marble1", "spike"))
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "spike" {
+		t.Fatalf("expected marble1 to move to spike, owner is %s", m.Owner)
+	}
+	expectError(t, s.invoke(o["jerry"], "transferMarble", "marble1", "jerry"), "not the owner")
+	expectSuccess(t, s.invoke(o["tom"], "setOperator", "jerry", "false"))
+	expectError(t, s.invoke(o["jerry"], "transferMarble", "marble2", "jerry"), "not the owner")
+}
+
+func TestMigrateLegacyMarbleOwner(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	admin := newCreator(t, "Org1MSP", "admin", map[string]string{"hf.Type": "admin"})
+
+	// ==== Written by a chaincode version without owner identities ====
+	s.State["marble1"], _ = json.Marshal(&marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "tom"})
+	s.State["marble2"], _ = json.Marshal(&marble{ObjectType: "marble", Name: "marble2", Color: "red", Size: 50, Owner: "tyke"})
+
+	expectError(t, s.invoke(o["tom"], "transferMarble", "marble1", "jerry"), "admin must migrate it to tom")
+	expectError(t, s.invoke(o["tom"], "migrateMarbleOwner", "marble1"), "not an admin")
+	expectError(t, s.invoke(admin, "migrateMarbleOwner", "marble2"), "not registered: tyke")
+	expectError(t, s.invoke(admin, "migrateMarbleOwner", "marble3"), "does not exist")
+	expectSuccess(t, s.invoke(admin, "migrateMarbleOwner", "marble1"))
+	expectError(t, s.invoke(admin, "migrateMarbleOwner", "marble1"), "already bound")
+
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "tom" || m.OwnerID == "" || m.OwnerMSP != "Org1MSP" {
+		t.Fatalf("expected marble1 to be bound to tom's identity, got %+v", m)
+	}
+	expectError(t, s.invoke(o["jerry"], "transferMarble", "marble1", "jerry"), "not the owner")
+	expectSuccess(t, s.invoke(o["tom"], "transferMarble", "marble1", "jerry"))
+}
+
+func TestBulkColorTransferMovesOnlyTheCallersMarbles(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry", "spike")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["jerry"], "initMarble", "marble2", "blue", "50", "jerry"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble3", "blue", "20", "tom"))
+	s.State["marble4"], _ = json.Marshal(&marble{ObjectType: "marble", Name: "marble4", Color: "blue", Size: 10, Owner: "tom"})
+	colorKey, _ := s.CreateCompositeKey("color~name", []string{"blue", "marble4"})
+	s.State[colorKey] = []byte{0x00}
+
+	// ==== Another owner's marble and a legacy marble do not stop tom's transfer ====
+	if got := string(expectSuccess(t, s.invoke(o["tom"], "transferMarblesBasedOnColor", "blue", "spike"))); got != "Transferred 2 blue marbles to spike" {
+		t.Fatalf("unexpected response %s", got)
+	}
+	for name, alias := range map[string]string{"marble1": "spike", "marble2": "jerry", "marble3": "spike", "marble4": "tom"} {
+		if m := readTestMarble(t, s, name); m.Owner != alias {
+			t.Fatalf("expected %s to be owned by %s, got %s", name, alias, m.Owner)
+		}
+	}
+
+	// ==== The caller's own marbles still move all or nothing ====
+	expectSuccess(t, s.invoke(o["spike"], "proposeSwap", "marble3", "marble2", s.now.Add(time.Hour).Format(time.RFC3339)))
+	expectError(t, s.invoke(o["spike"], "transferMarblesBasedOnColor", "blue", "tom"), "locked by swap")
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "spike" {
+		t.Fatalf("expected the failed transfer to leave marble1 with spike, got %s", m.Owner)
+	}
+}
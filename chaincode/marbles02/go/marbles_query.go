@@ -0,0 +1,283 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ==== Rich query validation ==================================================================
+// Ad hoc CouchDB queries from clients are parsed and checked before they reach the state
+// database. The selector is pinned to docType "marble", may only reference the fields and
+// operators allowed below (no $regex or $where scans), the limit is capped, and a sort is only
+// accepted when it is served by one of the indexes packaged under META-INF/statedb/couchdb/indexes.
+// =============================================================================================
+
+// richQueryFields are the marble fields a client query may select, sort or return
+var richQueryFields = map[string]bool{
+	"docType": true,
+	"name":    true,
+	"color":   true,
+	"size":    true,
+	"owner":   true,
+}
+
+// richQueryOperators are the CouchDB selector operators a client query may use
+var richQueryOperators = map[string]bool{
+	"$eq":     true,
+	"$ne":     true,
+	"$gt":     true,
+	"$gte":    true,
+	"$lt":     true,
+	"$lte":    true,
+	"$in":     true,
+	"$nin":    true,
+	"$exists": true,
+	"$and":    true,
+	"$or":     true,
+	"$not":    true,
+}
+
+// maxRichQueryLimit caps the number of records a client query may return, or ask for per page
+const maxRichQueryLimit = 100
+
+type indexField struct {
+	Field string
+	Desc  bool
+}
+
+type packagedIndex struct {
+	DDoc   string
+	Name   string
+	Fields []indexField
+}
+
+// packagedIndexes mirrors META-INF/statedb/couchdb/indexes; keep the two in step
+var packagedIndexes = []packagedIndex{
+	{DDoc: "indexOwnerDoc", Name: "indexOwner", Fields: []indexField{{"docType", false}, {"owner", false}}},
+	{DDoc: "indexSizeSortDoc", Name: "indexSizeSortDesc", Fields: []indexField{{"size", true}, {"docType", true}, {"owner", true}}},
+}
+
+// buildMarbleQuery builds a query string for a selector constructed by the chaincode itself,
+// so that values supplied by clients are always JSON encoded rather than spliced in
+func buildMarbleQuery(selector map[string]interface{}) (string, error) {
+	selector["docType"] = "marble"
+	queryAsBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// validateRichQuery checks a client supplied query string and returns the query to execute,
+// with docType pinned, the limit capped and use_index set for sorted queries
+func validateRichQuery(queryString string) (string, error) {
+	query := map[string]interface{}{}
+	err := json.Unmarshal([]byte(queryString), &query)
+	if err != nil {
+		return "", fmt.Errorf("Query string is not a JSON object: %s", err.Error())
+	}
+
+	for option := range query {
+		switch option {
+		case "selector", "fields", "sort", "limit", "use_index":
+		default:
+			return "", fmt.Errorf("Query option is not allowed: %s", option)
+		}
+	}
+
+	selector, ok := query["selector"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("Query must have a selector object")
+	}
+	if docType, found := selector["docType"]; found && docType != "marble" {
+		if eq, ok := docType.(map[string]interface{}); !ok || len(eq) != 1 || eq["$eq"] != "marble" {
+			return "", fmt.Errorf("Query selector may only match docType marble")
+		}
+	}
+	selector["docType"] = "marble"
+	err = validateSelector(selector)
+	if err != nil {
+		return "", err
+	}
+
+	if fields, found := query["fields"]; found {
+		fieldList, ok := fields.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("Query fields must be an array")
+		}
+		for _, field := range fieldList {
+			name, ok := field.(string)
+			if !ok || !richQueryFields[name] {
+				return "", fmt.Errorf("Query field is not allowed: %v", field)
+			}
+		}
+	}
+
+	limit := float64(maxRichQueryLimit)
+	if requested, found := query["limit"]; found {
+		requestedLimit, ok := requested.(float64)
+		if !ok || requestedLimit <= 0 {
+			return "", fmt.Errorf("Query limit must be a positive number")
+		}
+		if requestedLimit < limit {
+			limit = requestedLimit
+		}
+	}
+	query["limit"] = limit
+
+	if sort, found := query["sort"]; found {
+		index, err := matchSortIndex(sort)
+		if err != nil {
+			return "", err
+		}
+		if useIndex, found := query["use_index"]; found && !usesIndex(useIndex, index) {
+			return "", fmt.Errorf("Query sort is not served by use_index %v", useIndex)
+		}
+		query["use_index"] = []string{"_design/" + index.DDoc, index.Name}
+	} else if useIndex, found := query["use_index"]; found && !usesPackagedIndex(useIndex) {
+		return "", fmt.Errorf("Query use_index is not a packaged index: %v", useIndex)
+	}
+
+	queryAsBytes, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// validateSelector walks a selector, rejecting fields and operators that are not allowed
+func validateSelector(selector map[string]interface{}) error {
+	for key, value := range selector {
+		if strings.HasPrefix(key, "$") {
+			err := validateOperator(key, value)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !richQueryFields[key] {
+			return fmt.Errorf("Query field is not allowed: %s", key)
+		}
+		// a field either matches a value directly or holds a map of operators
+		if condition, ok := value.(map[string]interface{}); ok {
+			for operator, operand := range condition {
+				if !strings.HasPrefix(operator, "$") {
+					return fmt.Errorf("Query field %s has no sub-fields", key)
+				}
+				err := validateOperator(operator, operand)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateOperator checks an operator and, for combination operators, the selectors it holds
+func validateOperator(operator string, operand interface{}) error {
+	if !richQueryOperators[operator] {
+		return fmt.Errorf("Query operator is not allowed: %s", operator)
+	}
+	switch operator {
+	case "$and", "$or":
+		clauses, ok := operand.([]interface{})
+		if !ok {
+			return fmt.Errorf("Query operator %s takes an array of selectors", operator)
+		}
+		for _, clause := range clauses {
+			selector, ok := clause.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("Query operator %s takes an array of selectors", operator)
+			}
+			err := validateSelector(selector)
+			if err != nil {
+				return err
+			}
+		}
+	case "$not":
+		selector, ok := operand.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Query operator $not takes a selector")
+		}
+		return validateSelector(selector)
+	}
+	return nil
+}
+
+// matchSortIndex returns the packaged index whose leading fields and directions are exactly
+// the requested sort
+func matchSortIndex(sort interface{}) (*packagedIndex, error) {
+	sortList, ok := sort.([]interface{})
+	if !ok || len(sortList) == 0 {
+		return nil, fmt.Errorf("Query sort must be a non-empty array")
+	}
+
+	sortFields := []indexField{}
+	for _, entry := range sortList {
+		switch sortField := entry.(type) {
+		case string:
+			sortFields = append(sortFields, indexField{sortField, false})
+		case map[string]interface{}:
+			if len(sortField) != 1 {
+				return nil, fmt.Errorf("Query sort entries name a single field")
+			}
+			for field, direction := range sortField {
+				if direction != "asc" && direction != "desc" {
+					return nil, fmt.Errorf("Query sort direction must be asc or desc")
+				}
+				sortFields = append(sortFields, indexField{field, direction == "desc"})
+			}
+		default:
+			return nil, fmt.Errorf("Query sort entries must be a field or {field: direction}")
+		}
+	}
+
+	for i := range packagedIndexes {
+		index := &packagedIndexes[i]
+		if len(sortFields) > len(index.Fields) {
+			continue
+		}
+		matched := true
+		for j, sortField := range sortFields {
+			if index.Fields[j] != sortField {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return index, nil
+		}
+	}
+	return nil, fmt.Errorf("Query sort is not served by a packaged index")
+}
+
+// usesIndex reports whether a use_index value, "_design/ddoc" or ["_design/ddoc", "name"],
+// names the given index
+func usesIndex(useIndex interface{}, index *packagedIndex) bool {
+	switch value := useIndex.(type) {
+	case string:
+		return value == "_design/"+index.DDoc
+	case []interface{}:
+		if len(value) == 1 {
+			return value[0] == "_design/"+index.DDoc
+		}
+		return len(value) == 2 && value[0] == "_design/"+index.DDoc && value[1] == index.Name
+	}
+	return false
+}
+
+// usesPackagedIndex reports whether a use_index value names any packaged index
+func usesPackagedIndex(useIndex interface{}) bool {
+	for i := range packagedIndexes {
+		if usesIndex(useIndex, &packagedIndexes[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateRichQueryRewritesQuery(t *testing.T) {
+	queryString, err := validateRichQuery(`{"selector":{"owner":"tom","size":{"$gt":10}},"sort":[{"size":"desc"}],"limit":500}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := map[string]interface{}{}
+	err = json.Unmarshal([]byte(queryString), &query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query["selector"].(map[string]interface{})["docType"] != "marble" {
+		t.Fatalf("docType was not pinned: %s", queryString)
+	}
+	if query["limit"] != float64(maxRichQueryLimit) {
+		t.Fatalf("limit was not capped: %s", queryString)
+	}
+	if !reflect.DeepEqual(query["use_index"], []interface{}{"_design/indexSizeSortDoc", "indexSizeSortDesc"}) {
+		t.Fatalf("sort was not pinned to its index: %s", queryString)
+	}
+}
+
+func TestValidateRichQueryRejectsUnsafeQueries(t *testing.T) {
+	for query, reason := range map[string]string{
+		`[]`: "not a JSON object",
+		`{"selector":{"owner":"tom"},"bookmark":"x"}`:                                            "option is not allowed",
+		`{"fields":["name"]}`:                                                                    "must have a selector",
+		`{"selector":{"docType":"owner"}}`:                                                       "only match docType marble",
+		`{"selector":{"ownerId":"x"}}`:                                                           "field is not allowed: ownerId",
+		`{"selector":{"name":{"$regex":"^m"}}}`:                                                  "operator is not allowed: $regex",
+		`{"selector":{"$or":[{"color":"red"},{"secret":1}]}}`:                                    "field is not allowed: secret",
+		`{"selector":{"$not":{"name":{"$where":"1"}}}}`:                                          "operator is not allowed: $where",
+		`{"selector":{"color":{"shade":"dark"}}}`:                                                "has no sub-fields",
+		`{"selector":{"owner":"tom"},"fields":["ownerMSP"]}`:                                     "field is not allowed: ownerMSP",
+		`{"selector":{"owner":"tom"},"limit":0}`:                                                 "positive number",
+		`{"selector":{"owner":"tom"},"sort":["color"]}`:                                          "not served by a packaged index",
+		`{"selector":{"owner":"tom"},"sort":[{"size":"asc"}]}`:                                   "not served by a packaged index",
+		`{"selector":{"owner":"tom"},"sort":["docType"],"use_index":"_design/indexSizeSortDoc"}`: "not served by use_index",
+		`{"selector":{"owner":"tom"},"use_index":"_design/adhoc"}`:                               "not a packaged index",
+	} {
+		_, err := validateRichQuery(query)
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("%s: expected an error containing %q, got %v", query, reason, err)
+		}
+	}
+}
+
+func TestPackagedIndexesMatchMetaInf(t *testing.T) {
+	files, err := filepath.Glob("META-INF/statedb/couchdb/indexes/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(packagedIndexes) {
+		t.Fatalf("found %d index definitions for %d packaged indexes", len(files), len(packagedIndexes))
+	}
+	for _, file := range files {
+		indexAsBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		definition := struct {
+			Index struct {
+				Fields []interface{} `json:"fields"`
+			} `json:"index"`
+			DDoc string `json:"ddoc"`
+			Name string `json:"name"`
+		}{}
+		err = json.Unmarshal(indexAsBytes, &definition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortFields := []interface{}{}
+		for _, field := range definition.Index.Fields {
+			sortFields = append(sortFields, field)
+		}
+		index, err := matchSortIndex(sortFields)
+		if err != nil || index.DDoc != definition.DDoc || index.Name != definition.Name || len(index.Fields) != len(sortFields) {
+			t.Errorf("%s is not mirrored by packagedIndexes", file)
+		}
+	}
+}
+
+func TestQueryMarbles(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble2", "red", "5", "tom"))
+	expectSuccess(t, s.invoke(o["jerry"], "initMarble", "marble3", "blue", "20", "jerry"))
+
+	if keys := pageKeys(readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "queryMarbles", `{"selector":{"color":"blue","size":{"$gte":20}}}`)))); len(keys) != 2 {
+		t.Fatalf("expected both blue marbles, got %v", keys)
+	}
+	if keys := pageKeys(readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "queryMarblesByOwner", "Tom")))); len(keys) != 2 || keys[0] != "marble1" {
+		t.Fatalf("expected the marbles of tom, got %v", keys)
+	}
+	// owner records share the name field but are never returned
+	if keys := pageKeys(readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "queryMarbles", `{"selector":{"docType":{"$eq":"marble"}}}`)))); len(keys) != 3 {
+		t.Fatalf("expected marbles only, got %v", keys)
+	}
+	expectError(t, s.invoke(o["tom"], "queryMarbles", `{"selector":{"alias":"tom"}}`), "not allowed")
+	expectError(t, s.invoke(o["tom"], "queryMarblesWithPagination", `{"selector":{"color":"blue"}}`, "500", ""), "between 1 and 100")
+}
@@ -0,0 +1,85 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+func (s *testStub) upgrade(args ...string) pb.Response {
+	s.args = toArgs("init", args...)
+	s.MockTransactionStart("upgrade")
+	defer s.MockTransactionEnd("upgrade")
+	return s.cc.Init(s)
+}
+
+func TestUpgradeKeepsStorageBackend(t *testing.T) {
+	s := newTestStub(t, "private", "collectionMarbles")
+	o := owners(t, s, "tom")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+
+	expectSuccess(t, s.upgrade())
+	expectSuccess(t, s.upgrade("private", "collectionMarbles"))
+	expectError(t, s.upgrade("public"), "cannot be moved to public state")
+	expectError(t, s.upgrade("private", "collectionOther"), "cannot be moved to private data collection collectionOther")
+
+	if _, ok := s.PvtState["collectionMarbles"]["marble1"]; !ok || s.State["marble1"] != nil {
+		t.Fatal("expected marble1 to stay in the private collection")
+	}
+	expectSuccess(t, s.invoke(o["tom"], "readMarble", "marble1"))
+
+	public := newTestStub(t)
+	expectError(t, public.upgrade("private", "collectionMarbles"), "kept in public state")
+	expectError(t, public.upgrade("private"), "Incorrect arguments")
+}
+
+func TestPrivatePaginationResumesAfterDeletedBookmark(t *testing.T) {
+	s := newTestStub(t, "private", "collectionMarbles")
+	o := owners(t, s, "tom")
+	for i := 1; i <= 5; i++ {
+		expectSuccess(t, s.invoke(o["tom"], "initMarble", fmt.Sprintf("marble%d", i), "blue", "10", "tom"))
+	}
+
+	first := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByRangeWithPagination", "marble1", "marble9", "2", "")))
+	if keys := pageKeys(first); len(keys) != 2 || first.Bookmark != "marble3" {
+		t.Fatalf("unexpected first range page %+v", first)
+	}
+	colors := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByColorWithPagination", "blue", "2", "")))
+	if colors.Bookmark == "" {
+		t.Fatalf("expected a bookmark for the next color page, got %+v", colors)
+	}
+	expectSuccess(t, s.invoke(o["tom"], "delete", "marble3"))
+
+	second := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByRangeWithPagination", "marble1", "marble9", "2", first.Bookmark)))
+	if keys := pageKeys(second); len(keys) != 2 || keys[0] != "marble4" || keys[1] != "marble5" || second.Bookmark != "" {
+		t.Fatalf("expected the range to resume at marble4, got %+v", second)
+	}
+	colors = readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "getMarblesByColorWithPagination", "blue", "2", colors.Bookmark)))
+	if keys := pageKeys(colors); len(keys) != 2 || keys[0] != "marble4" || colors.Bookmark != "" {
+		t.Fatalf("expected the color scan to resume at marble4, got %+v", colors)
+	}
+}
+
+func TestPrivateQueryPaginationUsesOffsets(t *testing.T) {
+	s := newTestStub(t, "private", "collectionMarbles")
+	o := owners(t, s, "tom")
+	for i := 1; i <= 3; i++ {
+		expectSuccess(t, s.invoke(o["tom"], "initMarble", fmt.Sprintf("marble%d", i), "blue", "10", "tom"))
+	}
+	query := `{"selector":{"color":"blue"}}`
+
+	first := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "queryMarblesWithPagination", query, "2", "")))
+	if keys := pageKeys(first); len(keys) != 2 || first.Bookmark != "2" {
+		t.Fatalf("unexpected first query page %+v", first)
+	}
+	second := readTestPage(t, expectSuccess(t, s.invoke(o["tom"], "queryMarblesWithPagination", query, "2", first.Bookmark)))
+	if keys := pageKeys(second); len(keys) != 1 || keys[0] != "marble3" || second.Bookmark != "" {
+		t.Fatalf("unexpected second query page %+v", second)
+	}
+	expectError(t, s.invoke(o["tom"], "queryMarblesWithPagination", query, "2", "marble2"), "Invalid bookmark")
+}
@@ -0,0 +1,491 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub completes shim.MockStub for the marbles functions: it carries the creator and
+// transient data of each call, a controllable transaction time, the last event set, the
+// history of every key, private data range and partial composite key scans, paginated
+// queries and a small CouchDB selector engine. Like the peer, and unlike MockStub, range
+// queries over simple keys leave out composite keys.
+type testStub struct {
+	*shim.MockStub
+	cc        *SimpleChaincode
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+	now       time.Time
+	txCount   int
+	event     *pb.ChaincodeEvent
+	history   map[string][]*queryresult.KeyModification
+}
+
+func newTestStub(t *testing.T, initArgs ...string) *testStub {
+	cc := new(SimpleChaincode)
+	s := &testStub{
+		MockStub: shim.NewMockStub("marbles", cc),
+		cc:       cc,
+		now:      time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC),
+		history:  map[string][]*queryresult.KeyModification{},
+	}
+	s.txCount++
+	s.args = toArgs("init", initArgs...)
+	s.MockTransactionStart("init")
+	resp := cc.Init(s)
+	s.MockTransactionEnd("init")
+	if resp.Status != shim.OK {
+		t.Fatalf("Init failed: %s", resp.Message)
+	}
+	return s
+}
+
+func toArgs(function string, args ...string) [][]byte {
+	allArgs := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		allArgs = append(allArgs, []byte(arg))
+	}
+	return allArgs
+}
+
+// invoke runs one transaction submitted by creator. Like the peer, and unlike MockStub, it
+// discards the writes and event of a transaction that fails.
+func (s *testStub) invoke(creator []byte, function string, args ...string) pb.Response {
+	s.txCount++
+	txID := fmt.Sprintf("tx%d", s.txCount)
+	s.args = toArgs(function, args...)
+	s.creator = creator
+	s.event = nil
+	rollback := s.snapshot()
+	s.MockTransactionStart(txID)
+	defer s.MockTransactionEnd(txID)
+	resp := s.cc.Invoke(s)
+	if resp.Status >= shim.ERRORTHRESHOLD {
+		rollback()
+	}
+	return resp
+}
+
+// snapshot returns a function restoring the state, private data and history as they are now
+func (s *testStub) snapshot() func() {
+	state := copyState(s.State)
+	keys := []string{}
+	for e := s.Keys.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	pvtState := map[string]map[string][]byte{}
+	for collection, values := range s.PvtState {
+		pvtState[collection] = copyState(values)
+	}
+	history := map[string][]*queryresult.KeyModification{}
+	for key, modifications := range s.history {
+		history[key] = append([]*queryresult.KeyModification{}, modifications...)
+	}
+	return func() {
+		s.State = state
+		s.Keys = list.New()
+		for _, key := range keys {
+			s.Keys.PushBack(key)
+		}
+		s.PvtState = pvtState
+		s.history = history
+		s.event = nil
+	}
+}
+
+func copyState(state map[string][]byte) map[string][]byte {
+	copied := map[string][]byte{}
+	for key, value := range state {
+		copied[key] = value
+	}
+	return copied
+}
+
+// advance moves the transaction time on
+func (s *testStub) advance(d time.Duration) {
+	s.now = s.now.Add(d)
+}
+
+func (s *testStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *testStub) GetStringArgs() []string {
+	args := []string{}
+	for _, arg := range s.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	return args[0], args[1:]
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now.Unix(), Nanos: int32(s.now.Nanosecond())}, nil
+}
+
+func (s *testStub) SetEvent(name string, payload []byte) error {
+	s.event = &pb.ChaincodeEvent{EventName: name, Payload: payload}
+	return nil
+}
+
+func (s *testStub) PutState(key string, value []byte) error {
+	err := s.MockStub.PutState(key, value)
+	if err == nil {
+		s.recordHistory(key, value, false)
+	}
+	return err
+}
+
+func (s *testStub) DelState(key string) error {
+	existed := s.State[key] != nil
+	err := s.MockStub.DelState(key)
+	if err == nil && existed {
+		s.recordHistory(key, nil, true)
+	}
+	return err
+}
+
+// recordHistory keeps the last write of each transaction to a key, as the history database does
+func (s *testStub) recordHistory(key string, value []byte, isDelete bool) {
+	modification := &queryresult.KeyModification{
+		TxId:      s.TxID,
+		Value:     value,
+		Timestamp: &timestamp.Timestamp{Seconds: s.now.Unix(), Nanos: int32(s.now.Nanosecond())},
+		IsDelete:  isDelete,
+	}
+	modifications := s.history[key]
+	if len(modifications) > 0 && modifications[len(modifications)-1].TxId == s.TxID {
+		modifications = modifications[:len(modifications)-1]
+	}
+	s.history[key] = append(modifications, modification)
+}
+
+func (s *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: append([]*queryresult.KeyModification{}, s.history[key]...)}, nil
+}
+
+func (s *testStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return &sliceIterator{results: rangeOf(s.State, startKey, endKey)}, nil
+}
+
+func (s *testStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	return pageOf(rangeOf(s.State, startKey, endKey), pageSize)
+}
+
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	results := prefixOf(s.State, objectType, keys)
+	for len(results) > 0 && bookmark != "" && results[0].Key < bookmark {
+		results = results[1:]
+	}
+	return pageOf(results, pageSize)
+}
+
+func (s *testStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	results, err := selectRecords(s.State, query)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{results: results}, nil
+}
+
+func (s *testStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	results, err := selectRecords(s.State, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(results) > 0 && bookmark != "" && results[0].Key < bookmark {
+		results = results[1:]
+	}
+	return pageOf(results, pageSize)
+}
+
+func (s *testStub) DelPrivateData(collection string, key string) error {
+	delete(s.PvtState[collection], key)
+	return nil
+}
+
+func (s *testStub) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return &sliceIterator{results: rangeOf(s.PvtState[collection], startKey, endKey)}, nil
+}
+
+func (s *testStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	return &sliceIterator{results: prefixOf(s.PvtState[collection], objectType, keys)}, nil
+}
+
+func (s *testStub) GetPrivateDataQueryResult(collection, query string) (shim.StateQueryIteratorInterface, error) {
+	results, err := selectRecords(s.PvtState[collection], query)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{results: results}, nil
+}
+
+// rangeOf returns the simple keys in [startKey, endKey), an empty endKey being unbounded
+func rangeOf(state map[string][]byte, startKey, endKey string) []*queryresult.KV {
+	results := []*queryresult.KV{}
+	for _, key := range sortedKeys(state) {
+		if strings.HasPrefix(key, "\x00") || key < startKey || (endKey != "" && key >= endKey) {
+			continue
+		}
+		results = append(results, &queryresult.KV{Key: key, Value: state[key]})
+	}
+	return results
+}
+
+// prefixOf returns the composite keys starting with objectType and keys
+func prefixOf(state map[string][]byte, objectType string, keys []string) []*queryresult.KV {
+	prefix := "\x00" + objectType + "\x00"
+	for _, key := range keys {
+		prefix += key + "\x00"
+	}
+	results := []*queryresult.KV{}
+	for _, key := range sortedKeys(state) {
+		if strings.HasPrefix(key, prefix) {
+			results = append(results, &queryresult.KV{Key: key, Value: state[key]})
+		}
+	}
+	return results
+}
+
+// pageOf cuts the first page off results, bookmarked at the first key of the next page
+func pageOf(results []*queryresult.KV, pageSize int32) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	metadata := &pb.QueryResponseMetadata{}
+	if len(results) > int(pageSize) {
+		metadata.Bookmark = results[pageSize].Key
+		results = results[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(len(results))
+	return &sliceIterator{results: results}, metadata, nil
+}
+
+// selectRecords evaluates the selector of a query against the simple keys of a state,
+// supporting equality and the $eq, $gt, $gte, $lt and $lte operators
+func selectRecords(state map[string][]byte, query string) ([]*queryresult.KV, error) {
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	err := json.Unmarshal([]byte(query), &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*queryresult.KV{}
+	for _, kv := range rangeOf(state, "", "") {
+		record := map[string]interface{}{}
+		if json.Unmarshal(kv.Value, &record) != nil {
+			continue
+		}
+		if matchSelector(parsed.Selector, record) {
+			results = append(results, kv)
+		}
+	}
+	return results, nil
+}
+
+func matchSelector(selector map[string]interface{}, record map[string]interface{}) bool {
+	for field, condition := range selector {
+		operators, ok := condition.(map[string]interface{})
+		if !ok {
+			operators = map[string]interface{}{"$eq": condition}
+		}
+		for operator, operand := range operators {
+			if !compare(operator, record[field], operand) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func compare(operator string, value interface{}, operand interface{}) bool {
+	if operator == "$eq" {
+		return value == operand
+	}
+	var order int
+	switch v := value.(type) {
+	case string:
+		o, _ := operand.(string)
+		order = strings.Compare(v, o)
+	case float64:
+		o, _ := operand.(float64)
+		switch {
+		case v < o:
+			order = -1
+		case v > o:
+			order = 1
+		}
+	default:
+		return false
+	}
+	switch operator {
+	case "$gt":
+		return order > 0
+	case "$gte":
+		return order >= 0
+	case "$lt":
+		return order < 0
+	case "$lte":
+		return order <= 0
+	}
+	return false
+}
+
+func sortedKeys(state map[string][]byte) []string {
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type sliceIterator struct {
+	results []*queryresult.KV
+}
+
+func (it *sliceIterator) HasNext() bool {
+	return len(it.results) > 0
+}
+
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	next := it.results[0]
+	it.results = it.results[1:]
+	return next, nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (it *historyIterator) HasNext() bool {
+	return len(it.modifications) > 0
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	next := it.modifications[0]
+	it.modifications = it.modifications[1:]
+	return next, nil
+}
+
+func (it *historyIterator) Close() error {
+	return nil
+}
+
+// newCreator returns a serialized identity of mspID named commonName, whose certificate
+// carries attrs the way the Fabric CA enrolls them
+func newCreator(t *testing.T, mspID string, commonName string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if len(attrs) > 0 {
+		attrsAsBytes, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attrsAsBytes}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+func expectSuccess(t *testing.T, resp pb.Response) []byte {
+	t.Helper()
+	if resp.Status != shim.OK {
+		t.Fatalf("expected success, got: %s", resp.Message)
+	}
+	return resp.Payload
+}
+
+func expectError(t *testing.T, resp pb.Response, contains string) {
+	t.Helper()
+	if resp.Status == shim.OK {
+		t.Fatalf("expected an error containing %q, got success", contains)
+	}
+	if !strings.Contains(resp.Message, contains) {
+		t.Fatalf("expected an error containing %q, got: %s", contains, resp.Message)
+	}
+}
+
+// readTestMarble reads a marble straight from public state
+func readTestMarble(t *testing.T, s *testStub, name string) *marble {
+	t.Helper()
+	marbleAsBytes := s.State[name]
+	if marbleAsBytes == nil {
+		return nil
+	}
+	m := &marble{}
+	err := json.Unmarshal(marbleAsBytes, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// owners registers a client per alias and returns their creators
+func owners(t *testing.T, s *testStub, aliases ...string) map[string][]byte {
+	creators := map[string][]byte{}
+	for i, alias := range aliases {
+		creators[alias] = newCreator(t, fmt.Sprintf("Org%dMSP", i%2+1), alias, nil)
+		expectSuccess(t, s.invoke(creators[alias], "registerOwner", alias))
+	}
+	return creators
+}
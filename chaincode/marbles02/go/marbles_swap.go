@@ -0,0 +1,383 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ==== Swaps ==================================================================================
+// proposeSwap escrows the proposer's marble by writing a swapLock~marble key for it, which
+// transferMarble, delete and the auction functions refuse to move past. The counterparty's
+// marble stays free until they accept: acceptSwap checks it is unlocked and exchanges the
+// owners of both marbles in one transaction, so neither side can back out halfway.
+// A proposal stops locking its marble once it is accepted, cancelled or past its expiry,
+// which may be at most maxSwapDuration away.
+// =============================================================================================
+
+type swap struct {
+	ObjectType         string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	SwapID             string `json:"swapId"`
+	ProposerMarble     string `json:"proposerMarble"`
+	Proposer           string `json:"proposer"`
+	CounterpartyMarble string `json:"counterpartyMarble"`
+	Counterparty       string `json:"counterparty"`
+	Expiry             int64  `json:"expiry"`
+	Status             string `json:"status"`
+}
+
+// maxSwapDuration is the longest a proposal may escrow the proposer's marble
+const maxSwapDuration = 7 * 24 * time.Hour
+
+const (
+	swapOpen      = "open"
+	swapAccepted  = "accepted"
+	swapCancelled = "cancelled"
+)
+
+// ============================================================
+// proposeSwap - offer my marble for your marble until the expiry, at most a week ahead
+// ============================================================
+func (t *SimpleChaincode) proposeSwap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0          1                2
+	// "marble1", "marble2", "2019-06-01T12:00:00Z"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if args[0] == args[1] {
+		return shim.Error("Cannot swap a marble for itself")
+	}
+	expiry, err := time.Parse(time.RFC3339, args[2])
+	if err != nil {
+		return shim.Error("3rd argument must be an RFC3339 timestamp")
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !expiry.After(now) {
+		return shim.Error("Expiry must be in the future")
+	}
+	if expiry.Sub(now) > maxSwapDuration {
+		return shim.Error(fmt.Sprintf("Expiry must be at most %d days away", int(maxSwapDuration.Hours()/24)))
+	}
+
+	proposerMarble, err := getMarbleForSwap(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	counterpartyMarble, err := getMarbleForSwap(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if proposerMarble.Owner == counterpartyMarble.Owner {
+		return shim.Error("Both marbles are owned by " + proposerMarble.Owner)
+	}
+	err = authorizeMarbleOwner(stub, proposerMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkMarbleUnlocked(stub, proposerMarble.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proposal := &swap{
+		ObjectType:         "swap",
+		SwapID:             stub.GetTxID(),
+		ProposerMarble:     proposerMarble.Name,
+		Proposer:           proposerMarble.Owner,
+		CounterpartyMarble: counterpartyMarble.Name,
+		Counterparty:       counterpartyMarble.Owner,
+		Expiry:             expiry.Unix(),
+		Status:             swapOpen,
+	}
+	err = putSwap(stub, proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Escrow the proposer's marble until the swap is settled ====
+	lockKey, err := stub.CreateCompositeKey("swapLock", []string{proposal.ProposerMarble})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(lockKey, []byte(proposal.SwapID))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(proposal.SwapID))
+}
+
+// ============================================================
+// acceptSwap - the counterparty accepts, exchanging both marbles atomically
+// ============================================================
+func (t *SimpleChaincode) acceptSwap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0
+	// "swapId"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	proposal, err := getSwap(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if proposal.Status != swapOpen {
+		return shim.Error("Swap is " + proposal.Status)
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Unix() >= proposal.Expiry {
+		return shim.Error("Swap has expired")
+	}
+
+	// ==== Both marbles must still be with the parties recorded at proposal time ====
+	proposerMarble, err := getMarbleForSwap(stub, proposal.ProposerMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	counterpartyMarble, err := getMarbleForSwap(stub, proposal.CounterpartyMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if proposerMarble.Owner != proposal.Proposer {
+		return shim.Error(proposal.ProposerMarble + " is no longer owned by " + proposal.Proposer)
+	}
+	if counterpartyMarble.Owner != proposal.Counterparty {
+		return shim.Error(proposal.CounterpartyMarble + " is no longer owned by " + proposal.Counterparty)
+	}
+	err = authorizeMarbleOwner(stub, counterpartyMarble)
+	if err != nil {
+		return shim.Error("Swap can only be accepted for " + proposal.Counterparty + ": " + err.Error())
+	}
+	err = checkMarbleUnlocked(stub, counterpartyMarble.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proposer := &owner{Alias: proposerMarble.Owner, ID: proposerMarble.OwnerID, MSPID: proposerMarble.OwnerMSP}
+	counterparty := &owner{Alias: counterpartyMarble.Owner, ID: counterpartyMarble.OwnerID, MSPID: counterpartyMarble.OwnerMSP}
+	proposerBefore, counterpartyBefore := *proposerMarble, *counterpartyMarble
+	err = setMarbleOwner(stub, proposerMarble, counterparty)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = setMarbleOwner(stub, counterpartyMarble, proposer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proposal.Status = swapAccepted
+	err = settleSwap(stub, proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = setMarbleEvent(stub, &marbleEvent{Type: eventMarbleTransferred, Marbles: []marbleEventEntry{
+		newMarbleEventEntry(&proposerBefore, proposerMarble),
+		newMarbleEventEntry(&counterpartyBefore, counterpartyMarble),
+	}})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================
+// cancelSwap - the proposer withdraws an open proposal. Once expired, anyone may
+// cancel it to clean up its lock.
+// ============================================================
+func (t *SimpleChaincode) cancelSwap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0
+	// "swapId"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	proposal, err := getSwap(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if proposal.Status != swapOpen {
+		return shim.Error("Swap is " + proposal.Status)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Unix() < proposal.Expiry {
+		proposerMarble, err := getMarbleForSwap(stub, proposal.ProposerMarble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = authorizeMarbleOwner(stub, proposerMarble)
+		if err != nil {
+			return shim.Error("Swap can only be cancelled by " + proposal.Proposer + " before it expires")
+		}
+	}
+
+	proposal.Status = swapCancelled
+	err = settleSwap(stub, proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readSwap - read a swap proposal
+// ============================================================
+func (t *SimpleChaincode) readSwap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting swap id")
+	}
+
+	proposal, err := getSwap(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	swapAsBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(swapAsBytes)
+}
+
+// getMarbleForSwap reads a marble that is not up for auction
+func getMarbleForSwap(stub shim.ChaincodeStubInterface, marbleName string) (*marble, error) {
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get marble: %s", err.Error())
+	} else if marbleAsBytes == nil {
+		return nil, fmt.Errorf("Marble does not exist: %s", marbleName)
+	}
+
+	swapped := &marble{}
+	err = json.Unmarshal(marbleAsBytes, swapped)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkMarbleNotAuctioned(stub, marbleName)
+	if err != nil {
+		return nil, err
+	}
+	return swapped, nil
+}
+
+// getMarbleLock returns the id of the open, unexpired swap escrowing a marble,
+// or an empty string when the marble is free to move
+func getMarbleLock(stub shim.ChaincodeStubInterface, marbleName string) (string, error) {
+	lockKey, err := stub.CreateCompositeKey("swapLock", []string{marbleName})
+	if err != nil {
+		return "", err
+	}
+	swapID, err := stub.GetState(lockKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get swap lock: %s", err.Error())
+	} else if swapID == nil {
+		return "", nil
+	}
+
+	proposal, err := getSwap(stub, string(swapID))
+	if err != nil {
+		return "", err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	if proposal.Status != swapOpen || now.Unix() >= proposal.Expiry {
+		return "", nil
+	}
+	return proposal.SwapID, nil
+}
+
+// checkMarbleUnlocked fails if a marble is escrowed by an open swap
+func checkMarbleUnlocked(stub shim.ChaincodeStubInterface, marbleName string) error {
+	swapID, err := getMarbleLock(stub, marbleName)
+	if err != nil {
+		return err
+	} else if swapID != "" {
+		return fmt.Errorf("Marble %s is locked by swap %s", marbleName, swapID)
+	}
+	return nil
+}
+
+// settleSwap records the final status of a swap and releases the locks it holds. A lock
+// taken over by a later swap, once this one had expired, belongs to that swap and is kept.
+func settleSwap(stub shim.ChaincodeStubInterface, proposal *swap) error {
+	err := putSwap(stub, proposal)
+	if err != nil {
+		return err
+	}
+	for _, marbleName := range []string{proposal.ProposerMarble, proposal.CounterpartyMarble} {
+		lockKey, err := stub.CreateCompositeKey("swapLock", []string{marbleName})
+		if err != nil {
+			return err
+		}
+		swapID, err := stub.GetState(lockKey)
+		if err != nil {
+			return fmt.Errorf("Failed to get swap lock: %s", err.Error())
+		} else if string(swapID) != proposal.SwapID {
+			continue
+		}
+		err = stub.DelState(lockKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSwap reads a swap proposal by id
+func getSwap(stub shim.ChaincodeStubInterface, swapID string) (*swap, error) {
+	swapKey, err := stub.CreateCompositeKey("swap", []string{swapID})
+	if err != nil {
+		return nil, err
+	}
+	swapAsBytes, err := stub.GetState(swapKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get swap: %s", err.Error())
+	} else if swapAsBytes == nil {
+		return nil, fmt.Errorf("Swap does not exist: %s", swapID)
+	}
+
+	proposal := &swap{}
+	err = json.Unmarshal(swapAsBytes, proposal)
+	if err != nil {
+		return nil, err
+	}
+	return proposal, nil
+}
+
+// putSwap writes a swap proposal under its id
+func putSwap(stub shim.ChaincodeStubInterface, proposal *swap) error {
+	swapKey, err := stub.CreateCompositeKey("swap", []string{proposal.SwapID})
+	if err != nil {
+		return err
+	}
+	swapAsBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(swapKey, swapAsBytes)
+}
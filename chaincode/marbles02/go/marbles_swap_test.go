@@ -0,0 +1,80 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSwapExchangesMarbles(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble3", "green", "20", "tom"))
+	expectSuccess(t, s.invoke(o["jerry"], "initMarble", "marble2", "red", "50", "jerry"))
+	expiry := s.now.Add(time.Hour).Format(time.RFC3339)
+
+	expectError(t, s.invoke(o["tom"], "proposeSwap", "marble1", "marble1", expiry), "for itself")
+	expectError(t, s.invoke(o["tom"], "proposeSwap", "marble1", "marble3", expiry), "Both marbles are owned by")
+	expectError(t, s.invoke(o["tom"], "proposeSwap", "marble2", "marble1", expiry), "not the owner")
+	expectError(t, s.invoke(o["tom"], "proposeSwap", "marble1", "marble2", s.now.Add(8*24*time.Hour).Format(time.RFC3339)), "at most 7 days")
+	swapID := string(expectSuccess(t, s.invoke(o["tom"], "proposeSwap", "marble1", "marble2", expiry)))
+
+	// ==== Only the proposer's marble is escrowed ====
+	expectError(t, s.invoke(o["tom"], "transferMarble", "marble1", "jerry"), "locked by swap")
+	expectError(t, s.invoke(o["tom"], "acceptSwap", swapID), "can only be accepted for jerry")
+	expectError(t, s.invoke(o["jerry"], "cancelSwap", swapID), "only be cancelled by tom")
+
+	expectSuccess(t, s.invoke(o["jerry"], "acceptSwap", swapID))
+	if m1, m2 := readTestMarble(t, s, "marble1"), readTestMarble(t, s, "marble2"); m1.Owner != "jerry" || m2.Owner != "tom" {
+		t.Fatalf("marbles were not exchanged: marble1 %s, marble2 %s", m1.Owner, m2.Owner)
+	}
+	expectError(t, s.invoke(o["jerry"], "acceptSwap", swapID), "Swap is accepted")
+	expectSuccess(t, s.invoke(o["jerry"], "transferMarble", "marble1", "tom"))
+}
+
+func TestSwapLeavesCounterpartyMarbleFree(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry", "spike")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["jerry"], "initMarble", "marble2", "red", "50", "jerry"))
+	expectSuccess(t, s.invoke(o["spike"], "initMarble", "marble3", "red", "60", "spike"))
+	expiry := s.now.Add(time.Hour).Format(time.RFC3339)
+
+	swapID := string(expectSuccess(t, s.invoke(o["tom"], "proposeSwap", "marble1", "marble2", expiry)))
+
+	// ==== A counterparty escrowing their marble elsewhere cannot accept ====
+	otherID := string(expectSuccess(t, s.invoke(o["jerry"], "proposeSwap", "marble2", "marble3", expiry)))
+	expectError(t, s.invoke(o["jerry"], "acceptSwap", swapID), "locked by swap "+otherID)
+	expectSuccess(t, s.invoke(o["jerry"], "cancelSwap", otherID))
+
+	// ==== Nor once they moved their marble on ====
+	expectSuccess(t, s.invoke(o["jerry"], "transferMarble", "marble2", "spike"))
+	expectError(t, s.invoke(o["spike"], "acceptSwap", swapID), "no longer owned by jerry")
+	expectSuccess(t, s.invoke(o["tom"], "cancelSwap", swapID))
+	expectSuccess(t, s.invoke(o["tom"], "transferMarble", "marble1", "spike"))
+}
+
+func TestSettledSwapKeepsLaterLock(t *testing.T) {
+	s := newTestStub(t)
+	o := owners(t, s, "tom", "jerry", "spike")
+	expectSuccess(t, s.invoke(o["tom"], "initMarble", "marble1", "blue", "35", "tom"))
+	expectSuccess(t, s.invoke(o["jerry"], "initMarble", "marble2", "red", "50", "jerry"))
+	expectSuccess(t, s.invoke(o["spike"], "initMarble", "marble3", "red", "60", "spike"))
+
+	expiredID := string(expectSuccess(t, s.invoke(o["tom"], "proposeSwap", "marble1", "marble2", s.now.Add(time.Hour).Format(time.RFC3339))))
+	s.advance(2 * time.Hour)
+	expectError(t, s.invoke(o["jerry"], "acceptSwap", expiredID), "expired")
+	laterID := string(expectSuccess(t, s.invoke(o["tom"], "proposeSwap", "marble1", "marble3", s.now.Add(time.Hour).Format(time.RFC3339))))
+
+	// ==== Anyone may clean up the expired swap, without releasing the later lock ====
+	expectSuccess(t, s.invoke(o["spike"], "cancelSwap", expiredID))
+	expectError(t, s.invoke(o["tom"], "transferMarble", "marble1", "jerry"), "locked by swap "+laterID)
+	expectSuccess(t, s.invoke(o["spike"], "acceptSwap", laterID))
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "spike" {
+		t.Fatalf("expected the later swap to settle, marble1 is owned by %s", m.Owner)
+	}
+}
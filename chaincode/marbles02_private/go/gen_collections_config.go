@@ -0,0 +1,48 @@
+//go:build ignore
+// +build ignore
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// gen_collections_config embeds ../collections_config.json into the chaincode, so that it
+// knows which orgs are members of each collection. Run it with go generate whenever the
+// collection definitions change.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	config, err := ioutil.ReadFile("../collections_config.json")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading collections config: %s\n", err)
+		os.Exit(1)
+	}
+	var collections []interface{}
+	err = json.Unmarshal(config, &collections)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error decoding collections config: %s\n", err)
+		os.Exit(1)
+	}
+
+	source := fmt.Sprintf(`// Code generated by gen_collections_config.go; DO NOT EDIT.
+
+package main
+
+// collectionsConfigJSON is the content of collections_config.json at build time
+const collectionsConfigJSON = %q
+`, config)
+
+	err = ioutil.WriteFile("collections_config_gen.go", []byte(source), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing collections_config_gen.go: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -4,6 +4,11 @@ Copyright IBM Corp. All Rights Reserved.
 SPDX-License-Identifier: Apache-2.0
 */
 
+// This sample is kept apart from the marbles chaincode of chaincode/marbles02, which runs on
+// public state or on a single private collection: here marbles belong to orgs, are sold on
+// price agreements kept in per-org collections and are checked against the members of each
+// collection they touch, and the functions of chaincode/marbles02 are not available.
+
 // ====CHAINCODE EXECUTION SAMPLES (CLI) ==================
 
 // ==== Invoke marbles, pass private data as base64 encoded bytes in transient map ====
@@ -17,9 +22,21 @@ SPDX-License-Identifier: Apache-2.0
 // export MARBLE=$(echo -n "{\"name\":\"marble3\",\"color\":\"blue\",\"size\":70,\"owner\":\"tom\",\"price\":103}" | base64)
 // peer chaincode invoke -C mychannel -n marblesp -c '{"Args":["initMarble"]}' --transient "{\"marble\":\"$MARBLE\"}"
 //
-// export MARBLE_OWNER=$(echo -n "{\"name\":\"marble2\",\"owner\":\"jerry\"}" | base64)
+// A transfer needs the seller's org and the buyer's org to agree on the price first, each on its own peer
+// export MARBLE_PRICE=$(echo -n "{\"name\":\"marble2\",\"price\":110,\"tradeId\":\"trade1\"}" | base64)
+// peer chaincode invoke -C mychannel -n marblesp -c '{"Args":["agreeToSell"]}' --transient "{\"marble_price\":\"$MARBLE_PRICE\"}"
+// peer chaincode invoke -C mychannel -n marblesp -c '{"Args":["agreeToBuy"]}' --transient "{\"marble_price\":\"$MARBLE_PRICE\"}"
+//
+// export MARBLE_OWNER=$(echo -n "{\"name\":\"marble2\",\"owner\":\"jerry\",\"buyerMSP\":\"Org2MSP\"}" | base64)
 // peer chaincode invoke -C mychannel -n marblesp -c '{"Args":["transferMarble"]}' --transient "{\"marble_owner\":\"$MARBLE_OWNER\"}"
 //
+// export MARBLE_COLOR_OWNER=$(echo -n "{\"color\":\"blue\",\"owner\":\"jerry\",\"buyerMSP\":\"Org2MSP\"}" | base64)
+// peer chaincode invoke -C mychannel -n marblesp -c '{"Args":["transferMarblesBasedOnColor"]}' --transient "{\"marble_color_owner\":\"$MARBLE_COLOR_OWNER\"}"
+//
+// A marble created before owning orgs were recorded is bound by an admin of the org that holds it
+// export MARBLE_BIND=$(echo -n "{\"name\":\"marble3\"}" | base64)
+// peer chaincode invoke -C mychannel -n marblesp -c '{"Args":["bindMarbleOwner"]}' --transient "{\"marble_bind\":\"$MARBLE_BIND\"}"
+//
 // export MARBLE_DELETE=$(echo -n "{\"name\":\"marble1\"}" | base64)
 // peer chaincode invoke -C mychannel -n marblesp -c '{"Args":["delete"]}' --transient "{\"marble_delete\":\"$MARBLE_DELETE\"}"
 
@@ -96,6 +113,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -110,6 +128,7 @@ type marble struct {
 	Color      string `json:"color"`
 	Size       int    `json:"size"`
 	Owner      string `json:"owner"`
+	OwnerMSP   string `json:"ownerMSP,omitempty"` //org of the owner, the only org that can sell the marble
 }
 
 type marblePrivateDetails struct {
@@ -151,9 +170,21 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	case "readMarblePrivateDetails":
 		//read a marble private details
 		return t.readMarblePrivateDetails(stub, args)
+	case "agreeToSell":
+		//record the seller org's agreed price for a marble
+		return t.agreeToSell(stub, args)
+	case "agreeToBuy":
+		//record the buyer org's agreed price for a marble
+		return t.agreeToBuy(stub, args)
 	case "transferMarble":
-		//change owner of a specific marble
+		//change owner of a specific marble once both orgs agreed on a price
 		return t.transferMarble(stub, args)
+	case "transferMarblesBasedOnColor":
+		//transfer all marbles of a certain color, all or nothing
+		return t.transferMarblesBasedOnColor(stub, args)
+	case "bindMarbleOwner":
+		//admin only, bind a marble created before owning orgs were recorded to the admin's org
+		return t.bindMarbleOwner(stub, args)
 	case "delete":
 		//delete a marble
 		return t.delete(stub, args)
@@ -190,6 +221,11 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	// ==== Input sanitation ====
 	fmt.Println("- start init marble")
 
+	err = authorizeCollectionWrite(stub, "collectionMarbles", "collectionMarblePrivateDetails")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	if len(args) != 0 {
 		return shim.Error("Incorrect number of arguments. Private marble data must be passed in transient map.")
 	}
@@ -238,6 +274,12 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error("This marble already exists: " + marbleInput.Name)
 	}
 
+	// ==== The creator's org owns the marble ====
+	ownerMSPID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error("Failed to get client MSP id: " + err.Error())
+	}
+
 	// ==== Create marble object, marshal to JSON, and save to state ====
 	marble := &marble{
 		ObjectType: "marble",
@@ -245,6 +287,7 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 		Color:      marbleInput.Color,
 		Size:       marbleInput.Size,
 		Owner:      marbleInput.Owner,
+		OwnerMSP:   ownerMSPID,
 	}
 	marbleJSONasBytes, err := json.Marshal(marble)
 	if err != nil {
@@ -304,6 +347,11 @@ func (t *SimpleChaincode) readMarble(stub shim.ChaincodeStubInterface, args []st
 	}
 
 	name = args[0]
+	err = authorizeCollectionRead(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	valAsbytes, err := stub.GetPrivateData("collectionMarbles", name) //get the marble from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
@@ -328,6 +376,11 @@ func (t *SimpleChaincode) readMarblePrivateDetails(stub shim.ChaincodeStubInterf
 	}
 
 	name = args[0]
+	err = authorizeCollectionRead(stub, "collectionMarblePrivateDetails")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	valAsbytes, err := stub.GetPrivateData("collectionMarblePrivateDetails", name) //get the marble private details from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get private details for " + name + ": " + err.Error() + "\"}"
@@ -354,6 +407,11 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error("Incorrect number of arguments. Private marble name must be passed in transient map.")
 	}
 
+	err := authorizeCollectionWrite(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	transMap, err := stub.GetTransient()
 	if err != nil {
 		return shim.Error("Error getting transient: " + err.Error())
@@ -408,10 +466,13 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
 
-	// Finally, delete private details of marble
-	err = stub.DelPrivateData("collectionMarblePrivateDetails", marbleDeleteInput.Name)
-	if err != nil {
-		return shim.Error(err.Error())
+	// Finally, delete private details of marble. Orgs outside collectionMarblePrivateDetails
+	// cannot, and leave them to be purged when they reach the collection's blockToLive
+	if authorizeCollectionWrite(stub, "collectionMarblePrivateDetails") == nil {
+		err = stub.DelPrivateData("collectionMarblePrivateDetails", marbleDeleteInput.Name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 
 	return shim.Success(nil)
@@ -425,14 +486,20 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	fmt.Println("- start transfer marble")
 
 	type marbleTransferTransientInput struct {
-		Name  string `json:"name"`
-		Owner string `json:"owner"`
+		Name     string `json:"name"`
+		Owner    string `json:"owner"`
+		BuyerMSP string `json:"buyerMSP"`
 	}
 
 	if len(args) != 0 {
 		return shim.Error("Incorrect number of arguments. Private marble data must be passed in transient map.")
 	}
 
+	err := authorizeCollectionWrite(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	transMap, err := stub.GetTransient()
 	if err != nil {
 		return shim.Error("Error getting transient: " + err.Error())
@@ -458,29 +525,80 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	if len(marbleTransferInput.Owner) == 0 {
 		return shim.Error("owner field must be a non-empty string")
 	}
+	if len(marbleTransferInput.BuyerMSP) == 0 {
+		return shim.Error("buyerMSP field must be a non-empty string")
+	}
 
-	marbleAsBytes, err := stub.GetPrivateData("collectionMarbles", marbleTransferInput.Name)
+	// ==== The seller's org transfers ====
+	sellerMSPID, err := getClientMSPID(stub)
 	if err != nil {
-		return shim.Error("Failed to get marble:" + err.Error())
+		return shim.Error(err.Error())
+	}
+
+	_, err = sellPrivateMarble(stub, marbleTransferInput.Name, marbleTransferInput.Owner, sellerMSPID, marbleTransferInput.BuyerMSP)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transferMarble (success)")
+	return shim.Success(nil)
+}
+
+// privateTransfer reports a marble moved by a private sale
+type privateTransfer struct {
+	Name          string `json:"name"`
+	PreviousOwner string `json:"previousOwner"`
+	Owner         string `json:"owner"`
+	Price         int    `json:"price"`
+}
+
+// sellPrivateMarble moves a marble to its new owner at the price both orgs agreed on. The
+// private details are left alone: collectionMarblePrivateDetails is only shared with Org1, so
+// a sale by or to another org could not write it, and the agreed price is reported instead
+func sellPrivateMarble(stub shim.ChaincodeStubInterface, marbleName string, newOwner string, sellerMSPID string, buyerMSPID string) (*privateTransfer, error) {
+	marbleAsBytes, err := stub.GetPrivateData("collectionMarbles", marbleName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get marble:%s", err.Error())
 	} else if marbleAsBytes == nil {
-		return shim.Error("Marble does not exist: " + marbleTransferInput.Name)
+		return nil, fmt.Errorf("Marble does not exist: %s", marbleName)
 	}
 
 	marbleToTransfer := marble{}
 	err = json.Unmarshal(marbleAsBytes, &marbleToTransfer) //unmarshal it aka JSON.parse()
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
+	}
+
+	// ==== Only the owning org sells, and to another org ====
+	err = authorizeMarbleSeller(&marbleToTransfer, sellerMSPID)
+	if err != nil {
+		return nil, err
+	}
+	if buyerMSPID == sellerMSPID {
+		return nil, fmt.Errorf("Seller and buyer must be different orgs")
+	}
+
+	// ==== Both orgs must have agreed on the same price and trade id ====
+	agreement, err := verifyPriceAgreement(stub, marbleToTransfer.Name, sellerMSPID, buyerMSPID)
+	if err != nil {
+		return nil, err
 	}
-	marbleToTransfer.Owner = marbleTransferInput.Owner //change the owner
+
+	transfer := &privateTransfer{Name: marbleToTransfer.Name, PreviousOwner: marbleToTransfer.Owner, Owner: newOwner, Price: agreement.Price}
+	marbleToTransfer.Owner = newOwner //change the owner
+	marbleToTransfer.OwnerMSP = buyerMSPID
 
 	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
 	err = stub.PutPrivateData("collectionMarbles", marbleToTransfer.Name, marbleJSONasBytes) //rewrite the marble
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
-	fmt.Println("- end transferMarble (success)")
-	return shim.Success(nil)
+	err = clearPriceAgreement(stub, marbleToTransfer.Name, sellerMSPID, buyerMSPID)
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
 }
 
 // ===========================================================================================
@@ -500,6 +618,11 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
+	err := authorizeCollectionRead(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	startKey := args[0]
 	endKey := args[1]
 
@@ -568,6 +691,11 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
+	err := authorizeCollectionRead(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	owner := strings.ToLower(args[0])
 
 	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
@@ -594,6 +722,11 @@ func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
+	err := authorizeCollectionRead(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
 	queryString := args[0]
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
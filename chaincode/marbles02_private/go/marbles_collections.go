@@ -0,0 +1,118 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+//go:generate go run gen_collections_config.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ==== Collection membership ==================================================================
+// The peer answers reads of a collection it is not a member of with an opaque error or an
+// empty result, and quietly drops writes it cannot store. The chaincode instead checks the
+// client's org, from its certificate, against the members of each collection, taken from the
+// collection policies in collections_config.json, which is embedded by go generate into
+// collections_config_gen.go.
+//
+// Fabric 1.4 does not tell the chaincode which org the endorsing peer belongs to, so the peer is
+// never trusted for authorization. When the peer does pass CORE_PEER_LOCALMSPID to its chaincode
+// containers, it is only used as a hint to fail early on a peer that could not store the data.
+// =============================================================================================
+
+// unauthorizedStatus is the response status of calls refused by collection membership
+const unauthorizedStatus = 403
+
+type collectionConfig struct {
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+}
+
+// memberPattern picks the MSP ids out of a policy such as OR('Org1MSP.member', 'Org2MSP.member')
+var memberPattern = regexp.MustCompile(`'([^'.]+)\.[a-z]+'`)
+
+// collectionMembers maps each collection to the set of MSP ids that are members of it
+var collectionMembers = parseCollectionMembers(collectionsConfigJSON)
+
+func parseCollectionMembers(configJSON string) map[string]map[string]bool {
+	var collections []collectionConfig
+	err := json.Unmarshal([]byte(configJSON), &collections)
+	if err != nil {
+		panic(fmt.Sprintf("Embedded collections config is invalid: %s", err))
+	}
+
+	members := map[string]map[string]bool{}
+	for _, collection := range collections {
+		members[collection.Name] = map[string]bool{}
+		for _, match := range memberPattern.FindAllStringSubmatch(collection.Policy, -1) {
+			members[collection.Name][match[1]] = true
+		}
+	}
+	return members
+}
+
+// unauthorized builds the response for a call refused by collection membership
+func unauthorized(message string) pb.Response {
+	return pb.Response{Status: unauthorizedStatus, Message: "UNAUTHORIZED: " + message}
+}
+
+// authorizeCollectionRead fails unless the caller's org is a member of the collection
+func authorizeCollectionRead(stub shim.ChaincodeStubInterface, collection string) error {
+	clientMSPID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return fmt.Errorf("cannot determine the client org: %s", err.Error())
+	}
+	if !collectionMembers[collection][clientMSPID] {
+		return fmt.Errorf("org %s is not a member of %s", clientMSPID, collection)
+	}
+	return nil
+}
+
+// authorizeCollectionWrite fails unless the caller's org is a member of every collection a
+// transaction writes, or the endorsing peer is known not to be one
+func authorizeCollectionWrite(stub shim.ChaincodeStubInterface, collections ...string) error {
+	clientMSPID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return fmt.Errorf("cannot determine the client org: %s", err.Error())
+	}
+	peerMSPID := getPeerMSPIDHint()
+	for _, collection := range collections {
+		if !collectionMembers[collection][clientMSPID] {
+			return fmt.Errorf("org %s is not a member of %s", clientMSPID, collection)
+		}
+		if peerMSPID != "" && !collectionMembers[collection][peerMSPID] {
+			return fmt.Errorf("peer of org %s is not a member of %s", peerMSPID, collection)
+		}
+	}
+	return nil
+}
+
+// getClientMSPID returns the caller's org, which private data of the caller's own org is
+// written for, failing when the endorsing peer is known to belong to another org
+func getClientMSPID(stub shim.ChaincodeStubInterface) (string, error) {
+	clientMSPID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get client MSP id: %s", err.Error())
+	}
+	if peerMSPID := getPeerMSPIDHint(); peerMSPID != "" && peerMSPID != clientMSPID {
+		return "", fmt.Errorf("Client from org %s must use a peer of its own org, not of %s", clientMSPID, peerMSPID)
+	}
+	return clientMSPID, nil
+}
+
+// getPeerMSPIDHint returns the MSP id of the endorsing peer if the peer passed it to the
+// chaincode container, which Fabric 1.4 peers do not do by default, and "" otherwise
+func getPeerMSPIDHint() string {
+	return os.Getenv("CORE_PEER_LOCALMSPID")
+}
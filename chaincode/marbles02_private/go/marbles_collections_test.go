@@ -0,0 +1,39 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCollectionWritesAuthorizeTheClientOrg(t *testing.T) {
+	s := newTestStub()
+	input := `{"name":"marble1","color":"blue","size":35,"owner":"tom","price":99}`
+
+	// ==== Fabric 1.4 peers do not pass their MSP id, the client's org decides ====
+	expectError(t, s.invoke(newCreator(t, "Org2MSP", "jerry", nil), "", "initMarble", "marble", input), "org Org2MSP is not a member of collectionMarblePrivateDetails")
+	expectSuccess(t, s.invoke(newCreator(t, "Org1MSP", "tom", nil), "", "initMarble", "marble", input))
+	if m := readTestMarble(t, s, "marble1"); m.OwnerMSP != "Org1MSP" {
+		t.Fatalf("expected the marble to be bound to the client's org, got %q", m.OwnerMSP)
+	}
+
+	// ==== A known peer MSP id only rejects early ====
+	input = `{"name":"marble2","color":"red","size":50,"owner":"tom","price":10}`
+	expectError(t, s.invoke(newCreator(t, "Org1MSP", "tom", nil), "Org2MSP", "initMarble", "marble", input), "peer of org Org2MSP")
+	expectError(t, s.invoke(newCreator(t, "Org2MSP", "jerry", nil), "Org1MSP", "initMarble", "marble", input), "org Org2MSP is not a member")
+}
+
+func TestPriceAgreementsUseTheClientOrg(t *testing.T) {
+	s := newTestStub()
+	seller := newCreator(t, "Org1MSP", "tom", nil)
+	expectSuccess(t, s.invoke(seller, "", "initMarble", "marble", `{"name":"marble1","color":"blue","size":35,"owner":"tom","price":99}`))
+	expectSuccess(t, s.invoke(seller, "", "agreeToSell", "marble_price", `{"name":"marble1","price":150,"tradeId":"t1"}`))
+	if len(s.PvtState["collectionPriceAgreementOrg1MSP"]) != 1 {
+		t.Fatal("expected the agreement in the client org's collection")
+	}
+	expectError(t, s.invoke(seller, "Org2MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":150,"tradeId":"t1"}`), "must use a peer of its own org")
+}
@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type colorTransferReport struct {
+	Color       string            `json:"color"`
+	Owner       string            `json:"owner"`
+	Transferred []privateTransfer `json:"transferred"`
+}
+
+// ==== Example: GetPrivateDataByPartialCompositeKey/RangeQuery ================================
+// transferMarblesBasedOnColor sells every private marble of a color owned by the seller's org
+// to a new owner, skipping marbles of other orgs and marbles not bound to an org.
+// Uses a GetPrivateDataByPartialCompositeKey (range query) against the color~name 'index'
+// in collectionMarbles. Each marble needs its own price agreement between the two orgs, as
+// for transferMarble. The transfer is all or nothing: if any of the seller's marbles cannot be
+// moved the function returns an error, so none of the writes of the transaction are committed.
+// Note that, unlike range queries on public state, range queries on private data are not
+// re-executed at commit time, so marbles added concurrently are simply not included.
+// =============================================================================================
+func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	fmt.Println("- start transfer marbles based on color")
+
+	type marbleColorTransferTransientInput struct {
+		Color    string `json:"color"`
+		Owner    string `json:"owner"`
+		BuyerMSP string `json:"buyerMSP"`
+	}
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Private marble data must be passed in transient map.")
+	}
+
+	err := authorizeCollectionWrite(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Error getting transient: " + err.Error())
+	}
+
+	if _, ok := transMap["marble_color_owner"]; !ok {
+		return shim.Error("marble_color_owner must be a key in the transient map")
+	}
+
+	if len(transMap["marble_color_owner"]) == 0 {
+		return shim.Error("marble_color_owner value in the transient map must be a non-empty JSON string")
+	}
+
+	var colorTransferInput marbleColorTransferTransientInput
+	err = json.Unmarshal(transMap["marble_color_owner"], &colorTransferInput)
+	if err != nil {
+		return shim.Error("Failed to decode JSON of: " + string(transMap["marble_color_owner"]))
+	}
+
+	if len(colorTransferInput.Color) == 0 {
+		return shim.Error("color field must be a non-empty string")
+	}
+	if len(colorTransferInput.Owner) == 0 {
+		return shim.Error("owner field must be a non-empty string")
+	}
+	if len(colorTransferInput.BuyerMSP) == 0 {
+		return shim.Error("buyerMSP field must be a non-empty string")
+	}
+
+	// ==== The seller's org transfers ====
+	sellerMSPID, err := getClientMSPID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Query the color~name index by color
+	// This will execute a key range query on all keys starting with 'color'
+	coloredMarbleResultsIterator, err := stub.GetPrivateDataByPartialCompositeKey("collectionMarbles", "color~name", []string{colorTransferInput.Color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer coloredMarbleResultsIterator.Close()
+
+	report := &colorTransferReport{Color: colorTransferInput.Color, Owner: colorTransferInput.Owner, Transferred: []privateTransfer{}}
+	for coloredMarbleResultsIterator.HasNext() {
+		// Note that we don't get the value (2nd return variable), we'll just get the marble name from the composite key
+		responseRange, err := coloredMarbleResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// get the color and name from color~name composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		returnedMarbleName := compositeKeyParts[1]
+
+		// Only the seller's org's own marbles of the color are for sale
+		marbleAsBytes, err := stub.GetPrivateData("collectionMarbles", returnedMarbleName)
+		if err != nil {
+			return shim.Error("Failed to get marble: " + err.Error())
+		} else if marbleAsBytes == nil {
+			continue
+		}
+		coloredMarble := marble{}
+		err = json.Unmarshal(marbleAsBytes, &coloredMarble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if coloredMarble.OwnerMSP != sellerMSPID {
+			continue
+		}
+
+		// Re-use the same function that is used to transfer individual marbles.
+		// If any transfer fails, return an error so that none of the transfers are committed
+		transfer, err := sellPrivateMarble(stub, returnedMarbleName, colorTransferInput.Owner, sellerMSPID, colorTransferInput.BuyerMSP)
+		if err != nil {
+			return shim.Error("Transfer of " + returnedMarbleName + " failed, no marbles were transferred: " + err.Error())
+		}
+		report.Transferred = append(report.Transferred, *transfer)
+	}
+
+	reportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- end transferMarblesBasedOnColor: %d %s marbles to %s\n", len(report.Transferred), report.Color, report.Owner)
+	return shim.Success(reportAsBytes)
+}
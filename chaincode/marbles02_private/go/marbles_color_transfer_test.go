@@ -0,0 +1,96 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTransferMarblesBasedOnColor(t *testing.T) {
+	s := newTestStub()
+	seller := newCreator(t, "Org1MSP", "tom", nil)
+	buyer := newCreator(t, "Org2MSP", "jerry", nil)
+	expectSuccess(t, s.invoke(seller, "Org1MSP", "initMarble", "marble", `{"name":"marble1","color":"blue","size":35,"owner":"tom","price":99}`))
+	expectSuccess(t, s.invoke(seller, "Org1MSP", "initMarble", "marble", `{"name":"marble2","color":"blue","size":50,"owner":"tom","price":10}`))
+	expectSuccess(t, s.invoke(seller, "Org1MSP", "initMarble", "marble", `{"name":"marble3","color":"red","size":70,"owner":"tom","price":5}`))
+	transfer := `{"color":"blue","owner":"jerry","buyerMSP":"Org2MSP"}`
+
+	expectError(t, s.invoke(seller, "Org1MSP", "transferMarblesBasedOnColor", "marble_color_owner", `{"color":"blue","owner":"jerry"}`), "buyerMSP field")
+	expectError(t, s.invoke(seller, "Org1MSP", "transferMarblesBasedOnColor", "marble_color_owner", `{"color":"blue","owner":"spike","buyerMSP":"Org1MSP"}`), "different orgs")
+
+	// ==== A marble without agreements fails the whole transfer ====
+	for _, name := range []string{"marble1", "marble2"} {
+		expectSuccess(t, s.invoke(seller, "Org1MSP", "agreeToSell", "marble_price", `{"name":"`+name+`","price":20,"tradeId":"t1"}`))
+	}
+	expectSuccess(t, s.invoke(buyer, "Org2MSP", "agreeToBuy", "marble_price", `{"name":"marble1","price":20,"tradeId":"t1"}`))
+	expectError(t, s.invoke(seller, "Org1MSP", "transferMarblesBasedOnColor", "marble_color_owner", transfer), "Transfer of marble2 failed, no marbles were transferred")
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "tom" || m.OwnerMSP != "Org1MSP" {
+		t.Fatalf("expected marble1 to stay with tom after the failed transfer, got %+v", m)
+	}
+
+	// ==== With every agreement in place all blue marbles move ====
+	expectSuccess(t, s.invoke(buyer, "Org2MSP", "agreeToBuy", "marble_price", `{"name":"marble2","price":20,"tradeId":"t1"}`))
+	payload := expectSuccess(t, s.invoke(seller, "Org1MSP", "transferMarblesBasedOnColor", "marble_color_owner", transfer))
+	report := colorTransferReport{}
+	if err := json.Unmarshal(payload, &report); err != nil {
+		t.Fatalf("unexpected report %s: %s", payload, err)
+	}
+	if report.Color != "blue" || report.Owner != "jerry" || len(report.Transferred) != 2 {
+		t.Fatalf("expected two blue marbles in the report, got %+v", report)
+	}
+	for i, name := range []string{"marble1", "marble2"} {
+		moved := report.Transferred[i]
+		if moved.Name != name || moved.PreviousOwner != "tom" || moved.Owner != "jerry" || moved.Price != 20 {
+			t.Fatalf("unexpected report entry %+v", moved)
+		}
+		if m := readTestMarble(t, s, name); m.Owner != "jerry" || m.OwnerMSP != "Org2MSP" {
+			t.Fatalf("expected %s to belong to jerry of Org2MSP, got %+v", name, m)
+		}
+	}
+	if m := readTestMarble(t, s, "marble3"); m.Owner != "tom" {
+		t.Fatalf("expected the red marble to stay with tom, got %+v", m)
+	}
+}
+
+func TestTransferMarblesBasedOnColorReportsNoMatches(t *testing.T) {
+	s := newTestStub()
+	payload := expectSuccess(t, s.invoke(newCreator(t, "Org1MSP", "tom", nil), "Org1MSP", "transferMarblesBasedOnColor", "marble_color_owner", `{"color":"green","owner":"jerry","buyerMSP":"Org2MSP"}`))
+	report := colorTransferReport{}
+	if err := json.Unmarshal(payload, &report); err != nil || report.Transferred == nil || len(report.Transferred) != 0 {
+		t.Fatalf("expected an empty report, got %s", payload)
+	}
+}
+
+func TestTransferMarblesBasedOnColorSkipsOtherOrgsMarbles(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	jerry := newCreator(t, "Org2MSP", "jerry", nil)
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "initMarble", "marble", `{"name":"marble1","color":"blue","size":35,"owner":"tom","price":99}`))
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "initMarble", "marble", `{"name":"marble2","color":"blue","size":50,"owner":"tom","price":10}`))
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble2","price":10,"tradeId":"t0"}`))
+	expectSuccess(t, s.invoke(jerry, "Org2MSP", "agreeToBuy", "marble_price", `{"name":"marble2","price":10,"tradeId":"t0"}`))
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "transferMarble", "marble_owner", `{"name":"marble2","owner":"jerry","buyerMSP":"Org2MSP"}`))
+
+	// ==== A blue marble the buyer's org already owns neither fails nor joins the sale ====
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":20,"tradeId":"t1"}`))
+	expectSuccess(t, s.invoke(jerry, "Org2MSP", "agreeToBuy", "marble_price", `{"name":"marble1","price":20,"tradeId":"t1"}`))
+	payload := expectSuccess(t, s.invoke(tom, "Org1MSP", "transferMarblesBasedOnColor", "marble_color_owner", `{"color":"blue","owner":"jerry","buyerMSP":"Org2MSP"}`))
+	report := colorTransferReport{}
+	if err := json.Unmarshal(payload, &report); err != nil || len(report.Transferred) != 1 || report.Transferred[0].Name != "marble1" {
+		t.Fatalf("expected only marble1 in the report, got %s", payload)
+	}
+
+	// ==== Nor does another org's marble the seller once had ====
+	payload = expectSuccess(t, s.invoke(tom, "Org1MSP", "transferMarblesBasedOnColor", "marble_color_owner", `{"color":"blue","owner":"jerry","buyerMSP":"Org2MSP"}`))
+	if err := json.Unmarshal(payload, &report); err != nil || len(report.Transferred) != 0 {
+		t.Fatalf("expected an empty report, got %s", payload)
+	}
+	if m := readTestMarble(t, s, "marble2"); m.Owner != "jerry" || m.OwnerMSP != "Org2MSP" {
+		t.Fatalf("expected marble2 to stay with jerry, got %+v", m)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ==== Price agreements =======================================================================
+// A private sale needs the seller and the buyer to agree on a price without either writing it
+// anywhere the other org, or the rest of the channel, could read. Each side writes the agreed
+// price and a trade id into a collection only its own org is a member of, collectionPriceAgreement
+// followed by the MSP id, defined in collections_config.json since the implicit org collections
+// only exist on Fabric 2.0 and later. Only the hashes of those writes are shared with the channel,
+// so transferMarble compares them with GetPrivateDataHash and only moves the marble when both
+// sides agreed on exactly the same price and trade id.
+//
+// Marbles are bound to the org that created or bought them. Only a client of that org may agree
+// to sell a marble or transfer it, and only to a different org. Marbles created before owning
+// orgs were recorded cannot be sold until an admin of the org holding them binds them to it
+// with bindMarbleOwner.
+// =============================================================================================
+
+type priceAgreement struct {
+	Name    string `json:"name"`
+	Price   int    `json:"price"`
+	TradeID string `json:"tradeId"`
+}
+
+const (
+	agreementSell = "sell"
+	agreementBuy  = "buy"
+)
+
+// ============================================================
+// agreeToSell - record the price the seller's org agrees to sell a marble for
+// ============================================================
+func (t *SimpleChaincode) agreeToSell(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return recordPriceAgreement(stub, args, agreementSell)
+}
+
+// ============================================================
+// agreeToBuy - record the price the buyer's org agrees to buy a marble for
+// ============================================================
+func (t *SimpleChaincode) agreeToBuy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return recordPriceAgreement(stub, args, agreementBuy)
+}
+
+// recordPriceAgreement writes one side of a price agreement, passed in the marble_price
+// transient field, to the caller's org agreement collection
+func recordPriceAgreement(stub shim.ChaincodeStubInterface, args []string, side string) pb.Response {
+	fmt.Println("- start agree to " + side)
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Private price agreement must be passed in transient map.")
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Error getting transient: " + err.Error())
+	}
+
+	if _, ok := transMap["marble_price"]; !ok {
+		return shim.Error("marble_price must be a key in the transient map")
+	}
+
+	if len(transMap["marble_price"]) == 0 {
+		return shim.Error("marble_price value in the transient map must be a non-empty JSON string")
+	}
+
+	var agreement priceAgreement
+	err = json.Unmarshal(transMap["marble_price"], &agreement)
+	if err != nil {
+		return shim.Error("Failed to decode JSON of: " + string(transMap["marble_price"]))
+	}
+
+	if len(agreement.Name) == 0 {
+		return shim.Error("name field must be a non-empty string")
+	}
+	if agreement.Price <= 0 {
+		return shim.Error("price field must be a positive integer")
+	}
+	if len(agreement.TradeID) == 0 {
+		return shim.Error("tradeId field must be a non-empty string")
+	}
+
+	err = authorizeCollectionRead(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
+	marbleAsBytes, err := stub.GetPrivateData("collectionMarbles", agreement.Name)
+	if err != nil {
+		return shim.Error("Failed to get marble: " + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist: " + agreement.Name)
+	}
+	agreed := marble{}
+	err = json.Unmarshal(marbleAsBytes, &agreed)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	clientMSPID, err := getClientMSPID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== The owning org sells, any other org buys ====
+	if side == agreementSell {
+		err = authorizeMarbleSeller(&agreed, clientMSPID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else if agreed.OwnerMSP == clientMSPID {
+		return shim.Error("Org " + clientMSPID + " already owns " + agreement.Name)
+	}
+	collection, err := priceAgreementCollection(clientMSPID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Re-marshal the decoded agreement, so that both sides hash the same canonical JSON
+	// however their clients formatted it
+	agreementAsBytes, err := json.Marshal(agreement)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementKey, err := stub.CreateCompositeKey("priceAgreement", []string{side, agreement.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutPrivateData(collection, agreementKey, agreementAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end agree to " + side)
+	return shim.Success(nil)
+}
+
+// verifyPriceAgreement checks that the seller and the buyer recorded identical agreements for
+// a marble and returns the agreed terms, read from the seller's side
+func verifyPriceAgreement(stub shim.ChaincodeStubInterface, marbleName string, sellerMSPID string, buyerMSPID string) (*priceAgreement, error) {
+	sellKey, err := stub.CreateCompositeKey("priceAgreement", []string{agreementSell, marbleName})
+	if err != nil {
+		return nil, err
+	}
+	buyKey, err := stub.CreateCompositeKey("priceAgreement", []string{agreementBuy, marbleName})
+	if err != nil {
+		return nil, err
+	}
+
+	sellCollection, err := priceAgreementCollection(sellerMSPID)
+	if err != nil {
+		return nil, err
+	}
+	buyCollection, err := priceAgreementCollection(buyerMSPID)
+	if err != nil {
+		return nil, err
+	}
+
+	sellHash, err := stub.GetPrivateDataHash(sellCollection, sellKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get seller agreement hash: %s", err.Error())
+	} else if sellHash == nil {
+		return nil, fmt.Errorf("%s has not agreed to sell %s", sellerMSPID, marbleName)
+	}
+	buyHash, err := stub.GetPrivateDataHash(buyCollection, buyKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get buyer agreement hash: %s", err.Error())
+	} else if buyHash == nil {
+		return nil, fmt.Errorf("%s has not agreed to buy %s", buyerMSPID, marbleName)
+	}
+	if !bytes.Equal(sellHash, buyHash) {
+		return nil, fmt.Errorf("Seller and buyer have not agreed on the same price and trade id for %s", marbleName)
+	}
+
+	// The seller's peer is a member of the seller's agreement collection, so it can read the terms
+	agreementAsBytes, err := stub.GetPrivateData(sellCollection, sellKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get seller agreement: %s", err.Error())
+	}
+	agreement := &priceAgreement{}
+	err = json.Unmarshal(agreementAsBytes, agreement)
+	if err != nil {
+		return nil, err
+	}
+	return agreement, nil
+}
+
+// clearPriceAgreement deletes both sides of a price agreement once the sale went through
+func clearPriceAgreement(stub shim.ChaincodeStubInterface, marbleName string, sellerMSPID string, buyerMSPID string) error {
+	for side, mspID := range map[string]string{agreementSell: sellerMSPID, agreementBuy: buyerMSPID} {
+		agreementKey, err := stub.CreateCompositeKey("priceAgreement", []string{side, marbleName})
+		if err != nil {
+			return err
+		}
+		collection, err := priceAgreementCollection(mspID)
+		if err != nil {
+			return err
+		}
+		err = stub.DelPrivateData(collection, agreementKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// priceAgreementCollection returns the collection an org keeps its side of price agreements in,
+// failing unless it is configured with that org as its only member
+func priceAgreementCollection(mspID string) (string, error) {
+	collection := "collectionPriceAgreement" + mspID
+	members, ok := collectionMembers[collection]
+	if !ok || len(members) != 1 || !members[mspID] {
+		return "", fmt.Errorf("No price agreement collection is configured for org %s", mspID)
+	}
+	return collection, nil
+}
+
+// authorizeMarbleSeller fails unless the marble is bound to the selling org
+func authorizeMarbleSeller(m *marble, sellerMSPID string) error {
+	if m.OwnerMSP == "" {
+		return fmt.Errorf("Marble %s is not bound to an owning org", m.Name)
+	}
+	if m.OwnerMSP != sellerMSPID {
+		return fmt.Errorf("Marble %s is owned by org %s, not %s", m.Name, m.OwnerMSP, sellerMSPID)
+	}
+	return nil
+}
+
+// ============================================================
+// bindMarbleOwner - admin only, bind a marble created before owning orgs were recorded to the
+// admin's org, passed as the marble_bind transient field
+// ============================================================
+func (t *SimpleChaincode) bindMarbleOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start bind marble owner")
+
+	type marbleBindTransientInput struct {
+		Name string `json:"name"`
+	}
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Private marble name must be passed in transient map.")
+	}
+
+	err := authorizeCollectionWrite(stub, "collectionMarbles")
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
+	err = cid.AssertAttributeValue(stub, "hf.Type", "admin")
+	if err != nil {
+		return shim.Error("Caller is not an admin: " + err.Error())
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Error getting transient: " + err.Error())
+	}
+
+	if _, ok := transMap["marble_bind"]; !ok {
+		return shim.Error("marble_bind must be a key in the transient map")
+	}
+
+	if len(transMap["marble_bind"]) == 0 {
+		return shim.Error("marble_bind value in the transient map must be a non-empty JSON string")
+	}
+
+	var marbleBindInput marbleBindTransientInput
+	err = json.Unmarshal(transMap["marble_bind"], &marbleBindInput)
+	if err != nil {
+		return shim.Error("Failed to decode JSON of: " + string(transMap["marble_bind"]))
+	}
+
+	if len(marbleBindInput.Name) == 0 {
+		return shim.Error("name field must be a non-empty string")
+	}
+
+	marbleAsBytes, err := stub.GetPrivateData("collectionMarbles", marbleBindInput.Name)
+	if err != nil {
+		return shim.Error("Failed to get marble: " + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist: " + marbleBindInput.Name)
+	}
+	legacyMarble := marble{}
+	err = json.Unmarshal(marbleAsBytes, &legacyMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if legacyMarble.OwnerMSP != "" {
+		return shim.Error("Marble is already bound to org " + legacyMarble.OwnerMSP + ": " + marbleBindInput.Name)
+	}
+
+	legacyMarble.OwnerMSP, err = getClientMSPID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleJSONasBytes, err := json.Marshal(legacyMarble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutPrivateData("collectionMarbles", legacyMarble.Name, marbleJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end bind marble owner")
+	return shim.Success(nil)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTransferNeedsMatchingPriceAgreements(t *testing.T) {
+	s := newTestStub()
+	seller := newCreator(t, "Org1MSP", "tom", nil)
+	buyer := newCreator(t, "Org2MSP", "jerry", nil)
+	expectSuccess(t, s.invoke(seller, "Org1MSP", "initMarble", "marble", `{"name":"marble1","color":"blue","size":35,"owner":"tom","price":99}`))
+	if m := readTestMarble(t, s, "marble1"); m.OwnerMSP != "Org1MSP" {
+		t.Fatalf("expected the marble to be bound to the creator's org, got %q", m.OwnerMSP)
+	}
+	transfer := `{"name":"marble1","owner":"jerry","buyerMSP":"Org2MSP"}`
+
+	// ==== Each side agrees for its own org only ====
+	expectError(t, s.invoke(buyer, "Org2MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":150,"tradeId":"t1"}`), "owned by org Org1MSP")
+	expectError(t, s.invoke(seller, "Org1MSP", "agreeToBuy", "marble_price", `{"name":"marble1","price":150,"tradeId":"t1"}`), "already owns")
+	expectSuccess(t, s.invoke(seller, "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":150,"tradeId":"t1"}`))
+	expectError(t, s.invoke(seller, "Org1MSP", "transferMarble", "marble_owner", transfer), "Org2MSP has not agreed to buy")
+
+	expectSuccess(t, s.invoke(buyer, "Org2MSP", "agreeToBuy", "marble_price", `{"tradeId":"t1","price":140,"name":"marble1"}`))
+	expectError(t, s.invoke(seller, "Org1MSP", "transferMarble", "marble_owner", transfer), "not agreed on the same price")
+	expectSuccess(t, s.invoke(buyer, "Org2MSP", "agreeToBuy", "marble_price", `{"tradeId":"t1","price":150,"name":"marble1"}`))
+
+	// ==== The owning org does not sell to itself ====
+	expectError(t, s.invoke(seller, "Org1MSP", "transferMarble", "marble_owner", `{"name":"marble1","owner":"spike","buyerMSP":"Org1MSP"}`), "different orgs")
+	expectSuccess(t, s.invoke(seller, "Org1MSP", "transferMarble", "marble_owner", transfer))
+
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "jerry" || m.OwnerMSP != "Org2MSP" {
+		t.Fatalf("expected marble1 to belong to jerry of Org2MSP, got %+v", m)
+	}
+	details := marblePrivateDetails{}
+	err := json.Unmarshal(s.PvtState["collectionMarblePrivateDetails"]["marble1"], &details)
+	if err != nil || details.Price != 99 {
+		t.Fatalf("expected the sale to leave the private details alone, got %+v", details)
+	}
+	if len(s.PvtState["collectionPriceAgreementOrg1MSP"]) != 0 || len(s.PvtState["collectionPriceAgreementOrg2MSP"]) != 0 {
+		t.Fatal("expected both agreements to be cleared after the sale")
+	}
+
+	// ==== The previous owner's org can no longer sell it ====
+	expectError(t, s.invoke(seller, "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":1,"tradeId":"t2"}`), "owned by org Org2MSP")
+}
+
+func TestPriceAgreementCollections(t *testing.T) {
+	if collection, err := priceAgreementCollection("Org2MSP"); err != nil || collection != "collectionPriceAgreementOrg2MSP" {
+		t.Fatalf("unexpected collection %s: %v", collection, err)
+	}
+	for _, mspID := range []string{"Org3MSP", "Marbles"} {
+		if _, err := priceAgreementCollection(mspID); err == nil {
+			t.Fatalf("expected no agreement collection for %s", mspID)
+		}
+	}
+
+	s := newTestStub()
+	legacy, _ := json.Marshal(&marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "tom"})
+	s.PvtState["collectionMarbles"] = map[string][]byte{"marble1": legacy}
+	expectError(t, s.invoke(newCreator(t, "Org1MSP", "tom", nil), "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":1,"tradeId":"t1"}`), "not bound to an owning org")
+}
+
+func TestResaleReturnsMarbleToFirstOrg(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	jerry := newCreator(t, "Org2MSP", "jerry", nil)
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "initMarble", "marble", `{"name":"marble1","color":"blue","size":35,"owner":"tom","price":99}`))
+
+	// ==== Org1 sells to Org2 ====
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":150,"tradeId":"t1"}`))
+	expectSuccess(t, s.invoke(jerry, "Org2MSP", "agreeToBuy", "marble_price", `{"name":"marble1","price":150,"tradeId":"t1"}`))
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "transferMarble", "marble_owner", `{"name":"marble1","owner":"jerry","buyerMSP":"Org2MSP"}`))
+
+	// ==== Org2, outside collectionMarblePrivateDetails, sells it back ====
+	expectSuccess(t, s.invoke(jerry, "Org2MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":160,"tradeId":"t2"}`))
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "agreeToBuy", "marble_price", `{"name":"marble1","price":160,"tradeId":"t2"}`))
+	expectSuccess(t, s.invoke(jerry, "Org2MSP", "transferMarble", "marble_owner", `{"name":"marble1","owner":"tom","buyerMSP":"Org1MSP"}`))
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "tom" || m.OwnerMSP != "Org1MSP" {
+		t.Fatalf("expected marble1 to be back with tom of Org1MSP, got %+v", m)
+	}
+
+	// ==== And back to Org2 again, which may then delete it ====
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":170,"tradeId":"t3"}`))
+	expectSuccess(t, s.invoke(jerry, "Org2MSP", "agreeToBuy", "marble_price", `{"name":"marble1","price":170,"tradeId":"t3"}`))
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "transferMarble", "marble_owner", `{"name":"marble1","owner":"jerry","buyerMSP":"Org2MSP"}`))
+	expectSuccess(t, s.invoke(jerry, "Org2MSP", "delete", "marble_delete", `{"name":"marble1"}`))
+	if s.PvtState["collectionMarbles"]["marble1"] != nil {
+		t.Fatal("expected marble1 to be deleted")
+	}
+}
+
+func TestBindLegacyMarbleOwner(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	admin := newCreator(t, "Org1MSP", "admin", map[string]string{"hf.Type": "admin"})
+	legacy, _ := json.Marshal(&marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "tom"})
+	s.PvtState["collectionMarbles"] = map[string][]byte{"marble1": legacy}
+
+	expectError(t, s.invoke(tom, "Org1MSP", "bindMarbleOwner", "marble_bind", `{"name":"marble1"}`), "not an admin")
+	expectError(t, s.invoke(admin, "Org1MSP", "bindMarbleOwner", "marble_bind", `{"name":"marble2"}`), "does not exist")
+	expectSuccess(t, s.invoke(admin, "Org1MSP", "bindMarbleOwner", "marble_bind", `{"name":"marble1"}`))
+	expectError(t, s.invoke(admin, "Org1MSP", "bindMarbleOwner", "marble_bind", `{"name":"marble1"}`), "already bound to org Org1MSP")
+
+	if m := readTestMarble(t, s, "marble1"); m.Owner != "tom" || m.OwnerMSP != "Org1MSP" {
+		t.Fatalf("expected marble1 to be bound to Org1MSP, got %+v", m)
+	}
+	expectSuccess(t, s.invoke(tom, "Org1MSP", "agreeToSell", "marble_price", `{"name":"marble1","price":1,"tradeId":"t1"}`))
+}
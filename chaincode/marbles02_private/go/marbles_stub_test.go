@@ -0,0 +1,214 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub completes shim.MockStub for the private marbles functions: it carries the creator,
+// transient data and endorsing peer org of each call, and implements private data hashes,
+// deletes and partial composite key scans
+type testStub struct {
+	*shim.MockStub
+	cc        *SimpleChaincode
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+	txCount   int
+}
+
+func newTestStub() *testStub {
+	cc := new(SimpleChaincode)
+	return &testStub{MockStub: shim.NewMockStub("marblesp", cc), cc: cc}
+}
+
+// invoke runs one transaction submitted by creator to a peer of peerMSPID, with transient data
+// of the given key and JSON value. As on a peer, the private writes of a failed transaction are
+// discarded
+func (s *testStub) invoke(creator []byte, peerMSPID string, function string, transientKey string, transientValue string) pb.Response {
+	s.txCount++
+	txID := fmt.Sprintf("tx%d", s.txCount)
+	s.args = [][]byte{[]byte(function)}
+	s.creator = creator
+	s.transient = map[string][]byte{}
+	if transientKey != "" {
+		s.transient[transientKey] = []byte(transientValue)
+	}
+	os.Setenv("CORE_PEER_LOCALMSPID", peerMSPID)
+	defer os.Unsetenv("CORE_PEER_LOCALMSPID")
+	committed := map[string]map[string][]byte{}
+	for collection, values := range s.PvtState {
+		committed[collection] = map[string][]byte{}
+		for key, value := range values {
+			committed[collection][key] = value
+		}
+	}
+	s.MockTransactionStart(txID)
+	defer s.MockTransactionEnd(txID)
+	resp := s.cc.Invoke(s)
+	if resp.Status >= shim.ERRORTHRESHOLD {
+		s.PvtState = committed
+	}
+	return resp
+}
+
+func (s *testStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *testStub) GetStringArgs() []string {
+	args := []string{}
+	for _, arg := range s.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	return args[0], args[1:]
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *testStub) GetPrivateDataHash(collection, key string) ([]byte, error) {
+	value := s.PvtState[collection][key]
+	if value == nil {
+		return nil, nil
+	}
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+func (s *testStub) DelPrivateData(collection string, key string) error {
+	delete(s.PvtState[collection], key)
+	return nil
+}
+
+func (s *testStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range s.PvtState[collection] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	results := []*queryresult.KV{}
+	for _, key := range keys {
+		results = append(results, &queryresult.KV{Key: key, Value: s.PvtState[collection][key]})
+	}
+	return &sliceIterator{results: results}, nil
+}
+
+type sliceIterator struct {
+	results []*queryresult.KV
+}
+
+func (it *sliceIterator) HasNext() bool {
+	return len(it.results) > 0
+}
+
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	result := it.results[0]
+	it.results = it.results[1:]
+	return result, nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// newCreator returns a serialized identity of mspID named commonName, carrying attrs
+func newCreator(t *testing.T, mspID string, commonName string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if len(attrs) > 0 {
+		attrsAsBytes, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attrsAsBytes}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+func expectSuccess(t *testing.T, resp pb.Response) []byte {
+	t.Helper()
+	if resp.Status != shim.OK {
+		t.Fatalf("expected success, got %d: %s", resp.Status, resp.Message)
+	}
+	return resp.Payload
+}
+
+func expectError(t *testing.T, resp pb.Response, contains string) {
+	t.Helper()
+	if resp.Status == shim.OK {
+		t.Fatalf("expected an error containing %q, got success", contains)
+	}
+	if !strings.Contains(resp.Message, contains) {
+		t.Fatalf("expected an error containing %q, got: %s", contains, resp.Message)
+	}
+}
+
+// readTestMarble reads a marble straight from collectionMarbles
+func readTestMarble(t *testing.T, s *testStub, name string) *marble {
+	t.Helper()
+	m := &marble{}
+	err := json.Unmarshal(s.PvtState["collectionMarbles"][name], m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
@@ -17,6 +17,12 @@ specific language governing permissions and limitations
 under the License.
 */
 
+// This copy is kept for examples/e2e_cli/scripts/script_marbles_private.sh. New deployments should
+// use chaincode/marbles02/go instantiated with the private backend, '{"Args":["init","private","<collection>"]}',
+// which offers the same functions on a private data collection, except readMarblePrivateDetails as prices
+// are not kept there; see marbles_store.go there. Private sales between orgs on agreed prices are only
+// offered by chaincode/marbles02_private.
+
 // ====CHAINCODE EXECUTION SAMPLES (CLI) ==================
 
 // ==== Invoke marbles ====
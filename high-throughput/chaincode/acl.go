@@ -0,0 +1,428 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Ownership and access control. A variable is owned by the client identity that defined it, by its first
+ * update or by declare, and carries an access control list naming who else may:
+ *	- read it: get, getasof, getwindow and deltas
+ *	- write it: update, reserve, commit and release
+ *	- administer it: compact, prunefast, prunesafe, prunebatch, rebalance and delete
+ * Each entry of a list is an MSP id, such as Org1MSP, matching any member of that organization, an attribute
+ * of the client certificate written attr:name=value, or * for any client. Administrators may also read and
+ * write. A new variable may be read and written by the members of its owner's organization, and only
+ * administered by its owner. Only the owner may change the lists with setacl, or hand the variable over with
+ * transferowner, which the new owner completes with acceptowner. Since every update reads the definition row
+ * holding the lists, changing them makes updates in flight at the same time fail.
+ *
+ * The values of the conflict-free data types of crdt.go are owned in the same way, by the client of their
+ * first crdtupdate, with crdtget needing read, crdtupdate write and crdtcompact administer permission. Their
+ * definitions are kept apart from those of variables, keyed by type and name, and setacl, transferowner and
+ * acceptowner take the type as an extra argument to address them.
+ *
+ * Variables created before owners were recorded have no owner. They stay open to any client and cannot be
+ * claimed, since nothing shows who created them; to secure one, copy it to a new name. Values always have an
+ * owner, since they were only introduced with owners.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	permissionRead  = "read"
+	permissionWrite = "write"
+	permissionAdmin = "administer"
+)
+
+// crdtDefinitionIndexName is the composite key under which the owners of conflict-free data type values are stored
+const crdtDefinitionIndexName = "crdtType~name"
+
+// variableACL lists who, besides the owner, may use a variable
+type variableACL struct {
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+	Admin []string `json:"admin"`
+}
+
+/**
+ * Makes the calling client the owner of a new variable, with the default access control list.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the new variable
+ *
+ * @return An error if the client could not be identified
+ */
+func setOwner(APIstub shim.ChaincodeStubInterface, v *variable) error {
+	clientID, err := cid.GetID(APIstub)
+	if err != nil {
+		return fmt.Errorf("Could not identify the client: %s", err.Error())
+	}
+	mspID, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return fmt.Errorf("Could not identify the client organization: %s", err.Error())
+	}
+
+	v.Owner = clientID
+	v.OwnerMSP = mspID
+	v.ACL = &variableACL{Read: []string{mspID}, Write: []string{mspID}, Admin: []string{}}
+	return nil
+}
+
+/**
+ * Retrieves the owner and access control list of a variable, or of a value of a conflict-free data type.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable or value
+ * @param crdtType The type of the value, or empty for a variable
+ *
+ * @return The definition, or nil if there is none
+ */
+func getDefinition(APIstub shim.ChaincodeStubInterface, name string, crdtType string) (*variable, error) {
+	if crdtType == "" {
+		return getVariable(APIstub, name)
+	}
+	if _, ok := crdtTypes[crdtType]; !ok {
+		return nil, fmt.Errorf("Type %s is unrecognized", crdtType)
+	}
+
+	definitionKey, err := APIstub.CreateCompositeKey(crdtDefinitionIndexName, []string{crdtType, name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	definitionBytes, err := APIstub.GetState(definitionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the definition of %s %s: %s", crdtType, name, err.Error())
+	} else if definitionBytes == nil {
+		return nil, nil
+	}
+
+	v := &variable{}
+	err = json.Unmarshal(definitionBytes, v)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode the definition of %s %s: %s", crdtType, name, err.Error())
+	}
+	return v, nil
+}
+
+/**
+ * Stores the owner and access control list of a variable, or of a value of a conflict-free data type.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition to store
+ * @param crdtType The type of the value, or empty for a variable
+ *
+ * @return An error if the definition could not be stored
+ */
+func putDefinition(APIstub shim.ChaincodeStubInterface, v *variable, crdtType string) error {
+	if crdtType == "" {
+		return putVariable(APIstub, v)
+	}
+
+	definitionKey, err := APIstub.CreateCompositeKey(crdtDefinitionIndexName, []string{crdtType, v.Name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+	}
+	definitionBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(definitionKey, definitionBytes)
+}
+
+/**
+ * Checks that the calling client holds a permission on a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param permission One of permissionRead, permissionWrite and permissionAdmin
+ *
+ * @return An error if the client does not hold the permission
+ */
+func authorizeVariable(APIstub shim.ChaincodeStubInterface, v *variable, permission string) error {
+	if v.Owner == "" {
+		return nil
+	}
+	clientID, err := cid.GetID(APIstub)
+	if err != nil {
+		return fmt.Errorf("Could not identify the client: %s", err.Error())
+	}
+	if clientID == v.Owner {
+		return nil
+	}
+
+	entries := []string{}
+	if v.ACL != nil {
+		entries = append(entries, v.ACL.Admin...)
+		switch permission {
+		case permissionRead:
+			entries = append(entries, v.ACL.Read...)
+		case permissionWrite:
+			entries = append(entries, v.ACL.Write...)
+		}
+	}
+	for _, entry := range entries {
+		matched, err := matchACLEntry(APIstub, entry)
+		if err != nil {
+			return err
+		}
+		if matched {
+			return nil
+		}
+	}
+
+	mspID, _ := cid.GetMSPID(APIstub)
+	return fmt.Errorf("Client of %s is not allowed to %s %s", mspID, permission, v.Name)
+}
+
+/**
+ * Checks whether the calling client matches an entry of an access control list.
+ *
+ * @param APIstub The chaincode shim
+ * @param entry An MSP id, attr:name=value or *
+ *
+ * @return true if the client matches the entry
+ */
+func matchACLEntry(APIstub shim.ChaincodeStubInterface, entry string) (bool, error) {
+	if entry == "*" {
+		return true, nil
+	}
+	if strings.HasPrefix(entry, "attr:") {
+		attribute := strings.SplitN(strings.TrimPrefix(entry, "attr:"), "=", 2)
+		if len(attribute) != 2 {
+			return false, fmt.Errorf("Access control entry %s is invalid, expecting attr:name=value", entry)
+		}
+		return cid.AssertAttributeValue(APIstub, attribute[0], attribute[1]) == nil, nil
+	}
+	mspID, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return false, fmt.Errorf("Could not identify the client organization: %s", err.Error())
+	}
+	return mspID == entry, nil
+}
+
+/**
+ * Replaces the access control list of a variable; only its owner may do so. The args array contains
+ * the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> the list as JSON, e.g. {"read":["Org1MSP","Org2MSP"],"write":["Org1MSP"],"admin":["attr:role=operator"]}
+ *	- args[2] -> optional, the type of a conflict-free data type value of that name, see crdt.go
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the setacl invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) setACL(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 2 or 3")
+	}
+
+	name := args[0]
+	acl := &variableACL{}
+	err := json.Unmarshal([]byte(args[1]), acl)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not decode the access control list: %s", err.Error()))
+	}
+	for _, entry := range append(append(append([]string{}, acl.Read...), acl.Write...), acl.Admin...) {
+		if strings.HasPrefix(entry, "attr:") && !strings.Contains(entry, "=") {
+			return shim.Error(fmt.Sprintf("Access control entry %s is invalid, expecting attr:name=value", entry))
+		}
+	}
+
+	crdtType := optionalArg(args, 2)
+	v, errResp := ownedVariable(APIstub, name, crdtType)
+	if errResp != nil {
+		return *errResp
+	}
+
+	v.ACL = acl
+	err = putDefinition(APIstub, v, crdtType)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not update variable %s: %s", name, err.Error()))
+	}
+	return shim.Success([]byte(fmt.Sprintf("Successfully updated the access control list of %s", name)))
+}
+
+/**
+ * Offers the ownership of a variable to another client; only its owner may do so. The offer is completed
+ * by the new owner with acceptowner, and replaces any earlier offer. The args array contains the following
+ * arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> identity of the new owner, as returned to them by whoami
+ *	- args[2] -> optional, the type of a conflict-free data type value of that name, see crdt.go
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the transferowner invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) transferOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 2 or 3")
+	}
+	if len(args[1]) == 0 {
+		return shim.Error("Identity of the new owner must be a non-empty string")
+	}
+
+	name := args[0]
+	crdtType := optionalArg(args, 2)
+	v, errResp := ownedVariable(APIstub, name, crdtType)
+	if errResp != nil {
+		return *errResp
+	}
+
+	v.PendingOwner = args[1]
+	err := putDefinition(APIstub, v, crdtType)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not update variable %s: %s", name, err.Error()))
+	}
+	return shim.Success([]byte(fmt.Sprintf("Ownership of %s offered, waiting for the new owner to accept", name)))
+}
+
+/**
+ * Completes the transfer of a variable to the calling client, who must be the one it was offered to.
+ * The access control list is kept as it is. The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> optional, the type of a conflict-free data type value of that name, see crdt.go
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the acceptowner invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) acceptOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 1 or 2")
+	}
+
+	name := args[0]
+	crdtType := optionalArg(args, 1)
+	v, err := getDefinition(APIstub, name, crdtType)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No %s by the name %s exists", subjectKind(crdtType), name))
+	}
+
+	clientID, err := cid.GetID(APIstub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not identify the client: %s", err.Error()))
+	}
+	if v.PendingOwner == "" || v.PendingOwner != clientID {
+		return shim.Error(fmt.Sprintf("Ownership of %s was not offered to this client", name))
+	}
+	mspID, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not identify the client organization: %s", err.Error()))
+	}
+
+	v.Owner = clientID
+	v.OwnerMSP = mspID
+	v.PendingOwner = ""
+	err = putDefinition(APIstub, v, crdtType)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not update variable %s: %s", name, err.Error()))
+	}
+	return shim.Success([]byte(fmt.Sprintf("Successfully took ownership of %s", name)))
+}
+
+/**
+ * Returns the identity of the calling client, to be given to the owner of a variable offering it to them.
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the whoami invocation, empty
+ *
+ * @return A response structure holding the identity and organization of the client as JSON
+ */
+func (s *SmartContract) whoAmI(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	clientID, err := cid.GetID(APIstub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not identify the client: %s", err.Error()))
+	}
+	mspID, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not identify the client organization: %s", err.Error()))
+	}
+
+	identityBytes, err := json.Marshal(map[string]string{"id": clientID, "mspId": mspID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(identityBytes)
+}
+
+/**
+ * Retrieves a variable, or a value of a conflict-free data type, on behalf of setacl and transferowner,
+ * once the calling client is verified as its owner.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable or value
+ * @param crdtType The type of the value, or empty for a variable
+ *
+ * @return The definition of the variable or value, or an error response
+ */
+func ownedVariable(APIstub shim.ChaincodeStubInterface, name string, crdtType string) (*variable, *sc.Response) {
+	fail := func(msg string) (*variable, *sc.Response) {
+		resp := shim.Error(msg)
+		return nil, &resp
+	}
+
+	v, err := getDefinition(APIstub, name, crdtType)
+	if err != nil {
+		return fail(err.Error())
+	} else if v == nil {
+		return fail(fmt.Sprintf("No %s by the name %s exists", subjectKind(crdtType), name))
+	} else if v.Owner == "" {
+		return fail(fmt.Sprintf("%s was created before owners were recorded, it stays open to any client and cannot be claimed", name))
+	}
+
+	clientID, err := cid.GetID(APIstub)
+	if err != nil {
+		return fail(fmt.Sprintf("Could not identify the client: %s", err.Error()))
+	}
+	if clientID != v.Owner {
+		return fail(fmt.Sprintf("Only the owner of %s may change its ownership or access control list", name))
+	}
+	return v, nil
+}
+
+/**
+ * Returns an optional argument.
+ *
+ * @param args The arguments array of the invocation
+ * @param i The position of the argument
+ *
+ * @return The argument, or empty if it was not given
+ */
+func optionalArg(args []string, i int) string {
+	if len(args) > i {
+		return args[i]
+	}
+	return ""
+}
+
+/**
+ * Names what a definition is the definition of, in messages.
+ *
+ * @param crdtType The type of a conflict-free data type value, or empty for a variable
+ *
+ * @return "variable" or the type
+ */
+func subjectKind(crdtType string) string {
+	if crdtType == "" {
+		return "variable"
+	}
+	return crdtType
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// clientID returns the identity of a client as returned to it by whoami
+func clientID(t *testing.T, s *testStub, creator []byte) string {
+	t.Helper()
+	identity := map[string]string{}
+	err := json.Unmarshal([]byte(expectSuccess(t, s.invoke(creator, "whoami"))), &identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity["id"]
+}
+
+func TestDefaultAccessControlList(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	ann := newCreator(t, "Org1MSP", "ann", nil)
+	bob := newCreator(t, "Org2MSP", "bob", nil)
+	expectSuccess(t, s.invoke(tom, "update", "balance", "5", "+"))
+
+	// members of the owner's organization may read and write, but not administer
+	expectSuccess(t, s.invoke(ann, "update", "balance", "2", "+"))
+	expectValue(t, s, ann, "balance", "7")
+	expectError(t, s.invoke(ann, "prunefast", "balance"), "Client of Org1MSP is not allowed to administer balance")
+	expectError(t, s.invoke(ann, "setacl", "balance", `{"read":["*"]}`), "Only the owner of balance")
+
+	// other organizations may do neither
+	expectError(t, s.invoke(bob, "get", "balance"), "Client of Org2MSP is not allowed to read balance")
+	expectError(t, s.invoke(bob, "update", "balance", "1", "+"), "Client of Org2MSP is not allowed to write balance")
+	expectValue(t, s, tom, "balance", "7")
+}
+
+func TestSetACL(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	bob := newCreator(t, "Org2MSP", "bob", nil)
+	operator := newCreator(t, "Org2MSP", "olga", map[string]string{"role": "operator"})
+	expectSuccess(t, s.invoke(tom, "update", "balance", "5", "+"))
+
+	expectError(t, s.invoke(tom, "setacl", "balance", `{"read":`), "Could not decode the access control list")
+	expectError(t, s.invoke(tom, "setacl", "missing", `{"read":["*"]}`), "No variable by the name missing exists")
+	expectSuccess(t, s.invoke(tom, "setacl", "balance", `{"read":["Org2MSP"],"write":[],"admin":["attr:role=operator"]}`))
+
+	expectValue(t, s, bob, "balance", "5")
+	expectError(t, s.invoke(bob, "update", "balance", "1", "+"), "not allowed to write balance")
+	expectSuccess(t, s.invoke(operator, "update", "balance", "1", "+"))
+	expectSuccess(t, s.invoke(operator, "prunefast", "balance"))
+	expectValue(t, s, tom, "balance", "6")
+
+	// administrators may not change the lists, only the owner may
+	expectError(t, s.invoke(operator, "setacl", "balance", `{"read":["*"]}`), "Only the owner of balance")
+}
+
+func TestTransferOwner(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	bob := newCreator(t, "Org2MSP", "bob", nil)
+	eve := newCreator(t, "Org2MSP", "eve", nil)
+	expectSuccess(t, s.invoke(tom, "update", "balance", "5", "+"))
+
+	expectError(t, s.invoke(bob, "transferowner", "balance", clientID(t, s, bob)), "Only the owner of balance")
+	expectError(t, s.invoke(bob, "acceptowner", "balance"), "Ownership of balance was not offered to this client")
+	expectSuccess(t, s.invoke(tom, "transferowner", "balance", clientID(t, s, bob)))
+	expectError(t, s.invoke(eve, "acceptowner", "balance"), "Ownership of balance was not offered to this client")
+	expectSuccess(t, s.invoke(bob, "acceptowner", "balance"))
+
+	// the access control list is kept, so the former owner's organization may still read and write
+	expectSuccess(t, s.invoke(tom, "update", "balance", "1", "+"))
+	expectError(t, s.invoke(tom, "prunefast", "balance"), "Client of Org1MSP is not allowed to administer balance")
+	expectError(t, s.invoke(tom, "setacl", "balance", `{"read":["*"]}`), "Only the owner of balance")
+	expectSuccess(t, s.invoke(bob, "prunefast", "balance"))
+	expectValue(t, s, bob, "balance", "6")
+}
+
+func TestLegacyVariableStaysOpenAndUnclaimable(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	bob := newCreator(t, "Org2MSP", "bob", nil)
+	s.putLegacy(t, "legacy", "+", "4")
+
+	expectError(t, s.invoke(bob, "setacl", "legacy", `{"read":[]}`), "legacy was created before owners were recorded")
+	expectError(t, s.invoke(bob, "transferowner", "legacy", clientID(t, s, bob)), "cannot be claimed")
+	expectError(t, s.invoke(bob, "acceptowner", "legacy"), "was not offered to this client")
+
+	// the definition synthesized by the first update keeps the variable open
+	expectSuccess(t, s.invoke(bob, "update", "legacy", "1", "+"))
+	expectSuccess(t, s.invoke(tom, "update", "legacy", "2", "-"))
+	expectValue(t, s, bob, "legacy", "3")
+	expectError(t, s.invoke(tom, "setacl", "legacy", `{"read":[]}`), "cannot be claimed")
+}
+
+func TestCrdtOwnership(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	ann := newCreator(t, "Org1MSP", "ann", nil)
+	bob := newCreator(t, "Org2MSP", "bob", nil)
+	expectSuccess(t, s.invoke(tom, "crdtupdate", "orset", "tags", "add", "blue"))
+
+	expectSuccess(t, s.invoke(ann, "crdtupdate", "orset", "tags", "add", "red"))
+	expectError(t, s.invoke(ann, "crdtcompact", "orset", "tags"), "Client of Org1MSP is not allowed to administer tags")
+	expectError(t, s.invoke(bob, "crdtupdate", "orset", "tags", "add", "green"), "Client of Org2MSP is not allowed to write tags")
+	expectError(t, s.invoke(bob, "crdtget", "orset", "tags"), "Client of Org2MSP is not allowed to read tags")
+
+	// the definition of a value is kept apart from variables and from values of other types
+	expectError(t, s.invoke(tom, "setacl", "tags", `{"read":["*"]}`), "No variable by the name tags exists")
+	expectError(t, s.invoke(tom, "setacl", "tags", `{"read":["*"]}`, "gcounter"), "No gcounter by the name tags exists")
+	expectError(t, s.invoke(tom, "setacl", "tags", `{"read":["*"]}`, "bag"), "Type bag is unrecognized")
+	expectSuccess(t, s.invoke(bob, "crdtupdate", "gcounter", "tags", "1"))
+
+	expectSuccess(t, s.invoke(tom, "setacl", "tags", `{"read":["Org2MSP"]}`, "orset"))
+	if got := expectSuccess(t, s.invoke(bob, "crdtget", "orset", "tags")); got != `["blue","red"]` {
+		t.Fatalf("unexpected set %s", got)
+	}
+	expectError(t, s.invoke(ann, "crdtget", "orset", "tags"), "Client of Org1MSP is not allowed to read tags")
+
+	expectSuccess(t, s.invoke(tom, "transferowner", "tags", clientID(t, s, bob), "orset"))
+	expectError(t, s.invoke(bob, "acceptowner", "tags"), "No variable by the name tags exists")
+	expectSuccess(t, s.invoke(bob, "acceptowner", "tags", "orset"))
+	expectSuccess(t, s.invoke(bob, "crdtcompact", "orset", "tags"))
+	expectError(t, s.invoke(tom, "crdtupdate", "orset", "tags", "add", "green"), "Client of Org1MSP is not allowed to write tags")
+}
@@ -0,0 +1,661 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Bounded variables. Since no single update transaction sees the aggregate value of a variable, an update
+ * cannot check a bound itself. Instead, the capacity left before each bound is pre-sliced into quota
+ * buckets when the variable is declared: the buckets of the "-" direction hold value - min between them,
+ * those of the "+" direction hold max - value. A delta towards a bound is applied in two steps:
+ *	- reserve takes the amount from a single bucket, failing if that bucket does not hold enough
+ *	- commit writes the reserved amount as a delta row and a credit row of the same amount for the opposite
+ *	  direction, or release returns the amount to the bucket it was taken from
+ * Updates in a direction without a bound write a credit row for the opposite direction in the same way.
+ * Credit rows have a key of their own per transaction, like delta rows, so they never conflict with
+ * reservations or with each other; rebalance folds them into the buckets. The sum of a direction's
+ * buckets, its pending reservations and its credit rows always equals the capacity left before the bound,
+ * and only the buckets can be reserved, so no sequence of committed deltas can cross it. Transactions only
+ * conflict when they reserve from the same bucket, so the number of buckets sets how many reservations
+ * can proceed in parallel, and rebalance evens out buckets that have run dry.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// quotaIndexName is the composite key under which the quota buckets of bounded variables are stored
+const quotaIndexName = "varName~op~bucket"
+
+// quotaCreditIndexName is the composite key under which capacity not yet folded into the buckets is stored
+const quotaCreditIndexName = "varName~op~txID"
+
+// reservationIndexName is the composite key under which pending reservations are stored
+const reservationIndexName = "varName~reservationID"
+
+// maxBuckets is the largest number of quota buckets of a variable
+const maxBuckets = 1000
+
+// reservation is capacity taken from a quota bucket and not yet committed or released
+type reservation struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Op     string `json:"op"`
+	Amount string `json:"amount"`
+	Bucket int    `json:"bucket"`
+	Client string `json:"client"` // identity of the client that made the reservation
+}
+
+/**
+ * Returns the bound a delta with the given operation moves towards.
+ *
+ * @param op The operation, "+" or "-"
+ *
+ * @return The bound in units of 10^-scale, or nil if the variable is unbounded in that direction
+ */
+func (v *variable) bound(op string) (*big.Int, error) {
+	boundStr := v.Max
+	if op == "-" {
+		boundStr = v.Min
+	}
+	if boundStr == "" {
+		return nil, nil
+	}
+	return parseSignedDecimal(boundStr, v.Scale)
+}
+
+/**
+ * Tells whether deltas with the given operation move towards a bound of the variable.
+ *
+ * @param op The operation, "+" or "-"
+ *
+ * @return true if the deltas must be reserved
+ */
+func (v *variable) bounded(op string) bool {
+	if op == "-" {
+		return v.Min != ""
+	}
+	return v.Max != ""
+}
+
+/**
+ * Declares a bounded variable, which starts at 0. Either bound may be left empty to leave the variable
+ * unbounded in that direction, in which case deltas in that direction are applied with update as usual.
+ * The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> number of digits after the decimal point of the variable
+ *	- args[2] -> lower bound, e.g. 0, or empty
+ *	- args[3] -> upper bound, e.g. 1000.00, or empty
+ *	- args[4] -> number of quota buckets, the number of reservations that can proceed in parallel
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the declare invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) declare(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments, expecting 5")
+	}
+
+	name := args[0]
+	scale, err := strconv.Atoi(args[1])
+	if err != nil || scale < 0 || scale > maxScale {
+		return shim.Error(fmt.Sprintf("Scale must be a whole number between 0 and %d", maxScale))
+	}
+	buckets, err := strconv.Atoi(args[4])
+	if err != nil || buckets < 1 || buckets > maxBuckets {
+		return shim.Error(fmt.Sprintf("Number of buckets must be a whole number between 1 and %d", maxBuckets))
+	}
+	if args[2] == "" && args[3] == "" {
+		return shim.Error("At least one bound must be given, use update for unbounded variables")
+	}
+
+	// A variable is declared once, before any update
+	existing, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if existing != nil {
+		return shim.Error(fmt.Sprintf("Variable %s already exists", name))
+	}
+
+	v := &variable{Name: name, Scale: scale, Min: args[2], Max: args[3], Buckets: buckets}
+	err = setOwner(APIstub, v)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	min, err := v.bound("-")
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Invalid lower bound: %s", err.Error()))
+	}
+	max, err := v.bound("+")
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Invalid upper bound: %s", err.Error()))
+	}
+	if (min != nil && min.Sign() > 0) || (max != nil && max.Sign() < 0) {
+		return shim.Error("Variables start at 0, which must lie within the bounds")
+	}
+
+	// Store the bounds in canonical form and slice the capacity before each of them into the buckets
+	if min != nil {
+		v.Min = formatDecimal(min, scale)
+		err = distributeQuota(APIstub, v, "-", new(big.Int).Neg(min))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if max != nil {
+		v.Max = formatDecimal(max, scale)
+		err = distributeQuota(APIstub, v, "+", max)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = putVariable(APIstub, v)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not define variable %s: %s", name, err.Error()))
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Successfully declared %s within [%s, %s] with %d buckets", name, v.Min, v.Max, buckets)))
+}
+
+/**
+ * Reserves capacity towards a bound of a variable from one of its quota buckets. The args array
+ * contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> amount to reserve (non-negative decimal)
+ *	- args[2] -> operation of the delta, "+" or "-"
+ *	- args[3] -> optional, the bucket to reserve from; by default it is picked from the transaction id
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the reserve invocation
+ *
+ * @return A response structure holding the reservation as JSON, whose id is passed to commit or release
+ */
+func (s *SmartContract) reserve(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments, expecting 3 or 4")
+	}
+
+	name := args[0]
+	op := args[2]
+	if op != "+" && op != "-" {
+		return shim.Error(fmt.Sprintf("Operator %s is unrecognized", op))
+	}
+
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	} else if !v.bounded(op) {
+		return shim.Error(fmt.Sprintf("Variable %s is not bounded for %s deltas, use update instead", name, op))
+	}
+	err = authorizeVariable(APIstub, v, permissionWrite)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	amount, err := parseDecimal(args[1], v.Scale)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Invalid amount for %s: %s", name, err.Error()))
+	} else if amount.Sign() == 0 {
+		return shim.Error("Amount must be greater than 0")
+	}
+
+	// Pick the bucket
+	txid := APIstub.GetTxID()
+	bucket := pickBucket(txid, v.Buckets)
+	if len(args) == 4 {
+		bucket, err = strconv.Atoi(args[3])
+		if err != nil || bucket < 0 || bucket >= v.Buckets {
+			return shim.Error(fmt.Sprintf("Bucket must be a whole number between 0 and %d", v.Buckets-1))
+		}
+	}
+
+	// Take the amount from the bucket
+	quota, err := getQuota(APIstub, v, op, bucket)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if quota.Cmp(amount) < 0 {
+		return shim.Error(fmt.Sprintf("Bucket %d of %s only holds %s for %s deltas, try another bucket or rebalance", bucket, name, formatDecimal(quota, v.Scale), op))
+	}
+	err = putQuota(APIstub, v, op, bucket, quota.Sub(quota, amount))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Record the reservation against the client making it
+	client, err := cid.GetID(APIstub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not identify the client: %s", err.Error()))
+	}
+	r := &reservation{ID: txid, Name: name, Op: op, Amount: formatDecimal(amount, v.Scale), Bucket: bucket, Client: client}
+	err = putReservation(APIstub, r)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reservationBytes, err := json.Marshal(r)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(reservationBytes)
+}
+
+/**
+ * Applies a reservation as a delta row of its variable. The capacity before the opposite bound grows
+ * by the same amount, so it is credited to the opposite direction.
+ * The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> id of the reservation
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the commit invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) commit(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	v, r, amount, errResp := s.closeReservation(APIstub, args, false)
+	if errResp != nil {
+		return *errResp
+	}
+
+	delta := new(big.Int).Set(amount)
+	if r.Op == "-" {
+		delta.Neg(delta)
+	}
+	err := putDelta(APIstub, v, delta)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not put operation for %s in the ledger: %s", v.Name, err.Error()))
+	}
+
+	err = creditQuota(APIstub, v, oppositeOp(r.Op), amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Successfully added %s%s to %s", r.Op, r.Amount, v.Name)))
+}
+
+/**
+ * Cancels a reservation, returning its amount to the bucket it was taken from. Administrators of the
+ * variable may cancel the reservations of any client, so that capacity held by a client that lost its
+ * permissions is not locked away. The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> id of the reservation
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the release invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) release(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	v, r, amount, errResp := s.closeReservation(APIstub, args, true)
+	if errResp != nil {
+		return *errResp
+	}
+
+	// The bucket was already read and written by the reservation
+	quota, err := getQuota(APIstub, v, r.Op, r.Bucket)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putQuota(APIstub, v, r.Op, r.Bucket, quota.Add(quota, amount))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Released %s%s reserved on %s", r.Op, r.Amount, v.Name)))
+}
+
+/**
+ * Folds the credit rows of a bounded variable into its buckets and spreads the capacity evenly over them
+ * again. This reads and writes every bucket, so it conflicts with any concurrent reservation and is best
+ * run when a reservation fails for lack of quota in its bucket. The args array contains the following argument:
+ *	- args[0] -> name of the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the rebalance invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) rebalance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	name := args[0]
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	} else if v.Buckets == 0 {
+		return shim.Error(fmt.Sprintf("Variable %s is not bounded", name))
+	}
+	err = authorizeVariable(APIstub, v, permissionAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, op := range []string{"-", "+"} {
+		if !v.bounded(op) {
+			continue
+		}
+		total := new(big.Int)
+		for bucket := 0; bucket < v.Buckets; bucket++ {
+			quota, err := getQuota(APIstub, v, op, bucket)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			total.Add(total, quota)
+		}
+		credits, err := foldQuotaCredits(APIstub, v, op)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		total.Add(total, credits)
+		err = distributeQuota(APIstub, v, op, total)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Rebalanced %s over %d buckets", name, v.Buckets)))
+}
+
+/**
+ * Removes a pending reservation on behalf of commit and release, once its caller is verified as the
+ * client that made it or, if adminMayClose, as an administrator of the variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array of the commit or release invocation
+ * @param adminMayClose Whether administrators of the variable may close reservations of other clients
+ *
+ * @return The variable, the reservation and its amount, or an error response
+ */
+func (s *SmartContract) closeReservation(APIstub shim.ChaincodeStubInterface, args []string, adminMayClose bool) (*variable, *reservation, *big.Int, *sc.Response) {
+	fail := func(msg string) (*variable, *reservation, *big.Int, *sc.Response) {
+		resp := shim.Error(msg)
+		return nil, nil, nil, &resp
+	}
+
+	// Check we have a valid number of args
+	if len(args) != 2 {
+		return fail("Incorrect number of arguments, expecting 2")
+	}
+	name := args[0]
+
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return fail(err.Error())
+	} else if v == nil {
+		return fail(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+
+	r, err := getReservation(APIstub, name, args[1])
+	if err != nil {
+		return fail(err.Error())
+	} else if r == nil {
+		return fail(fmt.Sprintf("No reservation %s exists on %s", args[1], name))
+	}
+
+	// The client that made the reservation closes it while it may still write the variable,
+	// and administrators may release it for a client that no longer can
+	client, err := cid.GetID(APIstub)
+	if err != nil {
+		return fail(fmt.Sprintf("Could not identify the client: %s", err.Error()))
+	} else if client == r.Client {
+		err = authorizeVariable(APIstub, v, permissionWrite)
+	} else if adminMayClose {
+		err = authorizeVariable(APIstub, v, permissionAdmin)
+	} else {
+		err = fmt.Errorf("Reservation %s was made by another client", r.ID)
+	}
+	if err != nil {
+		return fail(err.Error())
+	}
+
+	amount, err := parseDecimal(r.Amount, v.Scale)
+	if err != nil {
+		return fail(err.Error())
+	}
+
+	err = delReservation(APIstub, r)
+	if err != nil {
+		return fail(err.Error())
+	}
+	return v, r, amount, nil
+}
+
+/**
+ * Picks a quota bucket from a transaction id, so that every endorser of the transaction picks the same one.
+ *
+ * @param txid The transaction id
+ * @param buckets The number of buckets of the variable
+ *
+ * @return The bucket number
+ */
+func pickBucket(txid string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(txid))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+/**
+ * Splits an amount as evenly as possible over the buckets of one direction of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param op The direction of the buckets, "+" or "-"
+ * @param total The amount in units of 10^-scale of the variable
+ *
+ * @return An error if a bucket could not be written
+ */
+func distributeQuota(APIstub shim.ChaincodeStubInterface, v *variable, op string, total *big.Int) error {
+	share, remainder := new(big.Int).QuoRem(total, big.NewInt(int64(v.Buckets)), new(big.Int))
+	for bucket := 0; bucket < v.Buckets; bucket++ {
+		quota := new(big.Int).Set(share)
+		if int64(bucket) < remainder.Int64() {
+			quota.Add(quota, big.NewInt(1))
+		}
+		err := putQuota(APIstub, v, op, bucket, quota)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Adds capacity in one direction, if the variable is bounded in that direction, as a credit row of the
+ * transaction which rebalance later folds into the buckets.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param op The direction of the capacity, "+" or "-"
+ * @param amount The capacity to add in units of 10^-scale of the variable
+ *
+ * @return An error if the credit row could not be written
+ */
+func creditQuota(APIstub shim.ChaincodeStubInterface, v *variable, op string, amount *big.Int) error {
+	if !v.bounded(op) {
+		return nil
+	}
+	creditKey, err := APIstub.CreateCompositeKey(quotaCreditIndexName, []string{v.Name, op, APIstub.GetTxID()})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+	}
+	return APIstub.PutState(creditKey, []byte(formatDecimal(amount, v.Scale)))
+}
+
+/**
+ * Deletes the credit rows of one direction of a variable, returning their sum.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param op The direction of the credits, "+" or "-"
+ *
+ * @return The credited capacity in units of 10^-scale of the variable
+ */
+func foldQuotaCredits(APIstub shim.ChaincodeStubInterface, v *variable, op string) (*big.Int, error) {
+	creditResultsIterator, err := APIstub.GetStateByPartialCompositeKey(quotaCreditIndexName, []string{v.Name, op})
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the credits of %s: %s", v.Name, err.Error())
+	}
+	defer creditResultsIterator.Close()
+
+	total := new(big.Int)
+	for creditResultsIterator.HasNext() {
+		responseRange, err := creditResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		amount, err := parseDecimal(string(responseRange.Value), v.Scale)
+		if err != nil {
+			return nil, err
+		}
+		total.Add(total, amount)
+		err = APIstub.DelState(responseRange.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Could not delete credit row: %s", err.Error())
+		}
+	}
+	return total, nil
+}
+
+/**
+ * Returns the operation opposite to the given one.
+ *
+ * @param op The operation, "+" or "-"
+ *
+ * @return "-" for "+" and "+" for "-"
+ */
+func oppositeOp(op string) string {
+	if op == "+" {
+		return "-"
+	}
+	return "+"
+}
+
+/**
+ * Retrieves the capacity held by a quota bucket.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param op The direction of the bucket, "+" or "-"
+ * @param bucket The bucket number
+ *
+ * @return The capacity in units of 10^-scale of the variable
+ */
+func getQuota(APIstub shim.ChaincodeStubInterface, v *variable, op string, bucket int) (*big.Int, error) {
+	quotaKey, err := APIstub.CreateCompositeKey(quotaIndexName, []string{v.Name, op, strconv.Itoa(bucket)})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+	}
+	quotaBytes, err := APIstub.GetState(quotaKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve bucket %d of %s: %s", bucket, v.Name, err.Error())
+	} else if quotaBytes == nil {
+		return nil, fmt.Errorf("Bucket %d of %s does not exist for %s deltas", bucket, v.Name, op)
+	}
+	return parseDecimal(string(quotaBytes), v.Scale)
+}
+
+/**
+ * Stores the capacity held by a quota bucket.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param op The direction of the bucket, "+" or "-"
+ * @param bucket The bucket number
+ * @param quota The capacity in units of 10^-scale of the variable
+ *
+ * @return An error if the bucket could not be written
+ */
+func putQuota(APIstub shim.ChaincodeStubInterface, v *variable, op string, bucket int, quota *big.Int) error {
+	quotaKey, err := APIstub.CreateCompositeKey(quotaIndexName, []string{v.Name, op, strconv.Itoa(bucket)})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+	}
+	return APIstub.PutState(quotaKey, []byte(formatDecimal(quota, v.Scale)))
+}
+
+/**
+ * Retrieves a pending reservation.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param id The id of the reservation
+ *
+ * @return The reservation, or nil if there is no such pending reservation
+ */
+func getReservation(APIstub shim.ChaincodeStubInterface, name string, id string) (*reservation, error) {
+	reservationKey, err := APIstub.CreateCompositeKey(reservationIndexName, []string{name, id})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	reservationBytes, err := APIstub.GetState(reservationKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve reservation %s: %s", id, err.Error())
+	} else if reservationBytes == nil {
+		return nil, nil
+	}
+
+	r := &reservation{}
+	err = json.Unmarshal(reservationBytes, r)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode reservation %s: %s", id, err.Error())
+	}
+	return r, nil
+}
+
+/**
+ * Stores a pending reservation.
+ *
+ * @param APIstub The chaincode shim
+ * @param r The reservation
+ *
+ * @return An error if the reservation could not be stored
+ */
+func putReservation(APIstub shim.ChaincodeStubInterface, r *reservation) error {
+	reservationKey, err := APIstub.CreateCompositeKey(reservationIndexName, []string{r.Name, r.ID})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", r.Name, err.Error())
+	}
+	reservationBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(reservationKey, reservationBytes)
+}
+
+/**
+ * Deletes a pending reservation.
+ *
+ * @param APIstub The chaincode shim
+ * @param r The reservation
+ *
+ * @return An error if the reservation could not be deleted
+ */
+func delReservation(APIstub shim.ChaincodeStubInterface, r *reservation) error {
+	reservationKey, err := APIstub.CreateCompositeKey(reservationIndexName, []string{r.Name, r.ID})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", r.Name, err.Error())
+	}
+	return APIstub.DelState(reservationKey)
+}
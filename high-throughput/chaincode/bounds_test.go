@@ -0,0 +1,125 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func reserveTest(t *testing.T, s *testStub, creator []byte, args ...string) *reservation {
+	t.Helper()
+	r := &reservation{}
+	err := json.Unmarshal([]byte(expectSuccess(t, s.invoke(creator, "reserve", args...))), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func countRows(t *testing.T, s *testStub, indexName string, attributes ...string) int {
+	t.Helper()
+	s.MockTransactionStart("count")
+	defer s.MockTransactionEnd("count")
+	resultsIterator, err := s.GetStateByPartialCompositeKey(indexName, attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resultsIterator.Close()
+	count := 0
+	for ; resultsIterator.HasNext(); count++ {
+		if _, err := resultsIterator.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return count
+}
+
+func TestBoundedVariableNeverGoesBelowMin(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	jerry := newCreator(t, "Org1MSP", "jerry", nil)
+	expectError(t, s.invoke(tom, "declare", "balance", "2", "1", "", "2"), "must lie within the bounds")
+	expectSuccess(t, s.invoke(tom, "declare", "balance", "2", "0", "", "2"))
+	expectError(t, s.invoke(tom, "update", "balance", "1", "-"), "use reserve and commit")
+
+	// ==== Deposits are credits, folded into the buckets by rebalance ====
+	expectSuccess(t, s.invoke(tom, "update", "balance", "10", "+"))
+	if n := countRows(t, s, quotaCreditIndexName, "balance", "-"); n != 1 {
+		t.Fatalf("expected one credit row, got %d", n)
+	}
+	expectError(t, s.invoke(tom, "reserve", "balance", "5", "-", "0"), "only holds 0.00")
+	expectSuccess(t, s.invoke(tom, "rebalance", "balance"))
+	if n := countRows(t, s, quotaCreditIndexName, "balance"); n != 0 {
+		t.Fatalf("expected rebalance to fold the credits, got %d rows", n)
+	}
+
+	r := reserveTest(t, s, tom, "balance", "5", "-", "0")
+	expectError(t, s.invoke(jerry, "commit", "balance", r.ID), "made by another client")
+	expectSuccess(t, s.invoke(tom, "commit", "balance", r.ID))
+	expectError(t, s.invoke(tom, "commit", "balance", r.ID), "No reservation")
+	expectValue(t, s, tom, "balance", "5.00")
+
+	expectError(t, s.invoke(tom, "reserve", "balance", "5.01", "-", "1"), "only holds 5.00")
+	r = reserveTest(t, s, tom, "balance", "3", "-", "1")
+	expectSuccess(t, s.invoke(tom, "release", "balance", r.ID))
+	reserveTest(t, s, tom, "balance", "5", "-", "1")
+	expectError(t, s.invoke(tom, "reserve", "balance", "0.01", "-", "1"), "only holds 0.00")
+}
+
+func TestBoundedVariableCreditsTheOppositeDirection(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	expectSuccess(t, s.invoke(tom, "declare", "stock", "0", "", "100", "4"))
+	expectError(t, s.invoke(tom, "reserve", "stock", "26", "+", "0"), "only holds 25")
+	r := reserveTest(t, s, tom, "stock", "25", "+", "0")
+	expectSuccess(t, s.invoke(tom, "commit", "stock", r.ID))
+
+	// an unbounded direction has no buckets to credit
+	if n := countRows(t, s, quotaCreditIndexName, "stock"); n != 0 {
+		t.Fatalf("expected no credit rows, got %d", n)
+	}
+	expectSuccess(t, s.invoke(tom, "update", "stock", "10", "-"))
+	if n := countRows(t, s, quotaCreditIndexName, "stock", "+"); n != 1 {
+		t.Fatalf("expected one credit row for the upper bound, got %d", n)
+	}
+	expectSuccess(t, s.invoke(tom, "rebalance", "stock"))
+	for bucket := 0; bucket < 4; bucket++ {
+		s.MockTransactionStart("quota")
+		quota, err := getQuota(s, &variable{Name: "stock", Max: "100", Buckets: 4}, "+", bucket)
+		s.MockTransactionEnd("quota")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 100 - 25 + 10 spread over four buckets
+		if expected := []int64{22, 21, 21, 21}[bucket]; quota.Int64() != expected {
+			t.Fatalf("expected bucket %d to hold %d, got %s", bucket, expected, quota)
+		}
+	}
+	expectValue(t, s, tom, "stock", "15")
+}
+
+func TestAdministratorReleasesReservationOfRevokedClient(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	jerry := newCreator(t, "Org2MSP", "jerry", nil)
+	operator := newCreator(t, "Org2MSP", "olga", map[string]string{"role": "operator"})
+	expectSuccess(t, s.invoke(tom, "declare", "balance", "0", "0", "", "1"))
+	expectSuccess(t, s.invoke(tom, "update", "balance", "10", "+"))
+	expectSuccess(t, s.invoke(tom, "rebalance", "balance"))
+	expectSuccess(t, s.invoke(tom, "setacl", "balance", `{"write":["Org2MSP"],"admin":["attr:role=operator"]}`))
+	r := reserveTest(t, s, jerry, "balance", "10", "-", "0")
+
+	// ==== Once jerry may no longer write, only an administrator frees the capacity ====
+	expectSuccess(t, s.invoke(tom, "setacl", "balance", `{"admin":["attr:role=operator"]}`))
+	expectError(t, s.invoke(jerry, "release", "balance", r.ID), "Client of Org2MSP is not allowed to write balance")
+	expectError(t, s.invoke(operator, "commit", "balance", r.ID), "made by another client")
+	expectError(t, s.invoke(tom, "reserve", "balance", "1", "-", "0"), "only holds 0")
+	expectSuccess(t, s.invoke(operator, "release", "balance", r.ID))
+	reserveTest(t, s, tom, "balance", "10", "-", "0")
+	expectValue(t, s, tom, "balance", "10")
+}
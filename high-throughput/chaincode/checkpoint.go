@@ -0,0 +1,418 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Checkpoints. Each variable may have a checkpoint row holding the aggregate of the delta rows folded into
+ * it so far, and the folded rows are deleted, so the value of the variable is the checkpoint plus the delta
+ * rows still present. Folding happens in compact transactions, which are given an explicit set of delta
+ * rows, listed beforehand with the deltas query. Compact reads those rows by key instead of scanning the
+ * variable's rows, so it does not conflict with updates adding new rows at the same time, and can run
+ * while the variable is in use. Compact transactions on the same variable do conflict with each other on
+ * the checkpoint row, so they should be sent one at a time.
+ *
+ * Every compact or prune also writes a fold row of its own, recording which delta rows it folded: the first
+ * and last of them in key order, their number and aggregate, and a SHA-256 digest of all their keys in order.
+ * The checkpoint holds the latest fold, and the fold rows of a variable account for every row folded into it.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// checkpointIndexName is the composite key under which the checkpoints of variables are stored
+const checkpointIndexName = "varName~checkpoint"
+
+// foldIndexName is the composite key under which the record of each fold into a checkpoint is stored
+const foldIndexName = "varName~fold~txID"
+
+// maxCompactRows is the largest number of delta rows folded by a single compact transaction
+const maxCompactRows = 1000
+
+// checkpoint is the aggregate of the delta rows folded so far
+type checkpoint struct {
+	Name  string `json:"name"`
+	Value string `json:"value"` // aggregate of every folded delta row
+	Rows  int    `json:"rows"`  // number of delta rows folded so far
+	TxID  string `json:"txId"`  // last transaction that folded rows
+
+	LastFold *fold `json:"lastFold,omitempty"` // the rows folded by that transaction
+}
+
+// fold records the delta rows folded into a checkpoint by one transaction
+type fold struct {
+	TxID   string    `json:"txId"`
+	Rows   int       `json:"rows"`   // number of delta rows folded
+	Value  string    `json:"value"`  // aggregate of the folded rows
+	First  *deltaRow `json:"first"`  // first folded row in key order, nil if no rows were folded
+	Last   *deltaRow `json:"last"`   // last folded row in key order
+	Digest string    `json:"digest"` // hex SHA-256 of the keys of the folded rows, concatenated in key order
+}
+
+// deltaRow identifies a delta row by the parts of its composite key after the variable name
+type deltaRow struct {
+	Op    string `json:"op"`
+	Value string `json:"value"`
+	TxID  string `json:"txId"`
+}
+
+/**
+ * Lists delta rows of a variable which are not folded into its checkpoint yet, to be passed to compact.
+ * The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> largest number of rows to list
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the deltas invocation
+ *
+ * @return A response structure holding a JSON array of delta rows
+ */
+func (s *SmartContract) deltas(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	limit, err := strconv.Atoi(args[1])
+	if err != nil || limit < 1 || limit > maxCompactRows {
+		return shim.Error(fmt.Sprintf("Limit must be a whole number between 1 and %d", maxCompactRows))
+	}
+
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+	err = authorizeVariable(APIstub, v, permissionRead)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	deltaResultsIterator, err := APIstub.GetStateByPartialCompositeKey(deltaIndexName, []string{name})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve delta rows for %s: %s", name, err.Error()))
+	}
+	defer deltaResultsIterator.Close()
+
+	rows := []deltaRow{}
+	for len(rows) < limit && deltaResultsIterator.HasNext() {
+		responseRange, err := deltaResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		rows = append(rows, deltaRow{Op: keyParts[1], Value: keyParts[2], TxID: keyParts[3]})
+	}
+
+	rowsBytes, err := json.Marshal(rows)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(rowsBytes)
+}
+
+/**
+ * Folds a set of delta rows into the checkpoint of a variable and deletes them. Every row must still
+ * exist, so a row cannot be folded twice; if one was already folded or deleted the whole transaction
+ * fails and the rows should be listed again. The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> JSON array of the delta rows to fold, as returned by the deltas query
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the compact invocation
+ *
+ * @return A response structure holding the new checkpoint as JSON
+ */
+func (s *SmartContract) compact(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	var rows []deltaRow
+	err := json.Unmarshal([]byte(args[1]), &rows)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not decode the delta rows to compact: %s", err.Error()))
+	}
+	if len(rows) == 0 || len(rows) > maxCompactRows {
+		return shim.Error(fmt.Sprintf("Between 1 and %d delta rows can be compacted at once", maxCompactRows))
+	}
+
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+	err = authorizeVariable(APIstub, v, permissionAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Fold the rows, reading each by key. Reads do not see the deletes made earlier in the same
+	// transaction, so duplicates have to be caught here.
+	folded := new(big.Int)
+	periods := rollups{}
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, row := range rows {
+		deltaKey, err := APIstub.CreateCompositeKey(deltaIndexName, []string{name, row.Op, row.Value, row.TxID})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not create a composite key for %s: %s", name, err.Error()))
+		}
+		if seen[deltaKey] {
+			return shim.Error(fmt.Sprintf("Delta row %s%s of transaction %s is listed twice", row.Op, row.Value, row.TxID))
+		}
+		seen[deltaKey] = true
+		keys = append(keys, deltaKey)
+
+		deltaBytes, err := APIstub.GetState(deltaKey)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve delta row: %s", err.Error()))
+		} else if deltaBytes == nil {
+			return shim.Error(fmt.Sprintf("Delta row %s%s of transaction %s does not exist, it may already be compacted", row.Op, row.Value, row.TxID))
+		}
+
+		value, err := signedDelta(row.Op, row.Value, v.Scale)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		folded.Add(folded, value)
+
+		rowTime, err := parseDeltaTimestamp(deltaBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		periods.add(rowTime, value)
+
+		err = APIstub.DelState(deltaKey)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", err.Error()))
+		}
+	}
+
+	cp, err := foldIntoCheckpoint(APIstub, v, folded, keys, periods)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	checkpointBytes, err := json.Marshal(cp)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(checkpointBytes)
+}
+
+/**
+ * Computes the value of a variable from its checkpoint and the delta rows not folded into it yet.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ *
+ * @return The value in units of 10^-scale of the variable
+ */
+func currentValue(APIstub shim.ChaincodeStubInterface, v *variable) (*big.Int, error) {
+	cp, err := getCheckpoint(APIstub, v.Name)
+	if err != nil {
+		return nil, err
+	}
+	value, err := checkpointValue(cp, v)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas, _, err := sumDeltas(APIstub, v, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return value.Add(value, deltas), nil
+}
+
+/**
+ * Adds an aggregate of folded delta rows to the checkpoint of a variable, creating the checkpoint if needed,
+ * and to the rollups of the periods the rows belong to, so that point-in-time queries still see them. The
+ * folded rows are recorded in a fold row of the transaction.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param folded The aggregate of the folded rows in units of 10^-scale of the variable
+ * @param keys The keys of the folded rows
+ * @param periods The aggregate of the folded rows per period
+ *
+ * @return The updated checkpoint
+ */
+func foldIntoCheckpoint(APIstub shim.ChaincodeStubInterface, v *variable, folded *big.Int, keys []string, periods rollups) (*checkpoint, error) {
+	// The scale of a legacy variable is synthesized from its delta rows, so it is stored before they are folded away
+	if v.legacy {
+		err := putVariable(APIstub, v)
+		if err != nil {
+			return nil, fmt.Errorf("Could not define variable %s: %s", v.Name, err.Error())
+		}
+	}
+
+	err := addRollups(APIstub, v, periods)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := putFold(APIstub, v, folded, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	cp, err := getCheckpoint(APIstub, v.Name)
+	if err != nil {
+		return nil, err
+	}
+	value, err := checkpointValue(cp, v)
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil {
+		cp = &checkpoint{Name: v.Name}
+	}
+
+	cp.Value = formatDecimal(value.Add(value, folded), v.Scale)
+	cp.Rows += len(keys)
+	cp.TxID = APIstub.GetTxID()
+	cp.LastFold = f
+	err = putCheckpoint(APIstub, cp)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+/**
+ * Records the delta rows folded by the transaction in a fold row.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param folded The aggregate of the folded rows in units of 10^-scale of the variable
+ * @param keys The keys of the folded rows
+ *
+ * @return The fold record
+ */
+func putFold(APIstub shim.ChaincodeStubInterface, v *variable, folded *big.Int, keys []string) (*fold, error) {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+
+	f := &fold{TxID: APIstub.GetTxID(), Rows: len(sorted), Value: formatDecimal(folded, v.Scale)}
+	digest := sha256.New()
+	for i, key := range sorted {
+		digest.Write([]byte(key))
+		if i != 0 && i != len(sorted)-1 {
+			continue
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		row := &deltaRow{Op: keyParts[1], Value: keyParts[2], TxID: keyParts[3]}
+		if i == 0 {
+			f.First = row
+		}
+		if i == len(sorted)-1 {
+			f.Last = row
+		}
+	}
+	f.Digest = hex.EncodeToString(digest.Sum(nil))
+
+	foldKey, err := APIstub.CreateCompositeKey(foldIndexName, []string{v.Name, f.TxID})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+	}
+	foldBytes, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	err = APIstub.PutState(foldKey, foldBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not record the fold of %s: %s", v.Name, err.Error())
+	}
+	return f, nil
+}
+
+/**
+ * Returns the aggregate held by a checkpoint.
+ *
+ * @param cp The checkpoint, or nil if the variable has none
+ * @param v The definition of the variable
+ *
+ * @return The aggregate in units of 10^-scale of the variable, 0 without a checkpoint
+ */
+func checkpointValue(cp *checkpoint, v *variable) (*big.Int, error) {
+	if cp == nil {
+		return new(big.Int), nil
+	}
+	value, err := parseSignedDecimal(cp.Value, v.Scale)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the checkpoint of %s: %s", v.Name, err.Error())
+	}
+	return value, nil
+}
+
+/**
+ * Retrieves the checkpoint of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The checkpoint, or nil if no rows were folded yet
+ */
+func getCheckpoint(APIstub shim.ChaincodeStubInterface, name string) (*checkpoint, error) {
+	checkpointKey, err := APIstub.CreateCompositeKey(checkpointIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	checkpointBytes, err := APIstub.GetState(checkpointKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the checkpoint of %s: %s", name, err.Error())
+	} else if checkpointBytes == nil {
+		return nil, nil
+	}
+
+	cp := &checkpoint{}
+	err = json.Unmarshal(checkpointBytes, cp)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode the checkpoint of %s: %s", name, err.Error())
+	}
+	return cp, nil
+}
+
+/**
+ * Stores the checkpoint of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param cp The checkpoint
+ *
+ * @return An error if the checkpoint could not be stored
+ */
+func putCheckpoint(APIstub shim.ChaincodeStubInterface, cp *checkpoint) error {
+	checkpointKey, err := APIstub.CreateCompositeKey(checkpointIndexName, []string{cp.Name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", cp.Name, err.Error())
+	}
+	checkpointBytes, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(checkpointKey, checkpointBytes)
+}
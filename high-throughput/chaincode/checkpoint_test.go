@@ -0,0 +1,90 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestCompactRecordsFoldedRows(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	for _, value := range []string{"5", "3", "7"} {
+		expectSuccess(t, s.invoke(tom, "update", "myvar", value, "+"))
+	}
+	rows := []deltaRow{}
+	err := json.Unmarshal([]byte(expectSuccess(t, s.invoke(tom, "deltas", "myvar", "2"))), &rows)
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("expected two rows, got %v, %v", rows, err)
+	}
+	rowsJSON, _ := json.Marshal(rows)
+
+	// ==== An update arriving in between does not affect the compaction ====
+	expectSuccess(t, s.invoke(tom, "update", "myvar", "1", "-"))
+	cp := &checkpoint{}
+	err = json.Unmarshal([]byte(expectSuccess(t, s.invoke(tom, "compact", "myvar", string(rowsJSON)))), cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := cp.LastFold
+	if cp.Rows != 2 || f == nil || f.Rows != 2 || f.TxID != cp.TxID || *f.First != rows[0] || *f.Last != rows[1] {
+		t.Fatalf("expected the checkpoint to record the folded rows %v, got %+v", rows, cp)
+	}
+	digest := sha256.New()
+	for _, row := range rows {
+		key, _ := s.CreateCompositeKey(deltaIndexName, []string{"myvar", row.Op, row.Value, row.TxID})
+		digest.Write([]byte(key))
+	}
+	if f.Digest != hex.EncodeToString(digest.Sum(nil)) {
+		t.Fatalf("unexpected digest %s", f.Digest)
+	}
+	foldKey, _ := s.CreateCompositeKey(foldIndexName, []string{"myvar", f.TxID})
+	if s.State[foldKey] == nil {
+		t.Fatal("expected a fold row for the compaction")
+	}
+	expectValue(t, s, tom, "myvar", "14")
+
+	expectError(t, s.invoke(tom, "compact", "myvar", string(rowsJSON)), "may already be compacted")
+	expectError(t, s.invoke(tom, "compact", "myvar", "[]"), "Between 1 and 1000")
+
+	// ==== Pruning the rest records a second fold ====
+	expectSuccess(t, s.invoke(tom, "prunefast", "myvar"))
+	if n := countRows(t, s, foldIndexName, "myvar"); n != 2 {
+		t.Fatalf("expected a fold row per fold, got %d", n)
+	}
+	expectValue(t, s, tom, "myvar", "14")
+
+	expectSuccess(t, s.invoke(tom, "delete", "myvar"))
+	if n := countRows(t, s, foldIndexName, "myvar"); n != 0 {
+		t.Fatalf("expected delete to remove the fold rows, got %d", n)
+	}
+}
+
+func TestPruningLegacyVariableStoresItsDefinition(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	bob := newCreator(t, "Org2MSP", "bob", nil)
+	s.putLegacy(t, "legacy", "+", "1.5")
+	s.putLegacy(t, "legacy", "+", "2")
+	s.putLegacy(t, "batched", "+", "1.5")
+	s.putLegacy(t, "batched", "+", "2")
+
+	// ==== The synthesized scale outlives the rows it was taken from ====
+	expectSuccess(t, s.invoke(bob, "prunefast", "legacy"))
+	expectValue(t, s, tom, "legacy", "3.5")
+	expectSuccess(t, s.invoke(tom, "update", "legacy", "1", "+"))
+	expectValue(t, s, bob, "legacy", "4.5")
+	expectError(t, s.invoke(tom, "setacl", "legacy", `{"read":[]}`), "cannot be claimed")
+
+	first := pruneBatchTest(t, s, bob, "batched", "1", "")
+	expectValue(t, s, tom, "batched", "3.5")
+	pruneBatchTest(t, s, bob, "batched", "1", first.Cursor)
+	expectValue(t, s, tom, "batched", "3.5")
+}
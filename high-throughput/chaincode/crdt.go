@@ -0,0 +1,555 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Conflict-free replicated data types built on the same idea as the aggregate variables: every update adds
+ * a new row, keyed by its transaction id, instead of rewriting a shared row, so concurrent updates never
+ * conflict, and reads merge the rows into a value. The supported types are:
+ *	- gcounter, a counter that only grows
+ *	- pncounter, a counter that grows and shrinks
+ *	- orset, an observed-remove set of strings
+ *	- lwwregister, a register holding the last value written, by transaction timestamp
+ *	- maxregister, a register holding the largest number written
+ * Each type has its own keyspace and is used through the crdtupdate, crdtget and crdtcompact invocations,
+ * whose first argument is the type. Values are owned by the client of their first update and checked against
+ * an access control list like variables, see acl.go. Compaction merges the rows of a value into as few rows as possible;
+ * it scans every row of the value, so it conflicts with updates of the same value arriving at the same time.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// crdt is implemented by each conflict-free data type
+type crdt interface {
+	// update adds a row for the given update arguments
+	update(APIstub shim.ChaincodeStubInterface, name string, args []string) error
+	// value merges the rows into the current value, as JSON
+	value(APIstub shim.ChaincodeStubInterface, name string) ([]byte, error)
+	// compact merges the rows into as few rows as possible, returning the number of rows removed
+	compact(APIstub shim.ChaincodeStubInterface, name string) (int, error)
+	// indexName is the composite key index of the rows of the type
+	indexName() string
+}
+
+// crdtTypes are the supported conflict-free data types by name
+var crdtTypes = map[string]crdt{
+	"gcounter":    &counter{index: "gcounter~name~op~value~txID"},
+	"pncounter":   &counter{index: "pncounter~name~op~value~txID", signed: true},
+	"orset":       &orSet{index: "orset~name~element~txID"},
+	"lwwregister": &lwwRegister{index: "lwwregister~name~timestamp~txID"},
+	"maxregister": &maxRegister{index: "maxregister~name~value~txID"},
+}
+
+// crdtRow is a row of a conflict-free data type
+type crdtRow struct {
+	key   string
+	parts []string // attributes of the composite key, after the name
+	value []byte
+}
+
+/**
+ * Adds an update to a conflict-free data type. The args array contains the following arguments:
+ *	- args[0] -> type, one of gcounter, pncounter, orset, lwwregister and maxregister
+ *	- args[1] -> name of the value
+ *	- args[2:] -> the update, depending on the type:
+ *		gcounter: amount (whole number)
+ *		pncounter: amount (whole number), operation ("+" or "-")
+ *		orset: "add" or "remove", element
+ *		lwwregister: value
+ *		maxregister: number (decimal, may be negative)
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the crdtupdate invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) crdtUpdate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments, expecting at least 3")
+	}
+	t, ok := crdtTypes[args[0]]
+	if !ok {
+		return shim.Error(fmt.Sprintf("Type %s is unrecognized", args[0]))
+	}
+
+	// Define the value on its first update, as for variables
+	v, err := getDefinition(APIstub, args[1], args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if v == nil {
+		v, err = defineCrdt(APIstub, args[0], args[1])
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not define %s %s: %s", args[0], args[1], err.Error()))
+		}
+	} else {
+		err = authorizeVariable(APIstub, v, permissionWrite)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = t.update(APIstub, args[1], args[2:])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not update %s %s: %s", args[0], args[1], err.Error()))
+	}
+	return shim.Success([]byte(fmt.Sprintf("Successfully updated %s %s", args[0], args[1])))
+}
+
+/**
+ * Retrieves the current value of a conflict-free data type. The args array contains the following arguments:
+ *	- args[0] -> type
+ *	- args[1] -> name of the value
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the crdtget invocation
+ *
+ * @return A response structure holding the value as JSON
+ */
+func (s *SmartContract) crdtGet(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	t, ok := crdtTypes[args[0]]
+	if !ok {
+		return shim.Error(fmt.Sprintf("Type %s is unrecognized", args[0]))
+	}
+
+	err := authorizeCrdt(APIstub, args[0], args[1], permissionRead)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	value, err := t.value(APIstub, args[1])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve %s %s: %s", args[0], args[1], err.Error()))
+	}
+	return shim.Success(value)
+}
+
+/**
+ * Merges the rows of a conflict-free data type into as few rows as possible. The args array contains
+ * the following arguments:
+ *	- args[0] -> type
+ *	- args[1] -> name of the value
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the crdtcompact invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) crdtCompact(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	t, ok := crdtTypes[args[0]]
+	if !ok {
+		return shim.Error(fmt.Sprintf("Type %s is unrecognized", args[0]))
+	}
+
+	err := authorizeCrdt(APIstub, args[0], args[1], permissionAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	removed, err := t.compact(APIstub, args[1])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not compact %s %s: %s", args[0], args[1], err.Error()))
+	}
+	return shim.Success([]byte(fmt.Sprintf("Compacted %s %s, %d rows removed", args[0], args[1], removed)))
+}
+
+/**
+ * Stores the definition of a value on its first update, owned by the calling client.
+ *
+ * @param APIstub The chaincode shim
+ * @param crdtType The name of the type
+ * @param name The name of the value
+ *
+ * @return The definition
+ */
+func defineCrdt(APIstub shim.ChaincodeStubInterface, crdtType string, name string) (*variable, error) {
+	v := &variable{Name: name}
+	err := setOwner(APIstub, v)
+	if err != nil {
+		return nil, err
+	}
+	return v, putDefinition(APIstub, v, crdtType)
+}
+
+/**
+ * Checks that the calling client holds a permission on a value. Every value is defined by its first
+ * update, so a value without a definition does not exist.
+ *
+ * @param APIstub The chaincode shim
+ * @param crdtType The type of the value
+ * @param name The name of the value
+ * @param permission One of permissionRead, permissionWrite and permissionAdmin
+ *
+ * @return An error if the client does not hold the permission
+ */
+func authorizeCrdt(APIstub shim.ChaincodeStubInterface, crdtType string, name string, permission string) error {
+	v, err := getDefinition(APIstub, name, crdtType)
+	if err != nil {
+		return err
+	} else if v == nil {
+		return fmt.Errorf("No %s by the name %s exists", crdtType, name)
+	}
+	return authorizeVariable(APIstub, v, permission)
+}
+
+/**
+ * Reads every row of a value, or of the values matching a longer partial key.
+ *
+ * @param APIstub The chaincode shim
+ * @param indexName The composite key index of the type
+ * @param keys The name of the value, optionally followed by further key attributes
+ *
+ * @return The rows, in key order
+ */
+func readCrdtRows(APIstub shim.ChaincodeStubInterface, indexName string, keys []string) ([]crdtRow, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(indexName, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	rows := []crdtRow{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, crdtRow{key: responseRange.Key, parts: keyParts[1:], value: responseRange.Value})
+	}
+	return rows, nil
+}
+
+/**
+ * Adds a row of a conflict-free data type.
+ *
+ * @param APIstub The chaincode shim
+ * @param indexName The composite key index of the type
+ * @param attributes The attributes of the composite key, starting with the name of the value
+ * @param value The value of the row
+ *
+ * @return An error if the row could not be added
+ */
+func putCrdtRow(APIstub shim.ChaincodeStubInterface, indexName string, attributes []string, value []byte) error {
+	rowKey, err := APIstub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key: %s", err.Error())
+	}
+	return APIstub.PutState(rowKey, value)
+}
+
+/**
+ * Deletes rows of a conflict-free data type.
+ *
+ * @param APIstub The chaincode shim
+ * @param rows The rows to delete
+ *
+ * @return An error if a row could not be deleted
+ */
+func delCrdtRows(APIstub shim.ChaincodeStubInterface, rows []crdtRow) error {
+	for _, row := range rows {
+		err := APIstub.DelState(row.key)
+		if err != nil {
+			return fmt.Errorf("Could not delete row: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// counter is a G-counter, or a PN-counter when signed, of whole numbers
+type counter struct {
+	index  string
+	signed bool
+}
+
+func (c *counter) indexName() string {
+	return c.index
+}
+
+func (c *counter) update(APIstub shim.ChaincodeStubInterface, name string, args []string) error {
+	op := "+"
+	if c.signed {
+		if len(args) != 2 {
+			return fmt.Errorf("Expecting an amount and an operation")
+		}
+		op = args[1]
+		if op != "+" && op != "-" {
+			return fmt.Errorf("Operator %s is unrecognized", op)
+		}
+	} else if len(args) != 1 {
+		return fmt.Errorf("Expecting an amount")
+	}
+
+	amount, err := parseDecimal(args[0], 0)
+	if err != nil {
+		return err
+	}
+	return putCrdtRow(APIstub, c.index, []string{name, op, amount.String(), APIstub.GetTxID()}, []byte{0x00})
+}
+
+func (c *counter) sum(rows []crdtRow) (*big.Int, error) {
+	total := new(big.Int)
+	for _, row := range rows {
+		amount, err := parseDecimal(row.parts[1], 0)
+		if err != nil {
+			return nil, err
+		}
+		if row.parts[0] == "-" {
+			total.Sub(total, amount)
+		} else {
+			total.Add(total, amount)
+		}
+	}
+	return total, nil
+}
+
+func (c *counter) value(APIstub shim.ChaincodeStubInterface, name string) ([]byte, error) {
+	rows, err := readCrdtRows(APIstub, c.index, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	total, err := c.sum(rows)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(total.String()), nil
+}
+
+func (c *counter) compact(APIstub shim.ChaincodeStubInterface, name string) (int, error) {
+	rows, err := readCrdtRows(APIstub, c.index, []string{name})
+	if err != nil || len(rows) <= 1 {
+		return 0, err
+	}
+	total, err := c.sum(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	// Replace every row with a single row holding the total
+	err = delCrdtRows(APIstub, rows)
+	if err != nil {
+		return 0, err
+	}
+	op := "+"
+	if total.Sign() < 0 {
+		op = "-"
+	}
+	err = putCrdtRow(APIstub, c.index, []string{name, op, new(big.Int).Abs(total).String(), APIstub.GetTxID()}, []byte{0x00})
+	if err != nil {
+		return 0, err
+	}
+	return len(rows) - 1, nil
+}
+
+// orSet is an observed-remove set: each add writes a row tagged with its transaction id, and a remove
+// deletes the tagged rows of the element it observes. An add of the element committed concurrently with
+// a remove makes the remove fail, so the add wins.
+type orSet struct {
+	index string
+}
+
+func (o *orSet) indexName() string {
+	return o.index
+}
+
+func (o *orSet) update(APIstub shim.ChaincodeStubInterface, name string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Expecting add or remove and an element")
+	}
+	element := args[1]
+
+	switch args[0] {
+	case "add":
+		return putCrdtRow(APIstub, o.index, []string{name, element, APIstub.GetTxID()}, []byte{0x00})
+	case "remove":
+		rows, err := readCrdtRows(APIstub, o.index, []string{name, element})
+		if err != nil {
+			return err
+		} else if len(rows) == 0 {
+			return fmt.Errorf("%s is not in the set", element)
+		}
+		return delCrdtRows(APIstub, rows)
+	}
+	return fmt.Errorf("Set operation %s is unrecognized, expecting add or remove", args[0])
+}
+
+func (o *orSet) value(APIstub shim.ChaincodeStubInterface, name string) ([]byte, error) {
+	rows, err := readCrdtRows(APIstub, o.index, []string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows come in key order, so the tags of an element are next to each other
+	elements := []string{}
+	for _, row := range rows {
+		if len(elements) == 0 || elements[len(elements)-1] != row.parts[0] {
+			elements = append(elements, row.parts[0])
+		}
+	}
+	return json.Marshal(elements)
+}
+
+func (o *orSet) compact(APIstub shim.ChaincodeStubInterface, name string) (int, error) {
+	rows, err := readCrdtRows(APIstub, o.index, []string{name})
+	if err != nil {
+		return 0, err
+	}
+
+	// Keep a single tag per element
+	redundant := []crdtRow{}
+	for i, row := range rows {
+		if i > 0 && rows[i-1].parts[0] == row.parts[0] {
+			redundant = append(redundant, row)
+		}
+	}
+	return len(redundant), delCrdtRows(APIstub, redundant)
+}
+
+// lwwRegister is a last-writer-wins register. Rows are keyed by the zero-padded transaction timestamp,
+// which the submitting client sets, then by transaction id to break ties, so the last row in key order
+// holds the current value.
+type lwwRegister struct {
+	index string
+}
+
+func (l *lwwRegister) indexName() string {
+	return l.index
+}
+
+func (l *lwwRegister) update(APIstub shim.ChaincodeStubInterface, name string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expecting a value")
+	}
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	timestamp := fmt.Sprintf("%020d", txTimestamp.Seconds*1e9+int64(txTimestamp.Nanos))
+	return putCrdtRow(APIstub, l.index, []string{name, timestamp, APIstub.GetTxID()}, []byte(args[0]))
+}
+
+func (l *lwwRegister) value(APIstub shim.ChaincodeStubInterface, name string) ([]byte, error) {
+	rows, err := readCrdtRows(APIstub, l.index, []string{name})
+	if err != nil {
+		return nil, err
+	} else if len(rows) == 0 {
+		return nil, fmt.Errorf("No register by the name %s exists", name)
+	}
+	return json.Marshal(string(rows[len(rows)-1].value))
+}
+
+func (l *lwwRegister) compact(APIstub shim.ChaincodeStubInterface, name string) (int, error) {
+	rows, err := readCrdtRows(APIstub, l.index, []string{name})
+	if err != nil || len(rows) <= 1 {
+		return 0, err
+	}
+	// Keep the last written row
+	return len(rows) - 1, delCrdtRows(APIstub, rows[:len(rows)-1])
+}
+
+// maxRegister is a register holding the largest decimal number written to it
+type maxRegister struct {
+	index string
+}
+
+func (m *maxRegister) indexName() string {
+	return m.index
+}
+
+/**
+ * Parses a number written to a max register, a decimal with an optional minus sign.
+ *
+ * @param str The number
+ *
+ * @return The exact value of the number
+ */
+func parseRegisterNumber(str string) (*big.Rat, error) {
+	if !decimalPattern.MatchString(strings.TrimPrefix(str, "-")) {
+		return nil, fmt.Errorf("%s is not a decimal number", str)
+	}
+	number, ok := new(big.Rat).SetString(str)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a decimal number", str)
+	}
+	return number, nil
+}
+
+func (m *maxRegister) update(APIstub shim.ChaincodeStubInterface, name string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expecting a number")
+	}
+	_, err := parseRegisterNumber(args[0])
+	if err != nil {
+		return err
+	}
+	return putCrdtRow(APIstub, m.index, []string{name, args[0], APIstub.GetTxID()}, []byte{0x00})
+}
+
+/**
+ * Sorts the rows of a max register by number, largest first.
+ *
+ * @param rows The rows of the register
+ *
+ * @return An error if a row does not hold a number
+ */
+func (m *maxRegister) sortRows(rows []crdtRow) error {
+	numbers := make(map[string]*big.Rat, len(rows))
+	for _, row := range rows {
+		number, err := parseRegisterNumber(row.parts[0])
+		if err != nil {
+			return err
+		}
+		numbers[row.key] = number
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return numbers[rows[i].key].Cmp(numbers[rows[j].key]) > 0
+	})
+	return nil
+}
+
+func (m *maxRegister) value(APIstub shim.ChaincodeStubInterface, name string) ([]byte, error) {
+	rows, err := readCrdtRows(APIstub, m.index, []string{name})
+	if err != nil {
+		return nil, err
+	} else if len(rows) == 0 {
+		return nil, fmt.Errorf("No register by the name %s exists", name)
+	}
+	err = m.sortRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(rows[0].parts[0]), nil
+}
+
+func (m *maxRegister) compact(APIstub shim.ChaincodeStubInterface, name string) (int, error) {
+	rows, err := readCrdtRows(APIstub, m.index, []string{name})
+	if err != nil || len(rows) <= 1 {
+		return 0, err
+	}
+	err = m.sortRows(rows)
+	if err != nil {
+		return 0, err
+	}
+	// Keep the largest number
+	return len(rows) - 1, delCrdtRows(APIstub, rows[1:])
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounters(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	for _, amount := range []string{"3", "4", "5"} {
+		expectSuccess(t, s.invoke(tom, "crdtupdate", "gcounter", "visits", amount))
+	}
+	expectError(t, s.invoke(tom, "crdtupdate", "gcounter", "visits", "1", "-"), "Expecting an amount")
+	expectError(t, s.invoke(tom, "crdtupdate", "gcounter", "visits", "1.5"), "more than 0 digits")
+	expectError(t, s.invoke(tom, "crdtupdate", "gcounter", "visits", "-1"), "not a decimal number")
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "gcounter", "visits")); got != "12" {
+		t.Fatalf("expected 12 visits, got %s", got)
+	}
+
+	expectSuccess(t, s.invoke(tom, "crdtupdate", "pncounter", "stock", "5", "+"))
+	expectSuccess(t, s.invoke(tom, "crdtupdate", "pncounter", "stock", "8", "-"))
+	expectError(t, s.invoke(tom, "crdtupdate", "pncounter", "stock", "8"), "Expecting an amount and an operation")
+	expectError(t, s.invoke(tom, "crdtupdate", "pncounter", "stock", "8", "*"), "Operator * is unrecognized")
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "pncounter", "stock")); got != "-3" {
+		t.Fatalf("expected a stock of -3, got %s", got)
+	}
+	if got := expectSuccess(t, s.invoke(tom, "crdtcompact", "pncounter", "stock")); got != "Compacted pncounter stock, 1 rows removed" {
+		t.Fatalf("unexpected compaction %s", got)
+	}
+	if n := countRows(t, s, "pncounter~name~op~value~txID", "stock"); n != 1 {
+		t.Fatalf("expected a single row after compaction, got %d", n)
+	}
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "pncounter", "stock")); got != "-3" {
+		t.Fatalf("expected compaction to keep the stock, got %s", got)
+	}
+
+	// each type has its own keyspace
+	expectError(t, s.invoke(tom, "crdtget", "gcounter", "stock"), "No gcounter by the name stock exists")
+	expectError(t, s.invoke(tom, "crdtupdate", "bag", "stock", "1"), "Type bag is unrecognized")
+}
+
+func TestObservedRemoveSet(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	for _, element := range []string{"b", "a", "b", "ab"} {
+		expectSuccess(t, s.invoke(tom, "crdtupdate", "orset", "tags", "add", element))
+	}
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "orset", "tags")); got != `["a","ab","b"]` {
+		t.Fatalf("unexpected set %s", got)
+	}
+	if got := expectSuccess(t, s.invoke(tom, "crdtcompact", "orset", "tags")); got != "Compacted orset tags, 1 rows removed" {
+		t.Fatalf("unexpected compaction %s", got)
+	}
+
+	// removing a leaves ab alone
+	expectSuccess(t, s.invoke(tom, "crdtupdate", "orset", "tags", "remove", "a"))
+	expectError(t, s.invoke(tom, "crdtupdate", "orset", "tags", "remove", "a"), "a is not in the set")
+	expectError(t, s.invoke(tom, "crdtupdate", "orset", "tags", "clear", "a"), "Set operation clear is unrecognized")
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "orset", "tags")); got != `["ab","b"]` {
+		t.Fatalf("unexpected set after remove %s", got)
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	expectError(t, s.invoke(tom, "crdtget", "lwwregister", "status"), "No lwwregister by the name status exists")
+	expectSuccess(t, s.invoke(tom, "crdtupdate", "lwwregister", "status", "open"))
+	s.advance(time.Second)
+	expectSuccess(t, s.invoke(tom, "crdtupdate", "lwwregister", "status", "closed"))
+	s.advance(-time.Minute)
+	expectSuccess(t, s.invoke(tom, "crdtupdate", "lwwregister", "status", "stale"))
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "lwwregister", "status")); got != `"closed"` {
+		t.Fatalf("expected the latest write by timestamp, got %s", got)
+	}
+	expectSuccess(t, s.invoke(tom, "crdtcompact", "lwwregister", "status"))
+	if n := countRows(t, s, "lwwregister~name~timestamp~txID", "status"); n != 1 {
+		t.Fatalf("expected a single row after compaction, got %d", n)
+	}
+
+	for _, number := range []string{"9.5", "-20", "10", "09.75"} {
+		expectSuccess(t, s.invoke(tom, "crdtupdate", "maxregister", "peak", number))
+	}
+	expectError(t, s.invoke(tom, "crdtupdate", "maxregister", "peak", "1e3"), "not a decimal number")
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "maxregister", "peak")); got != "10" {
+		t.Fatalf("expected a peak of 10, got %s", got)
+	}
+	if got := expectSuccess(t, s.invoke(tom, "crdtcompact", "maxregister", "peak")); got != "Compacted maxregister peak, 3 rows removed" {
+		t.Fatalf("unexpected compaction %s", got)
+	}
+	if got := expectSuccess(t, s.invoke(tom, "crdtget", "maxregister", "peak")); got != "10" {
+		t.Fatalf("expected compaction to keep the peak, got %s", got)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Fixed-point decimal values for the aggregate variables. Each variable declares a scale, the number of
+ * digits after the decimal point, and every delta is held as an exact integer count of units of
+ * 10^-scale. Sums of such integers do not depend on the order in which the deltas are added, so get and
+ * prune give the same result on every peer, however the delta rows are returned.
+ *
+ * Delta rows written before scales were declared hold whatever strconv.ParseFloat accepted, e.g. 1e3 or
+ * -2.5. They are read exactly as decimals, see parseLegacyDecimal, and never rewritten.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// maxScale is the largest number of digits allowed after the decimal point of a variable
+const maxScale = 18
+
+// maxDecimalDigits is the largest number of digits, before and after the decimal point, of a single delta
+const maxDecimalDigits = 38
+
+// decimalPattern matches a non-negative decimal number without sign or exponent, e.g. 12 or 12.50
+var decimalPattern = regexp.MustCompile(`^([0-9]+)(?:\.([0-9]+))?$`)
+
+/**
+ * Returns the number of digits after the decimal point of a decimal string, or 0 if it is not a
+ * valid decimal, in which case parseDecimal reports the error.
+ *
+ * @param str The decimal string
+ *
+ * @return The number of fractional digits
+ */
+func fractionDigits(str string) int {
+	match := decimalPattern.FindStringSubmatch(str)
+	if match == nil {
+		return 0
+	}
+	return len(match[2])
+}
+
+/**
+ * Converts a non-negative decimal string into an integer count of units of 10^-scale. Digits beyond
+ * the scale are only accepted when they are zeros, so no value is ever rounded.
+ *
+ * @param str The decimal string, e.g. 12.5
+ * @param scale The number of digits after the decimal point of the variable
+ *
+ * @return The value in units of 10^-scale, e.g. 1250 for a scale of 2
+ */
+func parseDecimal(str string, scale int) (*big.Int, error) {
+	match := decimalPattern.FindStringSubmatch(str)
+	if match == nil {
+		return nil, fmt.Errorf("%s is not a decimal number, expecting digits with an optional decimal point and no sign", str)
+	}
+	integerPart := strings.TrimLeft(match[1], "0")
+	fractionPart := match[2]
+
+	if len(fractionPart) > scale {
+		if strings.Trim(fractionPart[scale:], "0") != "" {
+			return nil, fmt.Errorf("%s has more than %d digits after the decimal point", str, scale)
+		}
+		fractionPart = fractionPart[:scale]
+	}
+	fractionPart += strings.Repeat("0", scale-len(fractionPart))
+
+	if len(integerPart)+scale > maxDecimalDigits {
+		return nil, fmt.Errorf("%s overflows the %d digits allowed for a value with %d digits after the decimal point", str, maxDecimalDigits, scale)
+	}
+
+	digits := integerPart + fractionPart
+	if digits == "" {
+		digits = "0"
+	}
+	units, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a decimal number", str)
+	}
+	return units, nil
+}
+
+/**
+ * Same as parseDecimal, but also accepts a leading minus sign.
+ *
+ * @param str The decimal string, e.g. -12.5
+ * @param scale The number of digits after the decimal point of the variable
+ *
+ * @return The value in units of 10^-scale, e.g. -1250 for a scale of 2
+ */
+func parseSignedDecimal(str string, scale int) (*big.Int, error) {
+	if strings.HasPrefix(str, "-") {
+		units, err := parseDecimal(str[1:], scale)
+		if err != nil {
+			return nil, err
+		}
+		return units.Neg(units), nil
+	}
+	return parseDecimal(str, scale)
+}
+
+/**
+ * Converts an integer count of units of 10^-scale back into a decimal string with exactly scale
+ * digits after the decimal point.
+ *
+ * @param units The value in units of 10^-scale
+ * @param scale The number of digits after the decimal point of the variable
+ *
+ * @return The decimal string, e.g. -12.50 for -1250 units at a scale of 2
+ */
+func formatDecimal(units *big.Int, scale int) string {
+	digits := new(big.Int).Abs(units).String()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+
+	str := digits
+	if scale > 0 {
+		str = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if units.Sign() < 0 {
+		str = "-" + str
+	}
+	return str
+}
+
+/**
+ * Reads the value of a delta row written before scales were declared, which may use exponent notation
+ * or carry its own sign.
+ *
+ * @param str The value of the row, e.g. 1e3 or -2.5
+ *
+ * @return The exact value and the number of digits after the decimal point needed to hold it
+ */
+func parseLegacyDecimal(str string) (*big.Rat, int, error) {
+	value, ok := new(big.Rat).SetString(str)
+	if !ok {
+		return nil, 0, fmt.Errorf("%s is not a number", str)
+	}
+
+	// The scale is the smallest power of ten the denominator divides
+	power := big.NewInt(1)
+	for scale := 0; scale <= maxScale; scale++ {
+		if new(big.Int).Mod(power, value.Denom()).Sign() == 0 {
+			return value, scale, nil
+		}
+		power.Mul(power, big.NewInt(10))
+	}
+	return nil, 0, fmt.Errorf("%s has more than %d digits after the decimal point", str, maxScale)
+}
+
+/**
+ * Converts the value of a delta row written before scales were declared into units of 10^-scale.
+ *
+ * @param str The value of the row, e.g. 1e3 or -2.5
+ * @param scale The number of digits after the decimal point of the variable
+ *
+ * @return The value in units of 10^-scale, which may be negative
+ */
+func parseLegacyUnits(str string, scale int) (*big.Int, error) {
+	value, valueScale, err := parseLegacyDecimal(str)
+	if err != nil {
+		return nil, err
+	}
+	if valueScale > scale {
+		return nil, fmt.Errorf("%s has more than %d digits after the decimal point", str, scale)
+	}
+	units := new(big.Rat).Mul(value, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	if len(new(big.Int).Abs(units.Num()).String()) > maxDecimalDigits {
+		return nil, fmt.Errorf("%s overflows the %d digits allowed for a value with %d digits after the decimal point", str, maxDecimalDigits, scale)
+	}
+	return units.Num(), nil
+}
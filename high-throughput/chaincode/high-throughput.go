@@ -13,7 +13,8 @@
  * is then an aggregate of the initial value combined with all of the deltas. Additionally, a pruning
  * function is provided which aggregates and deletes the deltas to update the initial value. This should
  * be done during a maintenance window or when there is a lowered transaction volume, to avoid the proliferation
- * of millions of rows of data.
+ * of millions of rows of data. Alternatively, compact folds given delta rows into a checkpoint of the value
+ * while updates continue.
  *
  * @author	Alexandre Pauwels for IBM
  * @created	17 Aug 2017
@@ -27,6 +28,7 @@ package main
  */
 import (
 	"fmt"
+	"math/big"
 	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -50,11 +52,25 @@ func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
 
 // Invoke routes invocations to the appropriate function in chaincode
 // Current supported invocations are:
-//	- update, adds a delta to an aggregate variable in the ledger, all variables are assumed to start at 0
+//	- update, adds a decimal delta to an aggregate variable in the ledger, all variables are assumed to start at 0
 //	- get, retrieves the aggregate value of a variable in the ledger
-//	- pruneFast, deletes all rows associated with the variable and replaces them with a single row containing the aggregate value
+//	- pruneFast, deletes all delta rows of the variable and folds their aggregate into its checkpoint row
 //	- pruneSafe, same as pruneFast except it pre-computed the value and backs it up before performing any destructive operations
+//	- pruneBatch, same as pruneFast but folds a limited number of rows per call, resuming from a cursor
 //	- delete, removes all rows associated with the variable
+//	- deltas, lists delta rows of a variable not yet folded into its checkpoint
+//	- compact, folds a given set of delta rows into the checkpoint, while updates continue
+//	- getasof, retrieves the value of a variable at a point in time
+//	- getwindow, retrieves the sum of the deltas of a variable between two points in time
+//	- crdtupdate, crdtget and crdtcompact, update, read and compact the conflict-free data types of crdt.go
+//	- declare, defines a variable with lower and/or upper bounds
+//	- reserve, takes capacity towards a bound of a bounded variable from one of its quota buckets
+//	- commit, applies a reservation as a delta of the variable
+//	- release, returns the capacity of a reservation to its quota bucket
+//	- rebalance, spreads the remaining capacity of a bounded variable evenly over its quota buckets
+//	- setacl, replaces the list of clients allowed to read, write or administer a variable or CRDT value, for its owner
+//	- transferowner and acceptowner, hand a variable or CRDT value over to another client
+//	- whoami, returns the identity of the calling client
 func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response {
 	// Retrieve the requested Smart Contract function and arguments
 	function, args := APIstub.GetFunctionAndParameters()
@@ -68,8 +84,42 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.pruneFast(APIstub, args)
 	} else if function == "prunesafe" {
 		return s.pruneSafe(APIstub, args)
+	} else if function == "prunebatch" {
+		return s.pruneBatch(APIstub, args)
 	} else if function == "delete" {
 		return s.delete(APIstub, args)
+	} else if function == "deltas" {
+		return s.deltas(APIstub, args)
+	} else if function == "compact" {
+		return s.compact(APIstub, args)
+	} else if function == "getasof" {
+		return s.getAsOf(APIstub, args)
+	} else if function == "getwindow" {
+		return s.getWindow(APIstub, args)
+	} else if function == "crdtupdate" {
+		return s.crdtUpdate(APIstub, args)
+	} else if function == "crdtget" {
+		return s.crdtGet(APIstub, args)
+	} else if function == "crdtcompact" {
+		return s.crdtCompact(APIstub, args)
+	} else if function == "declare" {
+		return s.declare(APIstub, args)
+	} else if function == "reserve" {
+		return s.reserve(APIstub, args)
+	} else if function == "commit" {
+		return s.commit(APIstub, args)
+	} else if function == "release" {
+		return s.release(APIstub, args)
+	} else if function == "rebalance" {
+		return s.rebalance(APIstub, args)
+	} else if function == "setacl" {
+		return s.setACL(APIstub, args)
+	} else if function == "transferowner" {
+		return s.transferOwner(APIstub, args)
+	} else if function == "acceptowner" {
+		return s.acceptOwner(APIstub, args)
+	} else if function == "whoami" {
+		return s.whoAmI(APIstub, args)
 	} else if function == "putstandard" {
 		return s.putStandard(APIstub, args)
 	} else if function == "getstandard" {
@@ -81,11 +131,14 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 
 /**
  * Updates the ledger to include a new delta for a particular variable. If this is the first time
- * this variable is being added to the ledger, then its initial value is assumed to be 0. The arguments
- * to give in the args array are as follows:
+ * this variable is being added to the ledger, then its initial value is assumed to be 0 and the
+ * variable is defined with the given scale. The arguments to give in the args array are as follows:
  *	- args[0] -> name of the variable
- *	- args[1] -> new delta (float)
+ *	- args[1] -> new delta (non-negative decimal, e.g. 12.50)
  *	- args[2] -> operation (currently supported are addition "+" and subtraction "-")
+ *	- args[3] -> optional, number of digits after the decimal point of the variable; on first use it
+ *	             defaults to the number of digits after the decimal point of the delta, afterwards it
+ *	             must match the declared scale
  *
  * @param APIstub The chaincode shim
  * @param args The arguments array for the update invocation
@@ -94,45 +147,90 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
  */
 func (s *SmartContract) update(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	// Check we have a valid number of args
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments, expecting 3")
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments, expecting 3 or 4")
 	}
 
 	// Extract the args
 	name := args[0]
 	op := args[2]
-	_, err := strconv.ParseFloat(args[1], 64)
-	if err != nil {
-		return shim.Error("Provided value was not a number")
-	}
 
 	// Make sure a valid operator is provided
 	if op != "+" && op != "-" {
 		return shim.Error(fmt.Sprintf("Operator %s is unrecognized", op))
 	}
 
-	// Retrieve info needed for the update procedure
-	txid := APIstub.GetTxID()
-	compositeIndexName := "varName~op~value~txID"
+	// Retrieve the definition of the variable, declaring it on first use
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if v == nil {
+		scale := fractionDigits(args[1])
+		if len(args) == 4 {
+			scale, err = strconv.Atoi(args[3])
+			if err != nil || scale < 0 || scale > maxScale {
+				return shim.Error(fmt.Sprintf("Scale must be a whole number between 0 and %d", maxScale))
+			}
+		}
+		v = &variable{Name: name, Scale: scale}
+		err = setOwner(APIstub, v)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = putVariable(APIstub, v)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not define variable %s: %s", name, err.Error()))
+		}
+	} else if len(args) == 4 && args[3] != strconv.Itoa(v.Scale) {
+		return shim.Error(fmt.Sprintf("Variable %s is declared with scale %d", name, v.Scale))
+	} else {
+		err = authorizeVariable(APIstub, v, permissionWrite)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if v.legacy {
+			err = putVariable(APIstub, v)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("Could not define variable %s: %s", name, err.Error()))
+			}
+		}
+	}
+
+	// Convert the delta to an exact number of units of the variable's scale
+	units, err := parseDecimal(args[1], v.Scale)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Invalid value for %s: %s", name, err.Error()))
+	}
+	if op == "-" {
+		units.Neg(units)
+	}
+
+	// Deltas towards a bound must go through a reservation, see bounds.go
+	if v.bounded(op) {
+		return shim.Error(fmt.Sprintf("Variable %s is bounded, use reserve and commit to apply %s deltas", name, op))
+	}
 
-	// Create the composite key that will allow us to query for all deltas on a particular variable
-	compositeKey, compositeErr := APIstub.CreateCompositeKey(compositeIndexName, []string{name, op, args[1], txid})
-	if compositeErr != nil {
-		return shim.Error(fmt.Sprintf("Could not create a composite key for %s: %s", name, compositeErr.Error()))
+	// Save the delta row
+	err = putDelta(APIstub, v, units)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not put operation for %s in the ledger: %s", name, err.Error()))
 	}
 
-	// Save the composite key index
-	compositePutErr := APIstub.PutState(compositeKey, []byte{0x00})
-	if compositePutErr != nil {
-		return shim.Error(fmt.Sprintf("Could not put operation for %s in the ledger: %s", name, compositePutErr.Error()))
+	// Moving away from a bound leaves more capacity before it
+	if v.Buckets > 0 {
+		err = creditQuota(APIstub, v, oppositeOp(op), new(big.Int).Abs(units))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 
-	return shim.Success([]byte(fmt.Sprintf("Successfully added %s%s to %s", op, args[1], name)))
+	return shim.Success([]byte(fmt.Sprintf("Successfully added %s%s to %s", op, formatDecimal(new(big.Int).Abs(units), v.Scale), name)))
 }
 
 /**
- * Retrieves the aggregate value of a variable in the ledger. Gets all delta rows for the variable
- * and computes the final value from all deltas. The args array for the invocation must contain the
+ * Retrieves the aggregate value of a variable in the ledger. Gets the checkpoint and all delta rows
+ * not yet folded into it, and computes the final value from them. The args array for the invocation must contain the
  * following argument:
  *	- args[0] -> The name of the variable to get the value of
  *
@@ -148,61 +246,32 @@ func (s *SmartContract) get(APIstub shim.ChaincodeStubInterface, args []string)
 	}
 
 	name := args[0]
-	// Get all deltas for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
-	}
-	defer deltaResultsIterator.Close()
-
 	// Check the variable existed
-	if !deltaResultsIterator.HasNext() {
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
 		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
 	}
+	err = authorizeVariable(APIstub, v, permissionRead)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Iterate through result set and compute final value
-	var finalVal float64
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		// Get the next row
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(nextErr.Error())
-		}
-
-		// Split the composite key into its component parts
-		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
-		if splitKeyErr != nil {
-			return shim.Error(splitKeyErr.Error())
-		}
-
-		// Retrieve the delta value and operation
-		operation := keyParts[1]
-		valueStr := keyParts[2]
-
-		// Convert the value string and perform the operation
-		value, convErr := strconv.ParseFloat(valueStr, 64)
-		if convErr != nil {
-			return shim.Error(convErr.Error())
-		}
-
-		switch operation {
-		case "+":
-			finalVal += value
-		case "-":
-			finalVal -= value
-		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
-		}
+	// Compute the final value from the checkpoint and the remaining deltas
+	finalVal, err := currentValue(APIstub, v)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success([]byte(strconv.FormatFloat(finalVal, 'f', -1, 64)))
+	return shim.Success([]byte(formatDecimal(finalVal, v.Scale)))
 }
 
 /**
- * Prunes a variable by deleting all of its delta rows while computing the final value. Once all rows
- * have been processed and deleted, a single new row is added which defines a delta containing the final
- * computed value of the variable. This function is NOT safe as any failures or errors during pruning
+ * Prunes a variable by deleting all of its delta rows while computing their aggregate. Once all rows
+ * have been processed and deleted, their aggregate is folded into the checkpoint of the variable, which
+ * then holds its final value. Unlike compact, this scans every row of the variable, so it conflicts with
+ * concurrent updates and should be run when the variable is quiet. This function is NOT safe as any failures or errors during pruning
  * will result in an undefined final value for the variable and loss of data. Use pruneSafe if data
  * integrity is important. The args array contains the following argument:
  *	- args[0] -> The name of the variable to prune
@@ -221,75 +290,39 @@ func (s *SmartContract) pruneFast(APIstub shim.ChaincodeStubInterface, args []st
 	// Retrieve the name of the variable to prune
 	name := args[0]
 
-	// Get all delta rows for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
-	}
-	defer deltaResultsIterator.Close()
-
 	// Check the variable existed
-	if !deltaResultsIterator.HasNext() {
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
 		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
 	}
+	err = authorizeVariable(APIstub, v, permissionAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Iterate through result set computing final value while iterating and deleting each key
-	var finalVal float64
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		// Get the next row
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(nextErr.Error())
-		}
-
-		// Split the key into its composite parts
-		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
-		if splitKeyErr != nil {
-			return shim.Error(splitKeyErr.Error())
-		}
-
-		// Retrieve the operation and value
-		operation := keyParts[1]
-		valueStr := keyParts[2]
-
-		// Convert the value to a float
-		value, convErr := strconv.ParseFloat(valueStr, 64)
-		if convErr != nil {
-			return shim.Error(convErr.Error())
-		}
-
-		// Delete the row from the ledger
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
-		}
-
-		// Add the value of the deleted row to the final aggregate
-		switch operation {
-		case "+":
-			finalVal += value
-		case "-":
-			finalVal -= value
-		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
-		}
+	// Compute the aggregate of the deltas while deleting each delta row
+	periods := rollups{}
+	folded, keys, err := sumDeltas(APIstub, v, true, periods)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	// Update the ledger with the final value and return
-	updateResp := s.update(APIstub, []string{name, strconv.FormatFloat(finalVal, 'f', -1, 64), "+"})
-	if updateResp.Status == OK {
-		return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %f, %d rows pruned", args[0], finalVal, i)))
+	// Fold the aggregate into the checkpoint and return
+	cp, err := foldIntoCheckpoint(APIstub, v, folded, keys, periods)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to prune variable: all rows deleted but could not update the checkpoint, variable value is lost: %s", err.Error()))
 	}
 
-	return shim.Error(fmt.Sprintf("Failed to prune variable: all rows deleted but could not update value to %f, variable no longer exists in ledger", finalVal))
+	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %s, %d rows pruned", name, cp.Value, len(keys))))
 }
 
 /**
  * This function performs the same function as pruneFast except it provides data backups in case the
  * prune fails. The final aggregate value is computed before any deletion occurs and is backed up
- * to a new row. This back-up row is deleted only after the new aggregate delta has been successfully
- * written to the ledger. The args array contains the following argument:
+ * to a new row. This back-up row is deleted only after the checkpoint holding the final value has
+ * been successfully written to the ledger. The args array contains the following argument:
  *	args[0] -> The name of the variable to prune
  *
  * @param APIstub The chaincode shim
@@ -306,16 +339,29 @@ func (s *SmartContract) pruneSafe(APIstub shim.ChaincodeStubInterface, args []st
 	// Get the var name
 	name := args[0]
 
-	// Get the var's value and process it
-	getResp := s.get(APIstub, args)
-	if getResp.Status == ERROR {
-		return shim.Error(fmt.Sprintf("Could not retrieve the value of %s before pruning, pruning aborted: %s", name, getResp.Message))
+	// Get the var's value
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve the value of %s before pruning, pruning aborted: %s", name, err.Error()))
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve the value of %s before pruning, pruning aborted: no variable by the name %s exists", name, name))
 	}
+	err = authorizeVariable(APIstub, v, permissionAdmin)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("%s, pruning aborted", err.Error()))
+	}
+	val, err := currentValue(APIstub, v)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve the value of %s before pruning, pruning aborted: %s", name, err.Error()))
+	}
+	valueStr := formatDecimal(val, v.Scale)
 
-	valueStr := string(getResp.Payload)
-	val, convErr := strconv.ParseFloat(valueStr, 64)
-	if convErr != nil {
-		return shim.Error(fmt.Sprintf("Could not convert the value of %s to a number before pruning, pruning aborted: %s", name, convErr.Error()))
+	// Do not fold the rows of a batched prune in progress
+	run, err := getPruneRun(APIstub, name)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("%s, pruning aborted", err.Error()))
+	} else if run != nil {
+		return shim.Error(fmt.Sprintf("A batched prune of %s is in progress, finish it with cursor %s, pruning aborted", name, run.Cursor))
 	}
 
 	// Store the var's value temporarily
@@ -324,31 +370,17 @@ func (s *SmartContract) pruneSafe(APIstub shim.ChaincodeStubInterface, args []st
 		return shim.Error(fmt.Sprintf("Could not backup the value of %s before pruning, pruning aborted: %s", name, backupPutErr.Error()))
 	}
 
-	// Get all deltas for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
-	}
-	defer deltaResultsIterator.Close()
-
 	// Delete each row
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(fmt.Sprintf("Could not retrieve next row for pruning: %s", nextErr.Error()))
-		}
-
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
-		}
+	periods := rollups{}
+	folded, keys, err := sumDeltas(APIstub, v, true, periods)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not delete delta rows for pruning: %s", err.Error()))
 	}
 
-	// Insert new row for the final value
-	updateResp := s.update(APIstub, []string{name, valueStr, "+"})
-	if updateResp.Status == ERROR {
-		return shim.Error(fmt.Sprintf("Could not insert the final value of the variable after pruning, variable backup is stored in %s_PRUNE_BACKUP: %s", name, updateResp.Message))
+	// Fold the deleted rows into the checkpoint, which then holds the final value
+	_, err = foldIntoCheckpoint(APIstub, v, folded, keys, periods)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not insert the final value of the variable after pruning, variable backup is stored in %s_PRUNE_BACKUP: %s", name, err.Error()))
 	}
 
 	// Delete the backup value
@@ -357,12 +389,12 @@ func (s *SmartContract) pruneSafe(APIstub shim.ChaincodeStubInterface, args []st
 		return shim.Error(fmt.Sprintf("Could not delete backup value %s_PRUNE_BACKUP, this does not affect the ledger but should be removed manually", name))
 	}
 
-	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %f, %d rows pruned", name, val, i)))
+	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %s, %d rows pruned", name, valueStr, len(keys))))
 }
 
 /**
- * Deletes all rows associated with an aggregate variable from the ledger. The args array
- * contains the following argument:
+ * Deletes all rows associated with an aggregate variable from the ledger, including its definition and a batched prune in progress.
+ * The args array contains the following argument:
  *	- args[0] -> The name of the variable to delete
  *
  * @param APIstub The chaincode shim
@@ -379,46 +411,40 @@ func (s *SmartContract) delete(APIstub shim.ChaincodeStubInterface, args []strin
 	// Retrieve the variable name
 	name := args[0]
 
-	// Delete all delta rows
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve delta rows for %s: %s", name, deltaErr.Error()))
-	}
-	defer deltaResultsIterator.Close()
-
 	// Ensure the variable exists
-	if !deltaResultsIterator.HasNext() {
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
 		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
 	}
+	err = authorizeVariable(APIstub, v, permissionAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Iterate through result set and delete all indices
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(fmt.Sprintf("Could not retrieve next delta row: %s", nextErr.Error()))
-		}
+	// Delete all delta rows
+	_, keys, err := sumDeltas(APIstub, v, true, nil)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not delete delta rows for %s: %s", name, err.Error()))
+	}
 
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
+	// Delete the checkpoint, its fold records and the rollups, the quota buckets and pending reservations of a bounded variable,
+	// and the run row of a batched prune in progress
+	for _, indexName := range []string{checkpointIndexName, foldIndexName, rollupIndexName, quotaIndexName, quotaCreditIndexName, reservationIndexName, pruneRunIndexName} {
+		err = deleteRows(APIstub, indexName, name)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
 	}
 
-	return shim.Success([]byte(fmt.Sprintf("Deleted %s, %d rows removed", name, i)))
-}
-
-/**
- * Converts a float64 to a byte array
- *
- * @param f The float64 to convert
- *
- * @return The byte array representation
- */
-func f2barr(f float64) []byte {
-	str := strconv.FormatFloat(f, 'f', -1, 64)
+	// Delete the definition, so the variable can be declared again with another scale
+	err = delVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not delete the definition of %s: %s", name, err.Error()))
+	}
 
-	return []byte(str)
+	return shim.Success([]byte(fmt.Sprintf("Deleted %s, %d rows removed", name, len(keys))))
 }
 
 // The main function is only relevant in unit test mode. Only included here for completeness.
@@ -0,0 +1,219 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Batched pruning. pruneFast and pruneSafe fold every delta row of a variable in one transaction, which
+ * exceeds the proposal size and execution time limits once a variable has millions of rows. pruneBatch folds
+ * at most a given number of rows into the checkpoint per call, and returns a cursor to pass to the next call
+ * until the variable is fully pruned. Each batch is a transaction of its own, so a failed batch changes
+ * nothing and can simply be sent again. The run row of the variable is written by the first batch, records
+ * the checkpoint the run started from and its progress, and is only deleted by the final batch, so an
+ * unfinished run can be found and resumed with the cursor it holds. The row is kept under a composite key,
+ * which clients cannot write with putstandard.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxPruneBatchRows is the largest number of delta rows folded by a single pruneBatch call
+const maxPruneBatchRows = 10000
+
+// pruneRunIndexName is the composite key of the run row of a variable being pruned in batches
+const pruneRunIndexName = "varName~pruneRun"
+
+// pruneRun is the progress of a batched prune, stored in the run row of the variable
+type pruneRun struct {
+	Cursor     string `json:"cursor"`     // id of the run, the transaction id of its first batch
+	Checkpoint string `json:"checkpoint"` // checkpoint value of the variable when the run started
+	Rows       int    `json:"rows"`       // number of delta rows folded so far
+	Batches    int    `json:"batches"`    // number of batches completed so far
+}
+
+// pruneBatchResult is returned by each pruneBatch call
+type pruneBatchResult struct {
+	Cursor     string `json:"cursor"`     // cursor for the next batch, empty once the variable is fully pruned
+	Rows       int    `json:"rows"`       // number of delta rows folded by this batch
+	TotalRows  int    `json:"totalRows"`  // number of delta rows folded by the run so far
+	Checkpoint string `json:"checkpoint"` // checkpoint value after this batch
+}
+
+/**
+ * Folds at most a given number of delta rows of a variable into its checkpoint and deletes them. The
+ * args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> largest number of rows to fold
+ *	- args[2] -> the cursor returned by the previous batch, or empty to start a run
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the pruneBatch invocation
+ *
+ * @return A response structure holding the result of the batch as JSON
+ */
+func (s *SmartContract) pruneBatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+
+	name := args[0]
+	limit, err := strconv.Atoi(args[1])
+	if err != nil || limit < 1 || limit > maxPruneBatchRows {
+		return shim.Error(fmt.Sprintf("Batch size must be a whole number between 1 and %d", maxPruneBatchRows))
+	}
+	cursor := args[2]
+
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+	err = authorizeVariable(APIstub, v, permissionAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Start or resume the run recorded in the run row
+	run, err := getPruneRun(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if cursor == "" {
+		if run != nil {
+			return shim.Error(fmt.Sprintf("A prune of %s is already in progress, resume it with cursor %s", name, run.Cursor))
+		}
+		cp, err := getCheckpoint(APIstub, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		startValue, err := checkpointValue(cp, v)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		run = &pruneRun{Cursor: APIstub.GetTxID(), Checkpoint: formatDecimal(startValue, v.Scale)}
+	} else if run == nil || run.Cursor != cursor {
+		return shim.Error(fmt.Sprintf("Cursor %s does not match a prune in progress of %s", cursor, name))
+	}
+
+	// Fold the first rows of the variable; the rows of previous batches are already deleted
+	deltaResultsIterator, err := APIstub.GetStateByPartialCompositeKey(deltaIndexName, []string{name})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, err.Error()))
+	}
+	defer deltaResultsIterator.Close()
+
+	folded := new(big.Int)
+	periods := rollups{}
+	keys := []string{}
+	for len(keys) < limit && deltaResultsIterator.HasNext() {
+		responseRange, err := deltaResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		value, err := signedDelta(keyParts[1], keyParts[2], v.Scale)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		rowTime, err := parseDeltaTimestamp(responseRange.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		folded.Add(folded, value)
+		periods.add(rowTime, value)
+
+		err = APIstub.DelState(responseRange.Key)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", err.Error()))
+		}
+		keys = append(keys, responseRange.Key)
+	}
+	done := !deltaResultsIterator.HasNext()
+
+	cp, err := foldIntoCheckpoint(APIstub, v, folded, keys, periods)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Record the progress, or end the run with the final batch
+	run.Rows += len(keys)
+	run.Batches++
+	result := &pruneBatchResult{Cursor: run.Cursor, Rows: len(keys), TotalRows: run.Rows, Checkpoint: cp.Value}
+	if done {
+		result.Cursor = ""
+		err = deleteRows(APIstub, pruneRunIndexName, name)
+	} else {
+		err = putPruneRun(APIstub, name, run)
+	}
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not update the prune run of %s: %s", name, err.Error()))
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultBytes)
+}
+
+/**
+ * Retrieves the batched prune in progress from the run row of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The run, or nil if no batched prune is in progress
+ */
+func getPruneRun(APIstub shim.ChaincodeStubInterface, name string) (*pruneRun, error) {
+	runKey, err := APIstub.CreateCompositeKey(pruneRunIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	runBytes, err := APIstub.GetState(runKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the prune run of %s: %s", name, err.Error())
+	} else if runBytes == nil {
+		return nil, nil
+	}
+
+	run := &pruneRun{}
+	err = json.Unmarshal(runBytes, run)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode the prune run of %s: %s", name, err.Error())
+	}
+	return run, nil
+}
+
+/**
+ * Stores the progress of a batched prune in the run row of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param run The progress of the run
+ *
+ * @return An error if the row could not be stored
+ */
+func putPruneRun(APIstub shim.ChaincodeStubInterface, name string, run *pruneRun) error {
+	runKey, err := APIstub.CreateCompositeKey(pruneRunIndexName, []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	runBytes, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(runKey, runBytes)
+}
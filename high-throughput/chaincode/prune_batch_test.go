@@ -0,0 +1,96 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func pruneBatchTest(t *testing.T, s *testStub, creator []byte, name string, limit string, cursor string) *pruneBatchResult {
+	t.Helper()
+	result := &pruneBatchResult{}
+	err := json.Unmarshal([]byte(expectSuccess(t, s.invoke(creator, "prunebatch", name, limit, cursor))), result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestPruneBatchResumesWithCursor(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	for i := 1; i <= 5; i++ {
+		expectSuccess(t, s.invoke(tom, "update", "myvar", fmt.Sprintf("%d", i), "+"))
+	}
+	runKey, _ := s.CreateCompositeKey(pruneRunIndexName, []string{"myvar"})
+
+	first := pruneBatchTest(t, s, tom, "myvar", "2", "")
+	if first.Cursor == "" || first.Rows != 2 || first.TotalRows != 2 || s.State[runKey] == nil {
+		t.Fatalf("expected a run in progress, got %+v", first)
+	}
+	expectValue(t, s, tom, "myvar", "15")
+
+	// ==== Only the cursor of the run in progress resumes it ====
+	expectError(t, s.invoke(tom, "prunebatch", "myvar", "2", ""), "already in progress")
+	expectError(t, s.invoke(tom, "prunebatch", "myvar", "2", "tx0"), "does not match")
+	expectError(t, s.invoke(tom, "prunesafe", "myvar"), "batched prune of myvar is in progress")
+	expectError(t, s.invoke(tom, "prunebatch", "myvar", "0", first.Cursor), "Batch size must be")
+
+	second := pruneBatchTest(t, s, tom, "myvar", "2", first.Cursor)
+	if second.Cursor != first.Cursor || second.TotalRows != 4 {
+		t.Fatalf("expected the run to continue, got %+v", second)
+	}
+	last := pruneBatchTest(t, s, tom, "myvar", "2", first.Cursor)
+	if last.Cursor != "" || last.Rows != 1 || last.TotalRows != 5 || last.Checkpoint != "15" {
+		t.Fatalf("expected the final batch, got %+v", last)
+	}
+	if s.State[runKey] != nil {
+		t.Fatal("expected the final batch to remove the run row")
+	}
+	expectValue(t, s, tom, "myvar", "15")
+}
+
+func TestPruneRunIgnoresStandardKeys(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	eve := newCreator(t, "Org2MSP", "eve", nil)
+	for i := 1; i <= 3; i++ {
+		expectSuccess(t, s.invoke(tom, "update", "myvar", "1", "+"))
+	}
+
+	// ==== Any client may write standard keys, which neither fake nor block a run ====
+	expectSuccess(t, s.invoke(eve, "putstandard", "myvar_PRUNE_BACKUP", `{"cursor":"forged"}`))
+	expectError(t, s.invoke(tom, "prunebatch", "myvar", "1", "forged"), "does not match")
+	first := pruneBatchTest(t, s, tom, "myvar", "1", "")
+	expectSuccess(t, s.invoke(eve, "putstandard", "myvar_PRUNE_BACKUP", "3"))
+	last := pruneBatchTest(t, s, tom, "myvar", "2", first.Cursor)
+	if last.Cursor != "" || last.TotalRows != 3 {
+		t.Fatalf("expected the run to finish, got %+v", last)
+	}
+	expectValue(t, s, tom, "myvar", "3")
+}
+
+func TestDeleteEndsPruneInProgress(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	for i := 1; i <= 3; i++ {
+		expectSuccess(t, s.invoke(tom, "update", "myvar", "1", "+"))
+	}
+	first := pruneBatchTest(t, s, tom, "myvar", "1", "")
+	expectSuccess(t, s.invoke(tom, "delete", "myvar"))
+	if n := countRows(t, s, pruneRunIndexName, "myvar"); n != 0 {
+		t.Fatalf("expected delete to remove the run row, got %d rows", n)
+	}
+
+	// ==== A variable of the same name starts afresh ====
+	expectSuccess(t, s.invoke(tom, "update", "myvar", "2", "+"))
+	expectError(t, s.invoke(tom, "prunebatch", "myvar", "10", first.Cursor), "does not match")
+	expectSuccess(t, s.invoke(tom, "prunesafe", "myvar"))
+	expectValue(t, s, tom, "myvar", "2")
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/**
+ * testStub completes shim.MockStub for the high-throughput functions: it carries the creator of each call
+ * and a controllable transaction time.
+ */
+type testStub struct {
+	*shim.MockStub
+	cc      *SmartContract
+	args    [][]byte
+	creator []byte
+	now     time.Time
+	txCount int
+}
+
+func newTestStub() *testStub {
+	cc := new(SmartContract)
+	return &testStub{
+		MockStub: shim.NewMockStub("highthroughput", cc),
+		cc:       cc,
+		now:      time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// invoke runs one transaction submitted by creator
+func (s *testStub) invoke(creator []byte, function string, args ...string) sc.Response {
+	s.txCount++
+	txID := fmt.Sprintf("tx%d", s.txCount)
+	s.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		s.args = append(s.args, []byte(arg))
+	}
+	s.creator = creator
+	s.MockTransactionStart(txID)
+	defer s.MockTransactionEnd(txID)
+	return s.cc.Invoke(s)
+}
+
+// putLegacy writes a row the way chaincode versions without definitions or timestamps did
+func (s *testStub) putLegacy(t *testing.T, name string, op string, value string) {
+	s.txCount++
+	txID := fmt.Sprintf("tx%d", s.txCount)
+	s.MockTransactionStart(txID)
+	defer s.MockTransactionEnd(txID)
+	key, err := s.CreateCompositeKey(deltaIndexName, []string{name, op, value, txID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutState(key, []byte{0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *testStub) advance(d time.Duration) {
+	s.now = s.now.Add(d)
+}
+
+func (s *testStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *testStub) GetStringArgs() []string {
+	args := []string{}
+	for _, arg := range s.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	return args[0], args[1:]
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now.Unix(), Nanos: int32(s.now.Nanosecond())}, nil
+}
+
+// attributesOID is the certificate extension in which the Fabric CA stores the attributes read by cid
+var attributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// newCreator returns a serialized identity of mspID named commonName, with the given certificate attributes
+func newCreator(t *testing.T, mspID string, commonName string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if len(attrs) > 0 {
+		attrsBytes, err := json.Marshal(map[string]map[string]string{"attrs": attrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: attributesOID, Value: attrsBytes}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+func expectSuccess(t *testing.T, resp sc.Response) string {
+	t.Helper()
+	if resp.Status != shim.OK {
+		t.Fatalf("expected success, got %d: %s", resp.Status, resp.Message)
+	}
+	return string(resp.Payload)
+}
+
+func expectError(t *testing.T, resp sc.Response, contains string) {
+	t.Helper()
+	if resp.Status == shim.OK {
+		t.Fatalf("expected an error containing %q, got success: %s", contains, resp.Payload)
+	}
+	if !strings.Contains(resp.Message, contains) {
+		t.Fatalf("expected an error containing %q, got: %s", contains, resp.Message)
+	}
+}
+
+// expectValue checks the aggregate value returned by get
+func expectValue(t *testing.T, s *testStub, creator []byte, name string, value string) {
+	t.Helper()
+	if got := expectSuccess(t, s.invoke(creator, "get", name)); got != value {
+		t.Fatalf("expected %s to be %s, got %s", name, value, got)
+	}
+}
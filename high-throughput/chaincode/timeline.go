@@ -0,0 +1,291 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Point-in-time queries. Every delta row holds the timestamp of the transaction that added it, as set by the
+ * submitting client, so the value of a variable as of a time T is the sum of the delta rows timestamped
+ * before T. Rows deleted by pruning or compaction are not lost to these queries: when rows are folded into
+ * the checkpoint, they are also added to a rollup row per period of rollupPeriod, keyed by the start of the
+ * period. A rollup counts in full for any T at or after the end of its period, so values remain exact at
+ * period boundaries, while a T inside a rolled up period cannot be answered any more and is refused.
+ * Delta rows written before timestamps were recorded are taken as dated at the Unix epoch.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// rollupIndexName is the composite key under which the rollups of folded delta rows are stored
+const rollupIndexName = "varName~period"
+
+// rollupPeriod is the length of the periods folded delta rows are rolled up by
+const rollupPeriod = time.Hour
+
+// rollups holds aggregates of delta rows by the Unix time of the start of their period
+type rollups map[int64]*big.Int
+
+/**
+ * Adds a delta to the rollup of the period of its timestamp.
+ *
+ * @param t The timestamp of the delta row
+ * @param value The delta in units of 10^-scale of the variable
+ */
+func (r rollups) add(t time.Time, value *big.Int) {
+	start := t.Truncate(rollupPeriod).Unix()
+	if r[start] == nil {
+		r[start] = new(big.Int)
+	}
+	r[start].Add(r[start], value)
+}
+
+/**
+ * Returns the timestamp of the current transaction as stored in delta rows.
+ *
+ * @param APIstub The chaincode shim
+ *
+ * @return The timestamp in RFC 3339 format with nanoseconds
+ */
+func deltaTimestamp(APIstub shim.ChaincodeStubInterface) (string, error) {
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Could not retrieve the transaction timestamp: %s", err.Error())
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format(time.RFC3339Nano), nil
+}
+
+/**
+ * Reads the timestamp held by a delta row.
+ *
+ * @param rowValue The value of the delta row
+ *
+ * @return The timestamp, or the Unix epoch for rows written before timestamps were recorded
+ */
+func parseDeltaTimestamp(rowValue []byte) (time.Time, error) {
+	if len(rowValue) == 1 && rowValue[0] == 0x00 {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(rowValue))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Could not read the timestamp of a delta row: %s", err.Error())
+	}
+	return t, nil
+}
+
+/**
+ * Retrieves the value of a variable as of a point in time, counting the deltas of transactions timestamped
+ * before it. The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> the point in time, in RFC 3339 format, e.g. 2019-06-01T12:00:00Z
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the getasof invocation
+ *
+ * @return A response structure holding the value
+ */
+func (s *SmartContract) getAsOf(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	asOf, err := time.Parse(time.RFC3339Nano, args[1])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Time must be in RFC 3339 format: %s", err.Error()))
+	}
+
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+	err = authorizeVariable(APIstub, v, permissionRead)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	value, err := valueAsOf(APIstub, v, asOf)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(formatDecimal(value, v.Scale)))
+}
+
+/**
+ * Retrieves the sum of the deltas of a variable from transactions timestamped from a start time, included,
+ * to an end time, excluded. The args array contains the following arguments:
+ *	- args[0] -> name of the variable
+ *	- args[1] -> start of the window, in RFC 3339 format
+ *	- args[2] -> end of the window, in RFC 3339 format
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the getwindow invocation
+ *
+ * @return A response structure holding the sum
+ */
+func (s *SmartContract) getWindow(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+
+	name := args[0]
+	from, err := time.Parse(time.RFC3339Nano, args[1])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Start time must be in RFC 3339 format: %s", err.Error()))
+	}
+	to, err := time.Parse(time.RFC3339Nano, args[2])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("End time must be in RFC 3339 format: %s", err.Error()))
+	}
+	if to.Before(from) {
+		return shim.Error("End time must not be before start time")
+	}
+
+	v, err := getVariable(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if v == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+	err = authorizeVariable(APIstub, v, permissionRead)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	valueFrom, err := valueAsOf(APIstub, v, from)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	valueTo, err := valueAsOf(APIstub, v, to)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(formatDecimal(valueTo.Sub(valueTo, valueFrom), v.Scale)))
+}
+
+/**
+ * Computes the value of a variable as of a point in time from its rollups and the delta rows timestamped
+ * before it.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param asOf The point in time
+ *
+ * @return The value in units of 10^-scale of the variable
+ */
+func valueAsOf(APIstub shim.ChaincodeStubInterface, v *variable, asOf time.Time) (*big.Int, error) {
+	total := new(big.Int)
+
+	// Add the rollups of the periods ended by then
+	rollupResultsIterator, err := APIstub.GetStateByPartialCompositeKey(rollupIndexName, []string{v.Name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve rollups for %s: %s", v.Name, err.Error())
+	}
+	defer rollupResultsIterator.Close()
+
+	for rollupResultsIterator.HasNext() {
+		responseRange, err := rollupResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		startUnix, err := strconv.ParseInt(keyParts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the period of a rollup: %s", err.Error())
+		}
+		start := time.Unix(startUnix, 0)
+		end := start.Add(rollupPeriod)
+
+		if !asOf.Before(end) {
+			value, err := parseSignedDecimal(string(responseRange.Value), v.Scale)
+			if err != nil {
+				return nil, err
+			}
+			total.Add(total, value)
+		} else if asOf.After(start) {
+			return nil, fmt.Errorf("Deltas of %s between %s and %s were pruned, the value is only known as of %s or %s", v.Name,
+				start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+		}
+	}
+
+	// Add the delta rows from before then
+	deltaResultsIterator, err := APIstub.GetStateByPartialCompositeKey(deltaIndexName, []string{v.Name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve value for %s: %s", v.Name, err.Error())
+	}
+	defer deltaResultsIterator.Close()
+
+	for deltaResultsIterator.HasNext() {
+		responseRange, err := deltaResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		rowTime, err := parseDeltaTimestamp(responseRange.Value)
+		if err != nil {
+			return nil, err
+		}
+		if !rowTime.Before(asOf) {
+			continue
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := signedDelta(keyParts[1], keyParts[2], v.Scale)
+		if err != nil {
+			return nil, err
+		}
+		total.Add(total, value)
+	}
+	return total, nil
+}
+
+/**
+ * Adds aggregates of folded delta rows to the rollups of their periods.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param periods The aggregates by period
+ *
+ * @return An error if a rollup could not be updated
+ */
+func addRollups(APIstub shim.ChaincodeStubInterface, v *variable, periods rollups) error {
+	for start, value := range periods {
+		// Zero-padded, so that rollups sort by period
+		rollupKey, err := APIstub.CreateCompositeKey(rollupIndexName, []string{v.Name, fmt.Sprintf("%020d", start)})
+		if err != nil {
+			return fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+		}
+		rollupBytes, err := APIstub.GetState(rollupKey)
+		if err != nil {
+			return fmt.Errorf("Could not retrieve a rollup of %s: %s", v.Name, err.Error())
+		}
+
+		total := new(big.Int)
+		if rollupBytes != nil {
+			total, err = parseSignedDecimal(string(rollupBytes), v.Scale)
+			if err != nil {
+				return err
+			}
+		}
+		err = APIstub.PutState(rollupKey, []byte(formatDecimal(total.Add(total, value), v.Scale)))
+		if err != nil {
+			return fmt.Errorf("Could not update a rollup of %s: %s", v.Name, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func expectAsOf(t *testing.T, s *testStub, creator []byte, name string, asOf string, value string) {
+	t.Helper()
+	if got := expectSuccess(t, s.invoke(creator, "getasof", name, asOf)); got != value {
+		t.Fatalf("expected %s to be %s as of %s, got %s", name, value, asOf, got)
+	}
+}
+
+func expectWindow(t *testing.T, s *testStub, creator []byte, name string, from string, to string, value string) {
+	t.Helper()
+	if got := expectSuccess(t, s.invoke(creator, "getwindow", name, from, to)); got != value {
+		t.Fatalf("expected the deltas of %s from %s to %s to sum to %s, got %s", name, from, to, value, got)
+	}
+}
+
+func TestPointInTimeQueriesSurvivePruning(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+
+	// 12:00 +10, 12:30 +5, 13:15 -3, 14:05 +1
+	expectSuccess(t, s.invoke(tom, "update", "myvar", "10", "+"))
+	s.advance(30 * time.Minute)
+	expectSuccess(t, s.invoke(tom, "update", "myvar", "5", "+"))
+	s.advance(45 * time.Minute)
+	expectSuccess(t, s.invoke(tom, "update", "myvar", "3", "-"))
+	s.advance(50 * time.Minute)
+	expectSuccess(t, s.invoke(tom, "update", "myvar", "1", "+"))
+
+	expectAsOf(t, s, tom, "myvar", "2019-06-01T12:00:00Z", "0")
+	expectAsOf(t, s, tom, "myvar", "2019-06-01T12:30:00Z", "10")
+	expectAsOf(t, s, tom, "myvar", "2019-06-01T13:30:00Z", "12")
+	expectAsOf(t, s, tom, "myvar", "2019-06-01T15:00:00Z", "13")
+	expectWindow(t, s, tom, "myvar", "2019-06-01T12:00:00Z", "2019-06-01T13:00:00Z", "15")
+	expectWindow(t, s, tom, "myvar", "2019-06-01T13:00:00Z", "2019-06-01T14:10:00Z", "-2")
+
+	// ==== Pruned rows are kept in hourly rollups ====
+	expectSuccess(t, s.invoke(tom, "prunesafe", "myvar"))
+	if n := countRows(t, s, rollupIndexName, "myvar"); n != 3 {
+		t.Fatalf("expected a rollup per hour, got %d", n)
+	}
+	s.advance(15 * time.Minute)
+	expectSuccess(t, s.invoke(tom, "update", "myvar", "2", "+"))
+
+	expectAsOf(t, s, tom, "myvar", "2019-06-01T13:00:00Z", "15")
+	expectAsOf(t, s, tom, "myvar", "2019-06-01T14:00:00Z", "12")
+	expectAsOf(t, s, tom, "myvar", "2019-06-01T15:00:00Z", "15")
+	expectWindow(t, s, tom, "myvar", "2019-06-01T13:00:00Z", "2019-06-01T14:00:00Z", "-3")
+	expectValue(t, s, tom, "myvar", "15")
+	expectError(t, s.invoke(tom, "getasof", "myvar", "2019-06-01T13:30:00Z"), "were pruned")
+	expectError(t, s.invoke(tom, "getwindow", "myvar", "2019-06-01T12:00:00Z", "2019-06-01T14:10:00Z"), "were pruned")
+
+	expectError(t, s.invoke(tom, "getasof", "myvar", "yesterday"), "RFC 3339")
+	expectError(t, s.invoke(tom, "getwindow", "myvar", "2019-06-01T14:00:00Z", "2019-06-01T13:00:00Z"), "must not be before")
+	expectError(t, s.invoke(tom, "getasof", "other", "2019-06-01T13:00:00Z"), "No variable by the name other exists")
+}
+
+func TestLegacyRowsDateFromTheEpoch(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	s.putLegacy(t, "legacy", "+", "4")
+	expectSuccess(t, s.invoke(tom, "update", "legacy", "1", "+"))
+
+	expectAsOf(t, s, tom, "legacy", "1970-01-01T00:00:00Z", "0")
+	expectAsOf(t, s, tom, "legacy", "2000-01-01T00:00:00Z", "4")
+	expectAsOf(t, s, tom, "legacy", "2019-06-01T13:00:00Z", "5")
+}
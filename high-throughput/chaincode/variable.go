@@ -0,0 +1,291 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Every aggregate variable has a definition row, written by the first update of the variable, which
+ * declares how its values are interpreted. Definitions are only read by later updates, so they do not
+ * cause read conflicts between concurrent updates of an existing variable. Concurrent first updates of
+ * the same variable do conflict, so the first update should be committed before parallel updates start.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// deltaIndexName is the composite key under which the delta rows of every variable are stored
+const deltaIndexName = "varName~op~value~txID"
+
+// variableIndexName is the composite key under which variable definitions are stored
+const variableIndexName = "variable"
+
+// variable is the definition row of an aggregate variable
+type variable struct {
+	Name    string `json:"name"`
+	Scale   int    `json:"scale"`             // digits after the decimal point of every value of the variable
+	Min     string `json:"min,omitempty"`     // lower bound of a bounded variable, empty when unbounded below
+	Max     string `json:"max,omitempty"`     // upper bound of a bounded variable, empty when unbounded above
+	Buckets int    `json:"buckets,omitempty"` // number of quota buckets of a bounded variable
+
+	// Ownership and access control, see acl.go; empty for variables defined before owners were recorded
+	Owner        string       `json:"owner,omitempty"`        // identity of the owning client
+	OwnerMSP     string       `json:"ownerMsp,omitempty"`     // organization of the owning client
+	PendingOwner string       `json:"pendingOwner,omitempty"` // identity the variable was offered to with transferowner
+	ACL          *variableACL `json:"acl,omitempty"`
+
+	legacy bool // synthesized from the delta rows of a variable updated before definitions were stored
+}
+
+/**
+ * Retrieves the definition of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The definition, or nil if the variable was never updated. Variables updated before definitions
+ * were stored get one synthesized from their delta rows, see legacyVariable.
+ */
+func getVariable(APIstub shim.ChaincodeStubInterface, name string) (*variable, error) {
+	variableKey, err := APIstub.CreateCompositeKey(variableIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+
+	variableBytes, err := APIstub.GetState(variableKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the definition of %s: %s", name, err.Error())
+	} else if variableBytes == nil {
+		return legacyVariable(APIstub, name)
+	}
+
+	v := &variable{}
+	err = json.Unmarshal(variableBytes, v)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode the definition of %s: %s", name, err.Error())
+	}
+	return v, nil
+}
+
+/**
+ * Synthesizes the definition of a variable whose delta rows predate definitions. Its scale is the
+ * smallest that holds every legacy value exactly, and it has no owner, see acl.go. The definition is
+ * only stored by the next update of the variable, so queries can use it without writing.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The definition, or nil if the variable has no delta rows
+ */
+func legacyVariable(APIstub shim.ChaincodeStubInterface, name string) (*variable, error) {
+	deltaResultsIterator, err := APIstub.GetStateByPartialCompositeKey(deltaIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve value for %s: %s", name, err.Error())
+	}
+	defer deltaResultsIterator.Close()
+
+	var v *variable
+	for deltaResultsIterator.HasNext() {
+		responseRange, err := deltaResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		_, scale, err := parseLegacyDecimal(keyParts[2])
+		if err != nil {
+			return nil, fmt.Errorf("Could not define legacy variable %s: %s", name, err.Error())
+		}
+		if v == nil {
+			v = &variable{Name: name, legacy: true}
+		}
+		if scale > v.Scale {
+			v.Scale = scale
+		}
+	}
+	return v, nil
+}
+
+/**
+ * Stores the definition of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition to store
+ *
+ * @return An error if the definition could not be stored
+ */
+func putVariable(APIstub shim.ChaincodeStubInterface, v *variable) error {
+	variableKey, err := APIstub.CreateCompositeKey(variableIndexName, []string{v.Name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+	}
+
+	variableBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(variableKey, variableBytes)
+}
+
+/**
+ * Deletes the definition of a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return An error if the definition could not be deleted
+ */
+func delVariable(APIstub shim.ChaincodeStubInterface, name string) error {
+	variableKey, err := APIstub.CreateCompositeKey(variableIndexName, []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	return APIstub.DelState(variableKey)
+}
+
+/**
+ * Adds a delta row to a variable, with an operation matching the sign of the delta. The row holds the
+ * timestamp of the transaction, see timeline.go.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param units The delta in units of 10^-scale of the variable
+ *
+ * @return An error if the row could not be added
+ */
+func putDelta(APIstub shim.ChaincodeStubInterface, v *variable, units *big.Int) error {
+	op := "+"
+	if units.Sign() < 0 {
+		op = "-"
+	}
+	value := formatDecimal(new(big.Int).Abs(units), v.Scale)
+
+	compositeKey, err := APIstub.CreateCompositeKey(deltaIndexName, []string{v.Name, op, value, APIstub.GetTxID()})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", v.Name, err.Error())
+	}
+	txTime, err := deltaTimestamp(APIstub)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(compositeKey, []byte(txTime))
+}
+
+/**
+ * Converts the operation and value of a delta row into a signed number of units.
+ *
+ * @param op The operation of the row, "+" or "-"
+ * @param valueStr The value of the row
+ * @param scale The number of digits after the decimal point of the variable
+ *
+ * @return The delta in units of 10^-scale of the variable
+ */
+func signedDelta(op string, valueStr string, scale int) (*big.Int, error) {
+	value, err := parseDecimal(valueStr, scale)
+	if err != nil {
+		// Rows written before scales were declared may use exponent notation or carry a sign
+		value, err = parseLegacyUnits(valueStr, scale)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch op {
+	case "+":
+		return value, nil
+	case "-":
+		return value.Neg(value), nil
+	}
+	return nil, fmt.Errorf("Unrecognized operation %s", op)
+}
+
+/**
+ * Computes the aggregate value of a variable from all of its delta rows, optionally deleting each row
+ * once it has been added to the aggregate.
+ *
+ * @param APIstub The chaincode shim
+ * @param v The definition of the variable
+ * @param deleteRows Whether to delete the delta rows
+ * @param periods If not nil, the rows are also added to the rollups of their periods
+ *
+ * @return The aggregate in units of 10^-scale of the variable and the keys of the deleted rows
+ */
+func sumDeltas(APIstub shim.ChaincodeStubInterface, v *variable, deleteRows bool, periods rollups) (*big.Int, []string, error) {
+	deltaResultsIterator, err := APIstub.GetStateByPartialCompositeKey(deltaIndexName, []string{v.Name})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not retrieve value for %s: %s", v.Name, err.Error())
+	}
+	defer deltaResultsIterator.Close()
+
+	total := new(big.Int)
+	deleted := []string{}
+	for deltaResultsIterator.HasNext() {
+		responseRange, err := deltaResultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Split the composite key into its component parts
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := signedDelta(keyParts[1], keyParts[2], v.Scale)
+		if err != nil {
+			return nil, nil, err
+		}
+		total.Add(total, value)
+
+		if periods != nil {
+			rowTime, err := parseDeltaTimestamp(responseRange.Value)
+			if err != nil {
+				return nil, nil, err
+			}
+			periods.add(rowTime, value)
+		}
+
+		if deleteRows {
+			err = APIstub.DelState(responseRange.Key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not delete delta row: %s", err.Error())
+			}
+			deleted = append(deleted, responseRange.Key)
+		}
+	}
+	return total, deleted, nil
+}
+
+/**
+ * Deletes every row stored under a composite key index for a variable.
+ *
+ * @param APIstub The chaincode shim
+ * @param indexName The composite key index
+ * @param name The name of the variable
+ *
+ * @return An error if the rows could not be deleted
+ */
+func deleteRows(APIstub shim.ChaincodeStubInterface, indexName string, name string) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(indexName, []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not retrieve %s rows for %s: %s", indexName, name, err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		err = APIstub.DelState(responseRange.Key)
+		if err != nil {
+			return fmt.Errorf("Could not delete %s row: %s", indexName, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestUpdateSumsExactDecimals(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	expectSuccess(t, s.invoke(tom, "update", "balance", "0.1", "+", "2"))
+	expectSuccess(t, s.invoke(tom, "update", "balance", "0.2", "+"))
+	expectSuccess(t, s.invoke(tom, "update", "balance", "0.05", "-"))
+	expectValue(t, s, tom, "balance", "0.25")
+
+	expectError(t, s.invoke(tom, "update", "balance", "0.001", "+"), "more than 2 digits after the decimal point")
+	expectError(t, s.invoke(tom, "update", "balance", "1e3", "+"), "not a decimal number")
+	expectError(t, s.invoke(tom, "update", "balance", "-1", "+"), "not a decimal number")
+	expectError(t, s.invoke(tom, "update", "balance", "1", "+", "3"), "declared with scale 2")
+	expectError(t, s.invoke(tom, "update", "balance", "1", "*"), "Operator * is unrecognized")
+	expectError(t, s.invoke(tom, "update", "balance", "123456789012345678901234567890123456789", "+"), "overflows")
+	expectError(t, s.invoke(tom, "update", "other", "1", "+", "19"), "Scale must be a whole number between 0 and 18")
+
+	// trailing zeros beyond the scale are not rounding
+	expectSuccess(t, s.invoke(tom, "update", "balance", "0.500", "+"))
+	expectValue(t, s, tom, "balance", "0.75")
+}
+
+func TestLegacyVariableGetsSynthesizedDefinition(t *testing.T) {
+	s := newTestStub()
+	tom := newCreator(t, "Org1MSP", "tom", nil)
+	s.putLegacy(t, "legacy", "+", "1.5")
+	s.putLegacy(t, "legacy", "+", "1e3")
+	s.putLegacy(t, "legacy", "+", "-0.25")
+	s.putLegacy(t, "legacy", "-", "2")
+
+	expectValue(t, s, tom, "legacy", "999.25")
+	variableKey, _ := s.CreateCompositeKey(variableIndexName, []string{"legacy"})
+	if s.State[variableKey] != nil {
+		t.Fatal("get must not store the synthesized definition")
+	}
+
+	// ==== The next update stores the definition with the scale of the legacy rows ====
+	expectError(t, s.invoke(tom, "update", "legacy", "0.001", "+"), "more than 2 digits after the decimal point")
+	expectSuccess(t, s.invoke(tom, "update", "legacy", "0.75", "+"))
+	v, err := getVariable(s, "legacy")
+	if err != nil || v == nil || v.legacy || v.Scale != 2 || v.Owner != "" {
+		t.Fatalf("expected a stored definition of scale 2 without owner, got %+v, %v", v, err)
+	}
+	expectValue(t, s, tom, "legacy", "1000.00")
+
+	s.putLegacy(t, "broken", "+", "NaN")
+	expectError(t, s.invoke(tom, "get", "broken"), "Could not define legacy variable broken")
+}
+
+func TestParseLegacyDecimal(t *testing.T) {
+	for str, scale := range map[string]int{"1": 0, "1e3": 0, "1.5": 1, "-0.25": 2, "1.5e-3": 4, "2.50": 1} {
+		_, got, err := parseLegacyDecimal(str)
+		if err != nil || got != scale {
+			t.Fatalf("expected %s to need scale %d, got %d, %v", str, scale, got, err)
+		}
+	}
+	if _, _, err := parseLegacyDecimal("1e-19"); err == nil {
+		t.Fatal("expected more than 18 digits after the decimal point to fail")
+	}
+	if units, err := parseLegacyUnits("-1.5e1", 2); err != nil || units.String() != "-1500" {
+		t.Fatalf("unexpected units %v, %v", units, err)
+	}
+}
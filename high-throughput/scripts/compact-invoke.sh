@@ -0,0 +1,11 @@
+#
+# Copyright IBM Corp All Rights Reserved
+#
+# SPDX-License-Identifier: Apache-2.0
+#
+
+# The rows are a JSON array, as returned by deltas-invoke.sh, escaped here to fit in the JSON of the arguments
+ROWS=$(echo "$2" | sed 's/"/\\"/g')
+
+peer chaincode invoke -o orderer.example.com:7050  --tls $CORE_PEER_TLS_ENABLED --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem  -C $CHANNEL_NAME -n $CC_NAME -c '{"Args":["compact","'$1'","'"$ROWS"'"]}'
+
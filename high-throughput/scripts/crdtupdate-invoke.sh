@@ -0,0 +1,15 @@
+#
+# Copyright IBM Corp All Rights Reserved
+#
+# SPDX-License-Identifier: Apache-2.0
+#
+
+# Usage: ./crdtupdate-invoke.sh type name arg...
+ARGS='"crdtupdate"'
+for ARG in "$@"
+do
+	ARGS=$ARGS',"'$ARG'"'
+done
+
+peer chaincode invoke -o orderer.example.com:7050  --tls $CORE_PEER_TLS_ENABLED --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem  -C $CHANNEL_NAME -n $CC_NAME -c '{"Args":['"$ARGS"']}'
+
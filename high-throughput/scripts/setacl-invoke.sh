@@ -0,0 +1,14 @@
+#
+# Copyright IBM Corp All Rights Reserved
+#
+# SPDX-License-Identifier: Apache-2.0
+#
+
+# The optional type names a CRDT value instead of a variable
+TYPE_ARG=${3:+',"'$3'"'}
+
+# The access control list is a JSON object, escaped here to fit in the JSON of the arguments
+ACL=$(echo "$2" | sed 's/"/\\"/g')
+
+peer chaincode invoke -o orderer.example.com:7050  --tls $CORE_PEER_TLS_ENABLED --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem  -C $CHANNEL_NAME -n $CC_NAME -c '{"Args":["setacl","'$1'","'"$ACL"'"'$TYPE_ARG']}'
+